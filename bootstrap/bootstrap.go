@@ -3,6 +3,8 @@ package bootstrap
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
+	"strconv"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -15,9 +17,20 @@ type Bootstrapper struct {
 	cloudAPI        CloudAPI
 	etcdAPI         EtcdAPI
 	protocol        string
+	peerPort        int
+	clientPort      int
+	advertiseDomain string
+	clusterToken    string
 	additionalFlags []string
 }
 
+const (
+	// DefaultPeerPort is the default port etcd listens for peers on.
+	DefaultPeerPort = 2380
+	// DefaultClientPort is the default port etcd listens for clients on.
+	DefaultClientPort = etcd.DefaultClientPort
+)
+
 type clusterState string
 
 const (
@@ -32,7 +45,8 @@ const (
 type CloudAPI interface {
 	// GetInstances returns all the non-terminated instances that will be part of the etcd cluster.
 	GetInstances() ([]cloud.Instance, error)
-	// GetLocalInstance returns the local machine instance.
+	// GetLocalInstance returns the local machine instance. If it has a separate peer endpoint, the peer endpoint must
+	// be the IP of a local interface, as it's listened on for peer traffic.
 	GetLocalInstance() (cloud.Instance, error)
 	// GetLocalIP returns the IP of a local interface to listen on. This should be an externally accessible IP,
 	// and may be the same as the endpoint returned in GetLocalInstance but this is not required.
@@ -42,8 +56,9 @@ type CloudAPI interface {
 // EtcdAPI returns information from the etcd cluster API.
 type EtcdAPI interface {
 	Members() ([]etcd.Member, error)
-	AddMemberByPeerURL(string) error
+	AddMemberByPeerURLs([]string) error
 	RemoveMemberByName(string) error
+	UpdateMemberPeerURLs(name string, peerURLs []string) error
 }
 
 // Option for configuring the bootstrapper.
@@ -84,12 +99,50 @@ func WithTLS(serverCA, serverCert, serverKey, peerCA, peerCert, peerKey string)
 	}
 }
 
+// WithPorts sets the ports etcd listens for peers and clients on, e.g. to run several clusters on the same hosts.
+func WithPorts(peerPort, clientPort int) Option {
+	return func(b *Bootstrapper) error {
+		for _, port := range []int{peerPort, clientPort} {
+			if port <= 0 || port > 65535 {
+				return fmt.Errorf("invalid port %d", port)
+			}
+		}
+		if peerPort == clientPort {
+			return fmt.Errorf("the peer and client ports must differ, but were both %d", peerPort)
+		}
+		b.peerPort = peerPort
+		b.clientPort = clientPort
+		return nil
+	}
+}
+
+// WithAdvertiseDomain advertises a peer and client URL with the DNS name of each instance, <name>.<domain>, along
+// with the URLs of its endpoints. The DNS names must resolve to the instances' endpoints, e.g. the per node records
+// published by a DNS registration provider.
+func WithAdvertiseDomain(domain string) Option {
+	return func(b *Bootstrapper) error {
+		b.advertiseDomain = strings.Trim(domain, ".")
+		return nil
+	}
+}
+
+// WithClusterToken sets the initial cluster token, which must be unique to each cluster so that members of clusters on
+// the same hosts can't join each other's cluster.
+func WithClusterToken(token string) Option {
+	return func(b *Bootstrapper) error {
+		b.clusterToken = token
+		return nil
+	}
+}
+
 // New creates a new bootstrapper.
 func New(cloudAPI CloudAPI, etcdAPI EtcdAPI, opts ...Option) (*Bootstrapper, error) {
 	bootstrapper := &Bootstrapper{
-		cloudAPI: cloudAPI,
-		etcdAPI:  etcdAPI,
-		protocol: "http",
+		cloudAPI:   cloudAPI,
+		etcdAPI:    etcdAPI,
+		protocol:   "http",
+		peerPort:   DefaultPeerPort,
+		clientPort: DefaultClientPort,
 	}
 	for _, opt := range opts {
 		if err := opt(bootstrapper); err != nil {
@@ -114,6 +167,10 @@ func (b *Bootstrapper) GenerateEtcdFlagsFile(outputFilename string) error {
 func (b *Bootstrapper) GenerateEtcdFlags() (string, error) {
 	log.Infof("Generating etcd cluster flags")
 
+	if err := b.warnOfZoneQuorum(); err != nil {
+		return "", err
+	}
+
 	clusterExists, err := b.clusterExists()
 	if err != nil {
 		return "", err
@@ -130,6 +187,9 @@ func (b *Bootstrapper) GenerateEtcdFlags() (string, error) {
 	if nodeExistsInCluster {
 		// etcd expects the cluster state to be set to `new` when the node is already part of the cluster.
 		log.Info("Node already exists in cluster - treating as an existing node in a new cluster")
+		if err := b.updateLocalPeerURLs(); err != nil {
+			return "", err
+		}
 		return b.createEtcdConfigForNewCluster()
 	}
 
@@ -186,7 +246,7 @@ func (b *Bootstrapper) createEtcdConfigForNewCluster() (string, error) {
 	}
 	var initialClusterURLs []string
 	for _, instance := range instances {
-		initialClusterURLs = append(initialClusterURLs, b.peerURL(instance.Endpoint))
+		initialClusterURLs = append(initialClusterURLs, b.instancePeerURLs(instance)...)
 	}
 	return b.createEtcdConfig(newCluster, initialClusterURLs)
 }
@@ -196,10 +256,10 @@ func (b *Bootstrapper) createEtcdConfigForNewCluster() (string, error) {
 //
 // This should only be used for a node that is joining an already existing cluster. The node should
 // not be registered yet in the cluster (its name does not appear in the cluster member list). However,
-// its peerURL should have been added so the cluster will accept it when it starts up.
+// its peerURLs should have been added so the cluster will accept it when it starts up.
 //
 // The local node must also be included in the initial cluster list, which should happen if its
-// peerURL was added in the reconcile step.
+// peerURLs were added in the reconcile step.
 func (b *Bootstrapper) createEtcdConfigForExistingCluster() (string, error) {
 	members, err := b.etcdAPI.Members()
 	if err != nil {
@@ -207,7 +267,7 @@ func (b *Bootstrapper) createEtcdConfigForExistingCluster() (string, error) {
 	}
 	var initialClusterURLs []string
 	for _, member := range members {
-		initialClusterURLs = append(initialClusterURLs, member.PeerURL)
+		initialClusterURLs = append(initialClusterURLs, member.PeerURLs...)
 	}
 	return b.createEtcdConfig(existingCluster, initialClusterURLs)
 }
@@ -220,7 +280,8 @@ func (b *Bootstrapper) createEtcdConfig(state clusterState, initialPeerURLs []st
 	// Should be "new" in all cases except when joining an existing cluster, when it should be "existing".
 	envs := []string{"ETCD_INITIAL_CLUSTER_STATE=" + string(state)}
 
-	// Construct the format "name=peerURL" for all of the "initial" nodes in the cluster.
+	// Construct the format "name=peerURL" for all of the "initial" nodes in the cluster, repeating the name for
+	// each peerURL of a node with several.
 	// "initial" simply means the nodes that have already joined the cluster. It doesn't necessarily
 	// mean the very initial nodes - the naming is confusing, unfortunately.
 	initialClusterValue, err := b.initialClusterFlagValue(initialPeerURLs)
@@ -228,6 +289,9 @@ func (b *Bootstrapper) createEtcdConfig(state clusterState, initialPeerURLs []st
 		return "", err
 	}
 	envs = append(envs, fmt.Sprintf("ETCD_INITIAL_CLUSTER=%s", initialClusterValue))
+	if b.clusterToken != "" {
+		envs = append(envs, fmt.Sprintf("ETCD_INITIAL_CLUSTER_TOKEN=%s", b.clusterToken))
+	}
 
 	// The name should be unique across the cluster and should match the name used in INITIAL_CLUSTER.
 	// This value will also be stored in etcd itself once the node has joined the cluster.
@@ -242,17 +306,35 @@ func (b *Bootstrapper) createEtcdConfig(state clusterState, initialPeerURLs []st
 
 	// Advertise using the URL that other nodes and clients use to connect to this node.
 	// This should typically be the domain name for this node, or IP if not using domain names.
-	envs = append(envs, fmt.Sprintf("ETCD_INITIAL_ADVERTISE_PEER_URLS=%s", b.peerURL(local.Endpoint)))
-	envs = append(envs, fmt.Sprintf("ETCD_ADVERTISE_CLIENT_URLS=%s", b.clientURL(local.Endpoint)))
+	// Peers may use a separate endpoint, e.g. to keep replication traffic on a dedicated network.
+	// Dual-stack instances advertise a peer and client URL for each of their addresses, and instances advertise their
+	// DNS name along with their endpoints if there's an advertise domain.
+	envs = append(envs, fmt.Sprintf("ETCD_INITIAL_ADVERTISE_PEER_URLS=%s",
+		strings.Join(b.instancePeerURLs(local), ",")))
+	envs = append(envs, fmt.Sprintf("ETCD_ADVERTISE_CLIENT_URLS=%s",
+		strings.Join(b.instanceClientURLs(local), ",")))
 
 	// Since we listen on the network interface, we have to specify an IP address here so etcd
-	// knows what to bind to.
+	// knows what to bind to. A separate peer endpoint is an IP, so peer traffic is only listened for on it.
+	// Dual-stack instances listen on the address of each family. Templated endpoints may be hostnames, which can't be
+	// listened on, so they're skipped in favour of the local IP.
 	localIP, err := b.cloudAPI.GetLocalIP()
 	if err != nil {
 		return "", err
 	}
-	envs = append(envs, fmt.Sprintf("ETCD_LISTEN_PEER_URLS=%s", b.peerURL(localIP)))
-	envs = append(envs, fmt.Sprintf("ETCD_LISTEN_CLIENT_URLS=%s,%s", b.clientURL(localIP), b.clientURL("127.0.0.1")))
+	localPeerIP := localIP
+	if local.PeerEndpoint != "" {
+		localPeerIP = local.PeerEndpoint
+	}
+	localPeerIPs := ipAddresses(append([]string{localPeerIP}, local.PeerAddresses()[1:]...))
+	if len(localPeerIPs) == 0 {
+		localPeerIPs = []string{localIP}
+	}
+	envs = append(envs, fmt.Sprintf("ETCD_LISTEN_PEER_URLS=%s", strings.Join(b.peerURLs(localPeerIPs), ",")))
+	// Clients are also listened for on the loopback address of each family the instance has an address of.
+	localClientIPs := append([]string{localIP}, ipAddresses(local.AdditionalEndpoints)...)
+	localClientIPs = append(localClientIPs, loopbackAddresses(localClientIPs)...)
+	envs = append(envs, fmt.Sprintf("ETCD_LISTEN_CLIENT_URLS=%s", strings.Join(b.clientURLs(localClientIPs), ",")))
 
 	// Add any additional flags. Currently this is only used to add the TLS specific flags which add certs and things.
 	for _, flag := range b.additionalFlags {
@@ -269,9 +351,10 @@ func (b *Bootstrapper) initialClusterFlagValue(initialPeerURLs []string) (string
 	var initialCluster []string
 	// This looks up the node name from the peer URL via a reverse lookup on the instances.
 	for _, instance := range instances {
-		instancePeerURL := b.peerURL(instance.Endpoint)
-		if contains(initialPeerURLs, instancePeerURL) {
-			initialCluster = append(initialCluster, fmt.Sprintf("%s=%s", instance.Name, instancePeerURL))
+		for _, instancePeerURL := range b.instancePeerURLs(instance) {
+			if contains(initialPeerURLs, instancePeerURL) {
+				initialCluster = append(initialCluster, fmt.Sprintf("%s=%s", instance.Name, instancePeerURL))
+			}
 		}
 	}
 
@@ -279,11 +362,103 @@ func (b *Bootstrapper) initialClusterFlagValue(initialPeerURLs []string) (string
 }
 
 func (b *Bootstrapper) peerURL(host string) string {
-	return fmt.Sprintf("%s://%s:2380", b.protocol, host)
+	return fmt.Sprintf("%s://%s", b.protocol, net.JoinHostPort(host, strconv.Itoa(b.peerPort)))
+}
+
+func (b *Bootstrapper) peerURLs(hosts []string) []string {
+	var urls []string
+	for _, host := range hosts {
+		urls = append(urls, b.peerURL(host))
+	}
+	return urls
 }
 
 func (b *Bootstrapper) clientURL(host string) string {
-	return fmt.Sprintf("%s://%s:2379", b.protocol, host)
+	return fmt.Sprintf("%s://%s", b.protocol, net.JoinHostPort(host, strconv.Itoa(b.clientPort)))
+}
+
+func (b *Bootstrapper) clientURLs(hosts []string) []string {
+	var urls []string
+	for _, host := range hosts {
+		urls = append(urls, b.clientURL(host))
+	}
+	return urls
+}
+
+// instancePeerURLs returns the peer URLs the instance advertises, the first of which is its peer address.
+func (b *Bootstrapper) instancePeerURLs(instance cloud.Instance) []string {
+	urls := b.peerURLs(instance.PeerAddresses())
+	if b.advertiseDomain != "" {
+		urls = append(urls, b.peerURL(b.advertiseHost(instance)))
+	}
+	return urls
+}
+
+// instanceClientURLs returns the client URLs the instance advertises.
+func (b *Bootstrapper) instanceClientURLs(instance cloud.Instance) []string {
+	urls := b.clientURLs(instance.ClientAddresses())
+	if b.advertiseDomain != "" {
+		urls = append(urls, b.clientURL(b.advertiseHost(instance)))
+	}
+	return urls
+}
+
+func (b *Bootstrapper) advertiseHost(instance cloud.Instance) string {
+	return instance.Name + "." + b.advertiseDomain
+}
+
+// ipAddresses returns the addresses which are IPs, rather than hostnames.
+func ipAddresses(addresses []string) []string {
+	var ips []string
+	for _, address := range addresses {
+		if net.ParseIP(address) != nil {
+			ips = append(ips, address)
+		}
+	}
+	return ips
+}
+
+// loopbackAddresses returns the loopback address of each family of the addresses. Hostnames are treated as IPv4.
+func loopbackAddresses(addresses []string) []string {
+	var ipv4, ipv6 bool
+	for _, address := range addresses {
+		if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+			ipv6 = true
+		} else {
+			ipv4 = true
+		}
+	}
+	var loopbacks []string
+	if ipv4 {
+		loopbacks = append(loopbacks, "127.0.0.1")
+	}
+	if ipv6 {
+		loopbacks = append(loopbacks, "::1")
+	}
+	return loopbacks
+}
+
+// containsAny returns true if any of the values is in strings.
+func containsAny(strings []string, values []string) bool {
+	for _, value := range values {
+		if contains(strings, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameURLs returns true if both lists contain the same URLs, in any order.
+func sameURLs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, url := range a {
+		if !contains(b, url) {
+			return false
+		}
+	}
+	return true
 }
 
 func contains(strings []string, value string) bool {
@@ -59,11 +59,14 @@ var _ = Describe("Bootstrap", func() {
 			MembersMock:      &Members{},
 			AddMemberMock:    &AddMember{},
 			RemoveMemberMock: &RemoveMember{},
+			UpdateMemberMock: &UpdateMember{},
 		}
 		bootstrapper = &Bootstrapper{
-			cloudAPI: cloudAPIMock,
-			etcdAPI:  etcdAPIMock,
-			protocol: "http",
+			cloudAPI:   cloudAPIMock,
+			etcdAPI:    etcdAPIMock,
+			protocol:   "http",
+			peerPort:   DefaultPeerPort,
+			clientPort: DefaultClientPort,
 		}
 	})
 
@@ -93,12 +96,12 @@ var _ = Describe("Bootstrap", func() {
 		}
 		etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
 			{
-				Name:    localInstanceID,
-				PeerURL: localAdvertisePeerURL,
+				Name:     localInstanceID,
+				PeerURLs: []string{localAdvertisePeerURL},
 			},
 			{
-				Name:    "test-remove-instance-id-1",
-				PeerURL: "http://etcd-remove-me:2380",
+				Name:     "test-remove-instance-id-1",
+				PeerURLs: []string{"http://etcd-remove-me:2380"},
 			},
 		}
 
@@ -130,13 +133,13 @@ var _ = Describe("Bootstrap", func() {
 		By("The etcd API only returns one member, missing the local instance")
 		etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
 			{
-				Name:    "test-add-instance-id-1",
-				PeerURL: "http://endpoint-1:2380",
+				Name:     "test-add-instance-id-1",
+				PeerURLs: []string{"http://endpoint-1:2380"},
 			},
 		}
 
 		By("Returning an error when attempting to add the local instance to the etcd API")
-		etcdAPIMock.AddMemberMock.ExpectedInput = &localAdvertisePeerURL
+		etcdAPIMock.AddMemberMock.ExpectedInput = []string{localAdvertisePeerURL}
 		etcdAPIMock.AddMemberMock.Err = fmt.Errorf("failed to add etcd member")
 		_, err := bootstrapper.GenerateEtcdFlags()
 		Expect(err).ToNot(Succeed())
@@ -183,6 +186,355 @@ var _ = Describe("Bootstrap", func() {
 		})
 	})
 
+	Describe("separate peer network", func() {
+		JustBeforeEach(func() {
+			By("Returning instances with separate peer endpoints")
+			cloudAPIMock.GetLocalInstanceMock.GetLocalInstance.PeerEndpoint = "10.0.0.1"
+			cloudAPIMock.GetInstancesMock.GetInstancesOutput = []cloud.Instance{
+				{
+					Name:         localInstanceID,
+					Endpoint:     localEndpoint,
+					PeerEndpoint: "10.0.0.1",
+				},
+				{
+					Name:         "test-peer-network-instance-id-1",
+					Endpoint:     "test-peer-network-endpoint-1",
+					PeerEndpoint: "10.0.0.2",
+				},
+			}
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{}
+		})
+
+		It("should advertise and listen on the peer endpoint for peers and the endpoint for clients", func() {
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags()
+			flags := strings.Split(etcdFlags, "\n")
+			Expect(err).To(BeNil())
+			Expect(flags).To(ContainElement(fmt.Sprintf("ETCD_INITIAL_CLUSTER=%s=%s,%s=%s",
+				localInstanceID, "http://10.0.0.1:2380",
+				"test-peer-network-instance-id-1", "http://10.0.0.2:2380")))
+			Expect(flags).To(ContainElement("ETCD_INITIAL_ADVERTISE_PEER_URLS=http://10.0.0.1:2380"))
+			Expect(flags).To(ContainElement("ETCD_ADVERTISE_CLIENT_URLS=" + localAdvertiseClientURL))
+			Expect(flags).To(ContainElement("ETCD_LISTEN_PEER_URLS=http://10.0.0.1:2380"))
+			Expect(flags).To(ContainElement(fmt.Sprintf("ETCD_LISTEN_CLIENT_URLS=%v,%v",
+				localListenClientURL, bootstrapper.clientURL("127.0.0.1"))))
+		})
+	})
+
+	Describe("dual-stack network", func() {
+		JustBeforeEach(func() {
+			By("Returning instances with IPv4 endpoints and additional IPv6 endpoints")
+			cloudAPIMock.GetLocalInstanceMock.GetLocalInstance = cloud.Instance{
+				Name:                localInstanceID,
+				Endpoint:            "10.0.0.1",
+				AdditionalEndpoints: []string{"fd00::1"},
+			}
+			cloudAPIMock.GetLocalIPMock.LocalIP = "10.0.0.1"
+			cloudAPIMock.GetInstancesMock.GetInstancesOutput = []cloud.Instance{
+				cloudAPIMock.GetLocalInstanceMock.GetLocalInstance,
+				{
+					Name:                "test-dual-stack-instance-id-1",
+					Endpoint:            "10.0.0.2",
+					AdditionalEndpoints: []string{"fd00::2"},
+				},
+			}
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{}
+		})
+
+		It("should advertise and listen on the peer and client URLs of both families", func() {
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags()
+			flags := strings.Split(etcdFlags, "\n")
+			Expect(err).To(BeNil())
+			Expect(flags).To(ContainElement(fmt.Sprintf("ETCD_INITIAL_CLUSTER=%s=%s,%s=%s,%s=%s,%s=%s",
+				localInstanceID, "http://10.0.0.1:2380",
+				localInstanceID, "http://[fd00::1]:2380",
+				"test-dual-stack-instance-id-1", "http://10.0.0.2:2380",
+				"test-dual-stack-instance-id-1", "http://[fd00::2]:2380")))
+			Expect(flags).To(ContainElement(
+				"ETCD_INITIAL_ADVERTISE_PEER_URLS=http://10.0.0.1:2380,http://[fd00::1]:2380"))
+			Expect(flags).To(ContainElement("ETCD_ADVERTISE_CLIENT_URLS=http://10.0.0.1:2379,http://[fd00::1]:2379"))
+			Expect(flags).To(ContainElement("ETCD_LISTEN_PEER_URLS=http://10.0.0.1:2380,http://[fd00::1]:2380"))
+			Expect(flags).To(ContainElement("ETCD_LISTEN_CLIENT_URLS=http://10.0.0.1:2379,http://[fd00::1]:2379," +
+				"http://127.0.0.1:2379,http://[::1]:2379"))
+		})
+
+		It("should advertise and listen on the peer endpoints of both families", func() {
+			cloudAPIMock.GetLocalInstanceMock.GetLocalInstance.PeerEndpoint = "192.168.0.1"
+			cloudAPIMock.GetLocalInstanceMock.GetLocalInstance.AdditionalPeerEndpoints = []string{"fd01::1"}
+			cloudAPIMock.GetInstancesMock.GetInstancesOutput = []cloud.Instance{
+				cloudAPIMock.GetLocalInstanceMock.GetLocalInstance,
+			}
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags()
+			flags := strings.Split(etcdFlags, "\n")
+			Expect(err).To(BeNil())
+			Expect(flags).To(ContainElement(
+				"ETCD_INITIAL_ADVERTISE_PEER_URLS=http://192.168.0.1:2380,http://[fd01::1]:2380"))
+			Expect(flags).To(ContainElement("ETCD_ADVERTISE_CLIENT_URLS=http://10.0.0.1:2379,http://[fd00::1]:2379"))
+			Expect(flags).To(ContainElement("ETCD_LISTEN_PEER_URLS=http://192.168.0.1:2380,http://[fd01::1]:2380"))
+		})
+
+		It("should bracket IPv6 endpoints and listen on the IPv6 loopback address", func() {
+			cloudAPIMock.GetLocalInstanceMock.GetLocalInstance = cloud.Instance{Name: localInstanceID, Endpoint: "fd00::1"}
+			cloudAPIMock.GetLocalIPMock.LocalIP = "fd00::1"
+			cloudAPIMock.GetInstancesMock.GetInstancesOutput = []cloud.Instance{
+				cloudAPIMock.GetLocalInstanceMock.GetLocalInstance,
+			}
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags()
+			flags := strings.Split(etcdFlags, "\n")
+			Expect(err).To(BeNil())
+			Expect(flags).To(ContainElement(fmt.Sprintf("ETCD_INITIAL_CLUSTER=%s=http://[fd00::1]:2380", localInstanceID)))
+			Expect(flags).To(ContainElement("ETCD_ADVERTISE_CLIENT_URLS=http://[fd00::1]:2379"))
+			Expect(flags).To(ContainElement("ETCD_LISTEN_PEER_URLS=http://[fd00::1]:2380"))
+			Expect(flags).To(ContainElement("ETCD_LISTEN_CLIENT_URLS=http://[fd00::1]:2379,http://[::1]:2379"))
+		})
+	})
+
+	Describe("custom ports and an advertise domain", func() {
+		JustBeforeEach(func() {
+			Expect(WithPorts(7001, 4001)(bootstrapper)).To(Succeed())
+			Expect(WithAdvertiseDomain("etcd.example.com.")(bootstrapper)).To(Succeed())
+			cloudAPIMock.GetLocalInstanceMock.GetLocalInstance.Endpoint = "10.0.0.1"
+			cloudAPIMock.GetInstancesMock.GetInstancesOutput = []cloud.Instance{
+				cloudAPIMock.GetLocalInstanceMock.GetLocalInstance,
+				{
+					Name:     "test-domain-instance-id-1",
+					Endpoint: "10.0.0.2",
+				},
+			}
+		})
+
+		It("should advertise the DNS name and endpoint of each instance on the custom ports", func() {
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{}
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags()
+			flags := strings.Split(etcdFlags, "\n")
+			Expect(err).To(BeNil())
+			localDNSName := localInstanceID + ".etcd.example.com"
+			Expect(flags).To(ContainElement(fmt.Sprintf("ETCD_INITIAL_CLUSTER=%s=%s,%s=%s,%s=%s,%s=%s",
+				localInstanceID, "http://10.0.0.1:7001",
+				localInstanceID, "http://"+localDNSName+":7001",
+				"test-domain-instance-id-1", "http://10.0.0.2:7001",
+				"test-domain-instance-id-1", "http://test-domain-instance-id-1.etcd.example.com:7001")))
+			Expect(flags).To(ContainElement(
+				"ETCD_INITIAL_ADVERTISE_PEER_URLS=http://10.0.0.1:7001,http://" + localDNSName + ":7001"))
+			Expect(flags).To(ContainElement(
+				"ETCD_ADVERTISE_CLIENT_URLS=http://10.0.0.1:4001,http://" + localDNSName + ":4001"))
+			Expect(flags).To(ContainElement("ETCD_LISTEN_PEER_URLS=http://192.168.100.1:7001"))
+			Expect(flags).To(ContainElement(
+				"ETCD_LISTEN_CLIENT_URLS=http://192.168.100.1:4001,http://127.0.0.1:4001"))
+		})
+
+		It("should add the local instance with all of its peer URLs", func() {
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
+				{
+					Name:     "test-domain-instance-id-1",
+					PeerURLs: []string{"http://10.0.0.2:7001"},
+				},
+			}
+			etcdAPIMock.AddMemberMock.ExpectedInput = []string{
+				"http://10.0.0.1:7001", "http://" + localInstanceID + ".etcd.example.com:7001",
+			}
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags()
+			Expect(err).To(BeNil())
+			Expect(etcdAPIMock.AddMemberMock.Called).To(BeTrue())
+			flags := strings.Split(etcdFlags, "\n")
+			Expect(flags).To(ContainElement("ETCD_INITIAL_CLUSTER_STATE=existing"))
+			Expect(flags).To(ContainElement("ETCD_INITIAL_CLUSTER=test-domain-instance-id-1=http://10.0.0.2:7001"))
+		})
+
+		It("should add the local instance again when an unnamed member only has some of its peer URLs", func() {
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
+				{
+					PeerURLs: []string{"http://10.0.0.1:7001"},
+				},
+			}
+			etcdAPIMock.AddMemberMock.ExpectedInput = []string{
+				"http://10.0.0.1:7001", "http://" + localInstanceID + ".etcd.example.com:7001",
+			}
+			_, err := bootstrapper.GenerateEtcdFlags()
+			Expect(err).To(BeNil())
+			Expect(etcdAPIMock.AddMemberMock.Called).To(BeTrue())
+		})
+
+		It("should not add the local instance again when an unnamed member has all of its peer URLs", func() {
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
+				{
+					PeerURLs: []string{
+						"http://" + localInstanceID + ".etcd.example.com:7001", "http://10.0.0.1:7001",
+					},
+				},
+			}
+			_, err := bootstrapper.GenerateEtcdFlags()
+			Expect(err).To(BeNil())
+			Expect(etcdAPIMock.AddMemberMock.Called).To(BeFalse())
+		})
+
+		It("should update the peer URLs of the local member which only has some of them", func() {
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
+				{
+					Name:     localInstanceID,
+					PeerURLs: []string{"http://10.0.0.1:7001"},
+				},
+			}
+			etcdAPIMock.UpdateMemberMock.ExpectedName = &localInstanceID
+			etcdAPIMock.UpdateMemberMock.ExpectedPeerURLs = []string{
+				"http://10.0.0.1:7001", "http://" + localInstanceID + ".etcd.example.com:7001",
+			}
+			_, err := bootstrapper.GenerateEtcdFlags()
+			Expect(err).To(BeNil())
+			Expect(etcdAPIMock.UpdateMemberMock.Called).To(BeTrue())
+		})
+
+		It("should not update the peer URLs of the local member which has all of them in another order", func() {
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
+				{
+					Name: localInstanceID,
+					PeerURLs: []string{
+						"http://" + localInstanceID + ".etcd.example.com:7001", "http://10.0.0.1:7001",
+					},
+				},
+			}
+			_, err := bootstrapper.GenerateEtcdFlags()
+			Expect(err).To(BeNil())
+			Expect(etcdAPIMock.UpdateMemberMock.Called).To(BeFalse())
+		})
+
+		It("rejects invalid ports", func() {
+			Expect(WithPorts(0, 2379)(bootstrapper)).ToNot(Succeed())
+			Expect(WithPorts(2379, 2379)(bootstrapper)).ToNot(Succeed())
+		})
+	})
+
+	Describe("several clusters on the same hosts", func() {
+		JustBeforeEach(func() {
+			cloudAPIMock.GetInstancesMock.GetInstancesOutput = []cloud.Instance{
+				{
+					Name:     localInstanceID,
+					Endpoint: localEndpoint,
+				},
+			}
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{}
+		})
+
+		It("should set the initial cluster token", func() {
+			Expect(WithClusterToken("events")(bootstrapper)).To(Succeed())
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags()
+			Expect(err).To(BeNil())
+			Expect(strings.Split(etcdFlags, "\n")).To(ContainElement("ETCD_INITIAL_CLUSTER_TOKEN=events"))
+		})
+
+		It("should not set the initial cluster token by default", func() {
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags()
+			Expect(err).To(BeNil())
+			Expect(etcdFlags).ToNot(ContainSubstring("ETCD_INITIAL_CLUSTER_TOKEN"))
+		})
+
+		It("should share the instances of a single discovery", func() {
+			shared := NewSharedCloudAPI(cloudAPIMock)
+			instances, err := shared.GetInstances()
+			Expect(err).To(BeNil())
+			local, err := shared.GetLocalInstance()
+			Expect(err).To(BeNil())
+			localIP, err := shared.GetLocalIP()
+			Expect(err).To(BeNil())
+
+			cloudAPIMock.GetInstancesMock.GetInstancesOutput = nil
+			cloudAPIMock.GetLocalInstanceMock.GetLocalInstance = cloud.Instance{}
+			cloudAPIMock.GetLocalIPMock.LocalIP = "192.168.100.9"
+			Expect(shared.GetInstances()).To(Equal(instances))
+			Expect(shared.GetLocalInstance()).To(Equal(local))
+			Expect(shared.GetLocalIP()).To(Equal(localIP))
+		})
+
+		It("should discover again after a failed discovery", func() {
+			shared := NewSharedCloudAPI(cloudAPIMock)
+			cloudAPIMock.GetInstancesMock.Error = fmt.Errorf("failed to discover instances")
+			_, err := shared.GetInstances()
+			Expect(err).ToNot(BeNil())
+
+			cloudAPIMock.GetInstancesMock.Error = nil
+			Expect(shared.GetInstances()).To(HaveLen(1))
+		})
+	})
+
+	Describe("member name and endpoint templates", func() {
+		JustBeforeEach(func() {
+			cloudAPIMock.GetInstancesMock.GetInstancesOutput = []cloud.Instance{
+				{
+					Name:           localInstanceID,
+					Endpoint:       localEndpoint,
+					PrivateDNSName: "etcd-local.internal",
+					Tags:           map[string]string{"Name": "etcd-local"},
+				},
+				{
+					Name:           "test-templated-instance-id-1",
+					Endpoint:       "endpoint-1",
+					PrivateDNSName: "etcd-1.internal",
+					Tags:           map[string]string{"Name": "etcd-1"},
+				},
+			}
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{}
+			templates, err := cloud.ParseInstanceTemplates("{{.Tags.Name}}", "{{.PrivateDNSName}}")
+			Expect(err).To(BeNil())
+			bootstrapper.cloudAPI = NewTemplatedCloudAPI(cloudAPIMock, templates)
+		})
+
+		It("should name and advertise members by their templates", func() {
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags()
+			Expect(err).To(BeNil())
+			flags := strings.Split(etcdFlags, "\n")
+			Expect(flags).To(ContainElement("ETCD_NAME=etcd-local"))
+			Expect(flags).To(ContainElement(
+				"ETCD_INITIAL_CLUSTER=etcd-local=http://etcd-local.internal:2380,etcd-1=http://etcd-1.internal:2380"))
+			Expect(flags).To(ContainElement("ETCD_INITIAL_ADVERTISE_PEER_URLS=http://etcd-local.internal:2380"))
+			Expect(flags).To(ContainElement("ETCD_ADVERTISE_CLIENT_URLS=http://etcd-local.internal:2379"))
+			Expect(flags).To(ContainElement(fmt.Sprintf("ETCD_LISTEN_PEER_URLS=%s", localListenPeerURL)))
+		})
+
+		It("should take the local instance metadata from the instances", func() {
+			local, err := bootstrapper.cloudAPI.GetLocalInstance()
+			Expect(err).To(BeNil())
+			Expect(local.Name).To(Equal("etcd-local"))
+			Expect(local.Endpoint).To(Equal("etcd-local.internal"))
+		})
+
+		It("should fail when an instance is missing the templated metadata", func() {
+			cloudAPIMock.GetInstancesMock.GetInstancesOutput[1].Tags = nil
+			_, err := bootstrapper.GenerateEtcdFlags()
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("zone spread", func() {
+		It("should find a zone holding a quorum of the instances", func() {
+			Expect(quorumZone([]cloud.Instance{
+				{Name: "etcd-1", Zone: "eu-west-1a"},
+				{Name: "etcd-2", Zone: "eu-west-1b"},
+				{Name: "etcd-3", Zone: "eu-west-1b"},
+			})).To(Equal("eu-west-1b"))
+			Expect(quorumZone([]cloud.Instance{
+				{Name: "etcd-1", Zone: "eu-west-1a"},
+				{Name: "etcd-2", Zone: "eu-west-1a"},
+			})).To(Equal("eu-west-1a"))
+		})
+
+		It("should not find a zone when the instances are spread across zones", func() {
+			Expect(quorumZone([]cloud.Instance{
+				{Name: "etcd-1", Zone: "eu-west-1a"},
+				{Name: "etcd-2", Zone: "eu-west-1b"},
+				{Name: "etcd-3", Zone: "eu-west-1c"},
+				{Name: "etcd-4", Zone: "eu-west-1a"},
+			})).To(Equal(""))
+		})
+
+		It("should not find a zone when a zone is unknown or there's a single instance", func() {
+			Expect(quorumZone([]cloud.Instance{
+				{Name: "etcd-1", Zone: "eu-west-1a"},
+				{Name: "etcd-2", Zone: "eu-west-1a"},
+				{Name: "etcd-3"},
+			})).To(Equal(""))
+			Expect(quorumZone([]cloud.Instance{{Name: "etcd-1", Zone: "eu-west-1a"}})).To(Equal(""))
+		})
+	})
+
 	Describe("an existing cluster", func() {
 		JustBeforeEach(func() {
 			By("Returning some instances including the local instance")
@@ -204,18 +556,22 @@ var _ = Describe("Bootstrap", func() {
 			By("And returning a list of etcd members that includes all of the instances")
 			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
 				{
-					Name:    localInstanceID,
-					PeerURL: localListenPeerURL,
+					Name:     localInstanceID,
+					PeerURLs: []string{localListenPeerURL},
 				},
 				{
-					Name:    "test-existing-cluster-instance-id-1",
-					PeerURL: "http://test-existing-cluster-endpoint-1:2380",
+					Name:     "test-existing-cluster-instance-id-1",
+					PeerURLs: []string{"http://test-existing-cluster-endpoint-1:2380"},
 				},
 				{
-					Name:    "test-existing-cluster-instance-id-2",
-					PeerURL: "http://test-existing-cluster-endpoint-2:2380",
+					Name:     "test-existing-cluster-instance-id-2",
+					PeerURLs: []string{"http://test-existing-cluster-endpoint-2:2380"},
 				},
 			}
+
+			By("Expecting the local member's peerURL to be updated to the one it advertises")
+			etcdAPIMock.UpdateMemberMock.ExpectedName = &localInstanceID
+			etcdAPIMock.UpdateMemberMock.ExpectedPeerURLs = []string{localAdvertisePeerURL}
 		})
 
 		It("should create etcd flags for joining an existing cluster", func() {
@@ -236,6 +592,99 @@ var _ = Describe("Bootstrap", func() {
 		})
 	})
 
+	Describe("an existing cluster where a replacement node takes over an existing member", func() {
+		JustBeforeEach(func() {
+			By("Returning some instances including the local instance")
+			cloudAPIMock.GetInstancesMock.GetInstancesOutput = []cloud.Instance{
+				{
+					Name:     localInstanceID,
+					Endpoint: localEndpoint,
+				},
+				{
+					Name:     "test-existing-cluster-instance-id-1",
+					Endpoint: "endpoint-1",
+				},
+			}
+
+			By("Returning a list of etcd members where the local member has the old instance's peerURL")
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
+				{
+					Name:     localInstanceID,
+					PeerURLs: []string{"http://old-local-endpoint:2380"},
+				},
+				{
+					Name:     "test-existing-cluster-instance-id-1",
+					PeerURLs: []string{"http://endpoint-1:2380"},
+				},
+			}
+		})
+
+		It("should update the local member's peerURL", func() {
+			etcdAPIMock.UpdateMemberMock.ExpectedName = &localInstanceID
+			etcdAPIMock.UpdateMemberMock.ExpectedPeerURLs = []string{localAdvertisePeerURL}
+			etcdFlags, err := bootstrapper.GenerateEtcdFlags()
+			Expect(err).To(BeNil())
+			Expect(etcdAPIMock.UpdateMemberMock.Called).To(BeTrue())
+			flags := strings.Split(etcdFlags, "\n")
+			Expect(flags).To(ContainElement("ETCD_INITIAL_CLUSTER_STATE=new"))
+			Expect(flags).To(ContainElement("ETCD_NAME=" + localInstanceID))
+		})
+
+		It("fails when the local member's peerURL can't be updated", func() {
+			etcdAPIMock.UpdateMemberMock.ExpectedName = &localInstanceID
+			etcdAPIMock.UpdateMemberMock.ExpectedPeerURLs = []string{localAdvertisePeerURL}
+			etcdAPIMock.UpdateMemberMock.Err = fmt.Errorf("failed to update etcd member")
+			_, err := bootstrapper.GenerateEtcdFlags()
+			Expect(err).ToNot(Succeed())
+		})
+	})
+
+	Describe("updating the local member's peerURLs", func() {
+		It("should only update the local member", func() {
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
+				{
+					Name:     localInstanceID,
+					PeerURLs: []string{"http://old-local-endpoint:2380"},
+				},
+				{
+					Name:     "test-existing-cluster-instance-id-1",
+					PeerURLs: []string{"http://old-endpoint-1:2380"},
+				},
+			}
+			etcdAPIMock.UpdateMemberMock.ExpectedName = &localInstanceID
+			etcdAPIMock.UpdateMemberMock.ExpectedPeerURLs = []string{localAdvertisePeerURL}
+			Expect(bootstrapper.updateLocalPeerURLs()).To(BeNil())
+			Expect(etcdAPIMock.UpdateMemberMock.Called).To(BeTrue())
+		})
+
+		It("should not update the local member when it has the advertised peerURL", func() {
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
+				{
+					Name:     localInstanceID,
+					PeerURLs: []string{localAdvertisePeerURL},
+				},
+			}
+			Expect(bootstrapper.updateLocalPeerURLs()).To(BeNil())
+			Expect(etcdAPIMock.UpdateMemberMock.Called).To(BeFalse())
+		})
+
+		It("should not update anything when the local instance isn't a member", func() {
+			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
+				{
+					Name:     "test-existing-cluster-instance-id-1",
+					PeerURLs: []string{"http://old-endpoint-1:2380"},
+				},
+			}
+			Expect(bootstrapper.updateLocalPeerURLs()).To(BeNil())
+			Expect(etcdAPIMock.UpdateMemberMock.Called).To(BeFalse())
+		})
+
+		It("fails when it cannot get etcd members", func() {
+			etcdAPIMock.MembersMock.Err = fmt.Errorf("failed to get etcd members")
+			Expect(bootstrapper.updateLocalPeerURLs()).ToNot(Succeed())
+		})
+	})
+
 	Describe("an existing cluster where a node needs replacing", func() {
 		JustBeforeEach(func() {
 			By("Returning some instances including the local instance")
@@ -257,16 +706,16 @@ var _ = Describe("Bootstrap", func() {
 			By("Returning a list of etcd members that contains too many members but does not include the local instance")
 			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
 				{
-					Name:    "test-existing-cluster-old-instance-id-1",
-					PeerURL: "http://endpoint-1:2380",
+					Name:     "test-existing-cluster-old-instance-id-1",
+					PeerURLs: []string{"http://endpoint-1:2380"},
 				},
 				{
-					Name:    "test-existing-cluster-instance-id-2",
-					PeerURL: "http://endpoint-2:2380",
+					Name:     "test-existing-cluster-instance-id-2",
+					PeerURLs: []string{"http://endpoint-2:2380"},
 				},
 				{
-					Name:    "test-existing-cluster-instance-id-3",
-					PeerURL: "http://endpoint-3:2380",
+					Name:     "test-existing-cluster-instance-id-3",
+					PeerURLs: []string{"http://endpoint-3:2380"},
 				},
 			}
 		})
@@ -274,7 +723,7 @@ var _ = Describe("Bootstrap", func() {
 		It("should remove the prior node and add the local node", func() {
 			oldInstanceID := "test-existing-cluster-old-instance-id-1"
 			etcdAPIMock.RemoveMemberMock.ExpectedInput = &oldInstanceID
-			etcdAPIMock.AddMemberMock.ExpectedInput = &localAdvertisePeerURL
+			etcdAPIMock.AddMemberMock.ExpectedInput = []string{localAdvertisePeerURL}
 			etcdFlags, err := bootstrapper.GenerateEtcdFlags()
 			Expect(err).To(BeNil())
 			Expect(etcdAPIMock.RemoveMemberMock.Called).To(BeTrue())
@@ -314,16 +763,16 @@ var _ = Describe("Bootstrap", func() {
 			etcdAPIMock.MembersMock.MembersOutput = []etcd.Member{
 				{
 					// Name will be blank after adding the peerURL until the instance registers itself.
-					Name:    "",
-					PeerURL: localAdvertisePeerURL,
+					Name:     "",
+					PeerURLs: []string{localAdvertisePeerURL},
 				},
 				{
-					Name:    "test-existing-cluster-partially-initialised-instance-id-1",
-					PeerURL: "http://endpoint-1:2380",
+					Name:     "test-existing-cluster-partially-initialised-instance-id-1",
+					PeerURLs: []string{"http://endpoint-1:2380"},
 				},
 				{
-					Name:    "test-existing-cluster-partially-initialised-instance-id-2",
-					PeerURL: "http://endpoint-2:2380",
+					Name:     "test-existing-cluster-partially-initialised-instance-id-2",
+					PeerURLs: []string{"http://endpoint-2:2380"},
 				},
 			}
 		})
@@ -415,6 +864,7 @@ type EtcdAPIMock struct {
 	MembersMock      *Members
 	RemoveMemberMock *RemoveMember
 	AddMemberMock    *AddMember
+	UpdateMemberMock *UpdateMember
 }
 
 // Members sets the expected output for Members() on EtcdCluster
@@ -446,18 +896,35 @@ func (t EtcdAPIMock) RemoveMemberByName(name string) error {
 // AddMember sets the expected input for AddMember() on EtcdCluster
 type AddMember struct {
 	Called        bool
-	ExpectedInput *string
+	ExpectedInput []string
 	Err           error
 }
 
-// AddMemberByPeerURL mocks the etcd cluster package client
-func (t EtcdAPIMock) AddMemberByPeerURL(peerURL string) error {
+// AddMemberByPeerURLs mocks the etcd cluster package client
+func (t EtcdAPIMock) AddMemberByPeerURLs(peerURLs []string) error {
 	t.AddMemberMock.Called = true
-	Expect(t.AddMemberMock.ExpectedInput).To(Not(BeNil()), "unexpected AddMember call with %q", peerURL)
-	Expect(*t.AddMemberMock.ExpectedInput).To(Equal(peerURL), "unexpected AddMember call")
+	Expect(t.AddMemberMock.ExpectedInput).To(Not(BeNil()), "unexpected AddMember call with %v", peerURLs)
+	Expect(t.AddMemberMock.ExpectedInput).To(Equal(peerURLs), "unexpected AddMember call")
 	return t.AddMemberMock.Err
 }
 
+// UpdateMember sets the expected input for UpdateMemberPeerURLs() on EtcdCluster
+type UpdateMember struct {
+	Called           bool
+	ExpectedName     *string
+	ExpectedPeerURLs []string
+	Err              error
+}
+
+// UpdateMemberPeerURLs mocks the etcd cluster package client
+func (t EtcdAPIMock) UpdateMemberPeerURLs(name string, peerURLs []string) error {
+	t.UpdateMemberMock.Called = true
+	Expect(t.UpdateMemberMock.ExpectedName).To(Not(BeNil()), "unexpected UpdateMember call with %q", name)
+	Expect(*t.UpdateMemberMock.ExpectedName).To(Equal(name), "unexpected UpdateMember call")
+	Expect(t.UpdateMemberMock.ExpectedPeerURLs).To(Equal(peerURLs), "unexpected UpdateMember call")
+	return t.UpdateMemberMock.Err
+}
+
 // CloudAPIMock for mocking calls to an etcd-bootstrap cloud provider
 type CloudAPIMock struct {
 	GetInstancesMock     *GetInstances
@@ -2,8 +2,10 @@ package bootstrap
 
 import (
 	"fmt"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
 )
 
 // reconcileMembers uses the etcd API to remove any non-existing members and add new ones that
@@ -17,7 +19,8 @@ func (b *Bootstrapper) reconcileMembers() error {
 
 // removeOldEtcdMembers removes any etcd members that are no longer part of the instances
 // returned by the cloud API. We assume if it's not part of the cloud instances then the actual
-// node VM has been removed.
+// node VM has been removed. Instances which are out of service, e.g. in standby or stopped, are expected to return so
+// remain members.
 func (b *Bootstrapper) removeOldEtcdMembers() error {
 	members, err := b.etcdAPI.Members()
 	if err != nil {
@@ -31,18 +34,19 @@ func (b *Bootstrapper) removeOldEtcdMembers() error {
 	var instanceURLs []string
 	for _, instance := range instances {
 		instanceNames = append(instanceNames, instance.Name)
-		instanceURLs = append(instanceURLs, b.peerURL(instance.Endpoint))
+		instanceURLs = append(instanceURLs, b.instancePeerURLs(instance)...)
 	}
 
 	for _, member := range members {
 		if !contains(instanceNames, member.Name) {
 			// The etcd member name doesn't exist in the list of cloud instances.
-			if member.Name == "" && contains(instanceURLs, member.PeerURL) {
+			if member.Name == "" && containsAny(instanceURLs, member.PeerURLs) {
 				// A special case is when member.Name == "". This means the member is still initialising, so don't remove it.
-				// Unless the peerURL doesn't exist in the instance list either, in which case this node is no longer around.
+				// Unless the peerURLs don't exist in the instance list either, in which case this node is no longer around.
 				continue
 			}
-			log.Infof("Removing %s (%s) from etcd member list, not found in cloud provider", member.Name, member.PeerURL)
+			log.Infof("Removing %s (%s) from etcd member list, not found in cloud provider", member.Name,
+				strings.Join(member.PeerURLs, ","))
 			if err := b.etcdAPI.RemoveMemberByName(member.Name); err != nil {
 				log.Warnf("Unable to remove old member. This may be due to temporary lack of quorum,"+
 					" will ignore: %v", err)
@@ -53,39 +57,101 @@ func (b *Bootstrapper) removeOldEtcdMembers() error {
 	return nil
 }
 
-// addLocalInstanceToEtcd ensures the advertise peerURL is added to the existing cluster. This is required by
+// addLocalInstanceToEtcd ensures the advertise peerURLs are added to the existing cluster. This is required by
 // etcd prior to a node joining a cluster, as described in https://etcd.io/docs/v3.4.0/op-guide/runtime-configuration/.
 //
-// After the peerURL is added, the member will show up with a blank name when listing members from the etcd API.
+// After the peerURLs are added, the member will show up with a blank name when listing members from the etcd API.
 // Once it successfully joins the name will be set.
 func (b *Bootstrapper) addLocalInstanceToEtcd() error {
 	members, err := b.etcdAPI.Members()
 	if err != nil {
 		return err
 	}
+	localInstance, err := b.cloudAPI.GetLocalInstance()
+	if err != nil {
+		return err
+	}
+
+	localInstanceURLs := b.instancePeerURLs(localInstance)
 	var memberNames []string
-	var memberURLs []string
+	var added bool
 	for _, member := range members {
 		memberNames = append(memberNames, member.Name)
-		memberURLs = append(memberURLs, member.PeerURL)
+		added = added || sameURLs(member.PeerURLs, localInstanceURLs)
+	}
+	if !contains(memberNames, localInstance.Name) && !added {
+		// Don't add if the member name already exists - the local instance is already part of the cluster.
+		// Also don't re-add if the local instance's peerURLs have already been added. This could happen
+		// if the node crashed or restarted before it registered. If only some of them have been added, the
+		// member is completed by AddMemberByPeerURLs.
+
+		log.Infof("Adding local instance %v to the etcd member list", localInstance)
+		if err := b.etcdAPI.AddMemberByPeerURLs(localInstanceURLs); err != nil {
+			return fmt.Errorf("unexpected error when adding new member URLs %v: %v", localInstanceURLs, err)
+		}
+	}
+
+	return nil
+}
+
+// updateLocalPeerURLs ensures the local member's peerURLs in the cluster match the ones it advertises. These differ
+// when a replacement instance takes over an existing member, for example by reattaching its data volume, as the
+// replacement instance has a different endpoint.
+func (b *Bootstrapper) updateLocalPeerURLs() error {
+	members, err := b.etcdAPI.Members()
+	if err != nil {
+		return err
 	}
 	localInstance, err := b.cloudAPI.GetLocalInstance()
 	if err != nil {
 		return err
 	}
 
-	if !contains(memberNames, localInstance.Name) &&
-		!contains(memberURLs, b.peerURL(localInstance.Endpoint)) {
-		// Don't add if the member name already exists - the local instance is already part of the cluster.
-		// Also don't re-add if the local instance's peerURL has already been added. This could happen
-		// if the node crashed or restarted before it registered.
-
-		log.Infof("Adding local instance %v to the etcd member list", localInstance)
-		localInstanceURL := b.peerURL(localInstance.Endpoint)
-		if err := b.etcdAPI.AddMemberByPeerURL(localInstanceURL); err != nil {
-			return fmt.Errorf("unexpected error when adding new member URL %s: %v", localInstanceURL, err)
+	localPeerURLs := b.instancePeerURLs(localInstance)
+	for _, member := range members {
+		if member.Name == localInstance.Name && !sameURLs(member.PeerURLs, localPeerURLs) {
+			log.Infof("Updating peerURLs of %s from %v to %v", member.Name, member.PeerURLs, localPeerURLs)
+			if err := b.etcdAPI.UpdateMemberPeerURLs(member.Name, localPeerURLs); err != nil {
+				return fmt.Errorf("unexpected error when updating member %s to peerURLs %v: %v", member.Name,
+					localPeerURLs, err)
+			}
 		}
 	}
 
 	return nil
 }
+
+// warnOfZoneQuorum warns if a single zone holds a quorum of the instances, as losing that zone would lose the cluster's
+// quorum. It's only checked if the zone of every instance is known.
+func (b *Bootstrapper) warnOfZoneQuorum() error {
+	instances, err := b.cloudAPI.GetInstances()
+	if err != nil {
+		return err
+	}
+	if zone := quorumZone(instances); zone != "" {
+		log.Warnf("Zone %s holds a quorum of the %d etcd instances, the cluster won't survive losing it", zone,
+			len(instances))
+	}
+	return nil
+}
+
+// quorumZone returns the zone which holds a quorum of several instances, or "" if there isn't one or the zone of an
+// instance is unknown.
+func quorumZone(instances []cloud.Instance) string {
+	if len(instances) < 2 {
+		return ""
+	}
+	counts := make(map[string]int)
+	for _, instance := range instances {
+		if instance.Zone == "" {
+			return ""
+		}
+		counts[instance.Zone]++
+	}
+	for _, instance := range instances {
+		if counts[instance.Zone] > len(instances)/2 {
+			return instance.Zone
+		}
+	}
+	return ""
+}
@@ -0,0 +1,65 @@
+package bootstrap
+
+import (
+	"sync"
+
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+)
+
+// SharedCloudAPI discovers the instances from a CloudAPI once, and then returns the same instances every time. It's
+// used to bootstrap several clusters on the same hosts from a single discovery pass.
+type SharedCloudAPI struct {
+	cloudAPI CloudAPI
+
+	mu            sync.Mutex
+	instances     []cloud.Instance
+	localInstance *cloud.Instance
+	localIP       string
+}
+
+// NewSharedCloudAPI returns a SharedCloudAPI which discovers the instances from cloudAPI when they're first requested.
+func NewSharedCloudAPI(cloudAPI CloudAPI) *SharedCloudAPI {
+	return &SharedCloudAPI{cloudAPI: cloudAPI}
+}
+
+// GetInstances returns the instances of the first successful discovery.
+func (s *SharedCloudAPI) GetInstances() ([]cloud.Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.instances == nil {
+		instances, err := s.cloudAPI.GetInstances()
+		if err != nil {
+			return nil, err
+		}
+		s.instances = instances
+	}
+	return s.instances, nil
+}
+
+// GetLocalInstance returns the local instance of the first successful discovery.
+func (s *SharedCloudAPI) GetLocalInstance() (cloud.Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.localInstance == nil {
+		localInstance, err := s.cloudAPI.GetLocalInstance()
+		if err != nil {
+			return cloud.Instance{}, err
+		}
+		s.localInstance = &localInstance
+	}
+	return *s.localInstance, nil
+}
+
+// GetLocalIP returns the local IP of the first successful discovery.
+func (s *SharedCloudAPI) GetLocalIP() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.localIP == "" {
+		localIP, err := s.cloudAPI.GetLocalIP()
+		if err != nil {
+			return "", err
+		}
+		s.localIP = localIP
+	}
+	return s.localIP, nil
+}
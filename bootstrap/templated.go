@@ -0,0 +1,60 @@
+package bootstrap
+
+import (
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+)
+
+// TemplatedCloudAPI replaces the names and endpoints of the instances from a CloudAPI with the result of templates,
+// e.g. to name members by a tag and advertise them by their DNS names.
+type TemplatedCloudAPI struct {
+	cloudAPI  CloudAPI
+	templates cloud.InstanceTemplates
+}
+
+// NewTemplatedCloudAPI returns a TemplatedCloudAPI which applies templates to the instances of cloudAPI.
+func NewTemplatedCloudAPI(cloudAPI CloudAPI, templates cloud.InstanceTemplates) *TemplatedCloudAPI {
+	return &TemplatedCloudAPI{cloudAPI: cloudAPI, templates: templates}
+}
+
+// GetInstances returns the instances with the templates applied.
+func (t *TemplatedCloudAPI) GetInstances() ([]cloud.Instance, error) {
+	instances, err := t.cloudAPI.GetInstances()
+	if err != nil {
+		return nil, err
+	}
+	var templated []cloud.Instance
+	for _, instance := range instances {
+		instance, err := t.templates.Apply(instance)
+		if err != nil {
+			return nil, err
+		}
+		templated = append(templated, instance)
+	}
+	return templated, nil
+}
+
+// GetLocalInstance returns the local instance with the templates applied. Providers may not have all the metadata of
+// the local instance, so it's taken from the matching instance of GetInstances where there is one. This ensures the
+// local instance has the same name and endpoint as the others see it with.
+func (t *TemplatedCloudAPI) GetLocalInstance() (cloud.Instance, error) {
+	local, err := t.cloudAPI.GetLocalInstance()
+	if err != nil {
+		return cloud.Instance{}, err
+	}
+	instances, err := t.cloudAPI.GetInstances()
+	if err != nil {
+		return cloud.Instance{}, err
+	}
+	for _, instance := range instances {
+		if instance.Name == local.Name {
+			local = instance
+			break
+		}
+	}
+	return t.templates.Apply(local)
+}
+
+// GetLocalIP returns the local IP of the cloudAPI, as it's the address to listen on rather than to advertise.
+func (t *TemplatedCloudAPI) GetLocalIP() (string, error) {
+	return t.cloudAPI.GetLocalIP()
+}
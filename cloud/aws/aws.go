@@ -3,10 +3,11 @@ package aws
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/sky-uk/etcd-bootstrap/cloud"
@@ -16,18 +17,54 @@ import (
 type awsASG interface {
 	DescribeAutoScalingInstances(a *autoscaling.DescribeAutoScalingInstancesInput) (*autoscaling.DescribeAutoScalingInstancesOutput, error)
 	DescribeAutoScalingGroups(a *autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error)
+	DescribeTags(a *autoscaling.DescribeTagsInput) (*autoscaling.DescribeTagsOutput, error)
 }
 
 // awsEC2 interface to abstract away from AWS commands
 type awsEC2 interface {
 	DescribeInstances(e *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
+	DescribeNetworkInterfaces(e *ec2.DescribeNetworkInterfacesInput) (*ec2.DescribeNetworkInterfacesOutput, error)
+	AttachNetworkInterface(e *ec2.AttachNetworkInterfaceInput) (*ec2.AttachNetworkInterfaceOutput, error)
+	CreateTags(e *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error)
+	DescribeVolumes(e *ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error)
+	AttachVolume(e *ec2.AttachVolumeInput) (*ec2.VolumeAttachment, error)
 }
 
-// AWS returns the instances in the local auto scaling group.
+// nonTerminatedStates are the EC2 instance states of instances which may be part of the etcd cluster.
+var nonTerminatedStates = []string{"pending", "running", "shutting-down", "stopped", "stopping"}
+
+// Config contains configuration for the AWS provider.
+type Config struct {
+	// InstanceTags, when set, looks up the cluster instances using EC2 tag filters rather than
+	// the local auto scaling group. All tags must match for an instance to be included.
+	InstanceTags map[string]string
+	// ASGNames, when set, looks up the cluster instances from all of the named auto scaling groups
+	// rather than only the local auto scaling group.
+	ASGNames []string
+	// ASGTags, when set, looks up the cluster instances from all of the auto scaling groups which
+	// have every one of these tags.
+	ASGTags map[string]string
+	// ENIPool, when set, gives the local instance a stable network identity by claiming and attaching
+	// a network interface from a pool.
+	ENIPool *ENIPoolConfig
+	// DataVolume, when set, claims and attaches a persistent data volume, and uses the member name
+	// recorded on the volume as the local instance name.
+	DataVolume *DataVolumeConfig
+	// EndpointSelector selects the endpoints of instances with several network interfaces, by VPC or subnet ID.
+	// Defaults to the primary private IP address. It isn't used with ENIPool, as the pooled interface is the endpoint.
+	EndpointSelector cloud.EndpointSelector
+}
+
+// AWS returns the instances in the local auto scaling group, or those matching the configured tags.
 type AWS struct {
-	awsSession       *session.Session
+	config           Config
+	session          *Session
+	asgClient        awsASG
+	ec2Client        awsEC2
 	identityDocument *ec2metadata.EC2InstanceIdentityDocument
 	instances        []cloud.Instance
+	localENI         *ec2.NetworkInterface
+	localVolume      *ec2.Volume
 }
 
 // GetInstances will return the aws etcd instances
@@ -37,12 +74,50 @@ func (m *AWS) GetInstances() ([]cloud.Instance, error) {
 		if err != nil {
 			return nil, fmt.Errorf("unable to get local instance information: %w", err)
 		}
-		config := &aws.Config{Region: aws.String(identityDoc.Region)}
-		awsASGClient := autoscaling.New(m.awsSession, config)
-		awsEC2Client := ec2.New(m.awsSession, config)
-		instances, err := queryInstances(identityDoc, awsASGClient, awsEC2Client)
+		awsASGClient, err := m.getASGClient()
 		if err != nil {
-			return nil, fmt.Errorf("unable to query ASG: %w", err)
+			return nil, err
+		}
+		awsEC2Client, err := m.getEC2Client()
+		if err != nil {
+			return nil, err
+		}
+		var instances []cloud.Instance
+		if len(m.config.InstanceTags) > 0 {
+			instances, err = queryInstancesByTags(m.config.InstanceTags, awsEC2Client, m.config.EndpointSelector)
+			if err != nil {
+				return nil, fmt.Errorf("unable to query instances by tags: %w", err)
+			}
+		} else {
+			asgNames, err := m.getASGNames(identityDoc, awsASGClient)
+			if err != nil {
+				return nil, fmt.Errorf("unable to find ASGs: %w", err)
+			}
+			instances, err = queryASGInstances(asgNames, awsASGClient, awsEC2Client, m.config.EndpointSelector)
+			if err != nil {
+				return nil, fmt.Errorf("unable to query ASG: %w", err)
+			}
+		}
+		// Until replaced below, the instance names are the instance IDs.
+		var instanceIDs []string
+		for _, instance := range instances {
+			instanceIDs = append(instanceIDs, instance.Name)
+		}
+		if m.config.ENIPool != nil {
+			instances, err = m.withPoolENIs(identityDoc, instanceIDs, instances, awsEC2Client)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if m.config.DataVolume != nil {
+			// Claim the local data volume first, so the local instance's name is included.
+			if _, err := m.claimLocalVolume(identityDoc, awsEC2Client); err != nil {
+				return nil, err
+			}
+			instances, err = m.withVolumeNames(instanceIDs, instances, awsEC2Client)
+			if err != nil {
+				return nil, err
+			}
 		}
 		m.instances = instances
 	}
@@ -56,10 +131,47 @@ func (m *AWS) GetLocalInstance() (cloud.Instance, error) {
 	if err != nil {
 		return cloud.Instance{}, err
 	}
-	return cloud.Instance{
-		Name:     identityDoc.InstanceID,
-		Endpoint: identityDoc.PrivateIP,
-	}, nil
+	instance := cloud.Instance{
+		Name:       identityDoc.InstanceID,
+		Endpoint:   identityDoc.PrivateIP,
+		Zone:       identityDoc.AvailabilityZone,
+		ProviderID: identityDoc.InstanceID,
+	}
+	if m.config.ENIPool == nil && m.config.DataVolume == nil && m.config.EndpointSelector.IsZero() {
+		return instance, nil
+	}
+
+	awsEC2Client, err := m.getEC2Client()
+	if err != nil {
+		return cloud.Instance{}, err
+	}
+	if m.config.ENIPool == nil && !m.config.EndpointSelector.IsZero() {
+		instances, err := describeInstances(&ec2.DescribeInstancesInput{
+			InstanceIds: aws.StringSlice([]string{identityDoc.InstanceID}),
+		}, awsEC2Client, m.config.EndpointSelector)
+		if err != nil {
+			return cloud.Instance{}, fmt.Errorf("unable to describe the local instance: %w", err)
+		}
+		if len(instances) != 1 {
+			return cloud.Instance{}, fmt.Errorf("expected a single instance for %s", identityDoc.InstanceID)
+		}
+		instance = instances[0]
+	}
+	if m.config.ENIPool != nil {
+		eni, err := m.getLocalENI(identityDoc, awsEC2Client)
+		if err != nil {
+			return cloud.Instance{}, err
+		}
+		instance = m.eniInstance(eni)
+	}
+	if m.config.DataVolume != nil {
+		volume, err := m.claimLocalVolume(identityDoc, awsEC2Client)
+		if err != nil {
+			return cloud.Instance{}, err
+		}
+		instance.Name = tagValue(volume.Tags, m.config.DataVolume.nameTag())
+	}
+	return instance, nil
 }
 
 // GetLocalIP returns the local instance's PrivateIP.
@@ -73,66 +185,236 @@ func (m *AWS) GetLocalIP() (string, error) {
 
 func (m *AWS) getIdentityDoc() (*ec2metadata.EC2InstanceIdentityDocument, error) {
 	if m.identityDocument == nil {
-		meta := ec2metadata.New(m.awsSession)
-		identityDoc, err := meta.GetInstanceIdentityDocument()
+		identityDoc, err := m.session.IdentityDocument()
 		if err != nil {
-			return nil, fmt.Errorf("failed to get AWS local instance data: %v", err)
+			return nil, err
 		}
-		m.identityDocument = &identityDoc
+		m.identityDocument = identityDoc
 	}
 	return m.identityDocument, nil
 }
 
-// NewAWS returns the Members this local instance belongs to.
-func NewAWS() (*AWS, error) {
-	awsSession, err := session.NewSession()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create new AWS session: %v", err)
+func (m *AWS) getASGClient() (awsASG, error) {
+	if m.asgClient == nil {
+		asgClient, err := m.session.newASGClient()
+		if err != nil {
+			return nil, err
+		}
+		m.asgClient = asgClient
+	}
+	return m.asgClient, nil
+}
+
+func (m *AWS) getEC2Client() (awsEC2, error) {
+	if m.ec2Client == nil {
+		ec2Client, err := m.session.newEC2Client()
+		if err != nil {
+			return nil, err
+		}
+		m.ec2Client = ec2Client
 	}
+	return m.ec2Client, nil
+}
+
+// NewAWS returns the Members this local instance belongs to.
+func NewAWS(session *Session, cfg *Config) (*AWS, error) {
 	return &AWS{
-		awsSession: awsSession,
+		config:  *cfg,
+		session: session,
 	}, nil
 }
 
-func queryInstances(identity *ec2metadata.EC2InstanceIdentityDocument, awsASGClient awsASG, awsEC2Client awsEC2) ([]cloud.Instance, error) {
-	instanceID := identity.InstanceID
-	asgName, err := getASGName(instanceID, awsASGClient)
-	if err != nil {
-		return nil, err
+// getASGNames returns the names of the auto scaling groups containing the cluster instances.
+func (m *AWS) getASGNames(identity *ec2metadata.EC2InstanceIdentityDocument, awsASGClient awsASG) ([]string, error) {
+	switch {
+	case len(m.config.ASGNames) > 0:
+		return m.config.ASGNames, nil
+	case len(m.config.ASGTags) > 0:
+		return getASGNamesByTags(m.config.ASGTags, awsASGClient)
+	default:
+		asgName, err := getASGName(identity.InstanceID, awsASGClient)
+		if err != nil {
+			return nil, err
+		}
+		return []string{asgName}, nil
 	}
+}
 
-	instanceIDs, err := getASGInstanceIDs(asgName, awsASGClient)
+// queryASGInstances returns the non-terminated instances across all of the given auto scaling groups.
+func queryASGInstances(asgNames []string, awsASGClient awsASG, awsEC2Client awsEC2,
+	selector cloud.EndpointSelector) ([]cloud.Instance, error) {
+	asgInstances, err := getASGInstances(asgNames, awsASGClient)
 	if err != nil {
 		return nil, err
 	}
+	if len(asgInstances) == 0 {
+		// DescribeInstances would return every instance in the region if given no instance IDs.
+		return nil, nil
+	}
+	var instanceIDs []string
+	lifecycleStates := make(map[string]string)
+	for _, asgInstance := range asgInstances {
+		instanceIDs = append(instanceIDs, *asgInstance.InstanceId)
+		lifecycleStates[*asgInstance.InstanceId] = aws.StringValue(asgInstance.LifecycleState)
+	}
 
-	var nonTerminatedStates = []string{"pending", "running", "shutting-down", "stopped", "stopping"}
 	req := &ec2.DescribeInstancesInput{
 		InstanceIds: aws.StringSlice(instanceIDs),
-		Filters: []*ec2.Filter{
-			{
-				Name:   aws.String("instance-state-name"),
-				Values: aws.StringSlice(nonTerminatedStates),
-			},
-		},
+		Filters:     []*ec2.Filter{nonTerminatedFilter()},
 	}
-
-	out, err := awsEC2Client.DescribeInstances(req)
+	instances, err := describeInstances(req, awsEC2Client, selector)
 	if err != nil {
 		return nil, err
 	}
+	for i := range instances {
+		instances[i].State = asgState(lifecycleStates[instances[i].ProviderID], instances[i].State)
+	}
+	return instances, nil
+}
+
+// queryInstancesByTags returns the non-terminated instances which have all of the given tags.
+func queryInstancesByTags(tags map[string]string, awsEC2Client awsEC2, selector cloud.EndpointSelector) ([]cloud.Instance, error) {
+	filters := append(tagFilters(tags), nonTerminatedFilter())
+	return describeInstances(&ec2.DescribeInstancesInput{Filters: filters}, awsEC2Client, selector)
+}
+
+// tagFilters returns EC2 filters matching resources which have all of the given tags.
+func tagFilters(tags map[string]string) []*ec2.Filter {
+	// Sort the keys so the filters are deterministic.
+	var keys []string
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
+	var filters []*ec2.Filter
+	for _, key := range keys {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("tag:" + key),
+			Values: aws.StringSlice([]string{tags[key]}),
+		})
+	}
+	return filters
+}
+
+func nonTerminatedFilter() *ec2.Filter {
+	return &ec2.Filter{
+		Name:   aws.String("instance-state-name"),
+		Values: aws.StringSlice(nonTerminatedStates),
+	}
+}
+
+// describeInstances returns the instances matching req, following any pagination. The endpoint of each instance is
+// its primary private IP address, unless an endpoint selector is set.
+func describeInstances(req *ec2.DescribeInstancesInput, awsEC2Client awsEC2, selector cloud.EndpointSelector) ([]cloud.Instance, error) {
 	var instances []cloud.Instance
-	for _, reservation := range out.Reservations {
-		for _, instance := range reservation.Instances {
-			instances = append(instances, cloud.Instance{
-				Name:     *instance.InstanceId,
-				Endpoint: *instance.PrivateIpAddress,
-			})
+	for {
+		out, err := awsEC2Client.DescribeInstances(req)
+		if err != nil {
+			return nil, err
 		}
+
+		for _, reservation := range out.Reservations {
+			for _, instance := range reservation.Instances {
+				cloudInstance := cloud.Instance{
+					Name:           *instance.InstanceId,
+					PrivateDNSName: aws.StringValue(instance.PrivateDnsName),
+					Tags:           tagMap(instance.Tags),
+					ProviderID:     *instance.InstanceId,
+					LaunchTime:     aws.TimeValue(instance.LaunchTime),
+				}
+				if instance.Placement != nil {
+					cloudInstance.Zone = aws.StringValue(instance.Placement.AvailabilityZone)
+				}
+				if instance.State != nil {
+					cloudInstance.State = ec2State(aws.StringValue(instance.State.Name))
+				}
+				err := selector.Select(&cloudInstance, aws.StringValue(instance.PrivateIpAddress),
+					ec2NetworkInterfaces(instance))
+				if err != nil {
+					return nil, fmt.Errorf("unable to select the endpoint of %s: %v", *instance.InstanceId, err)
+				}
+				instances = append(instances, cloudInstance)
+			}
+		}
+
+		if out.NextToken == nil || *out.NextToken == "" {
+			return instances, nil
+		}
+		req.NextToken = out.NextToken
 	}
+}
 
-	return instances, nil
+// ec2State returns the lifecycle state of an instance in the given EC2 state.
+func ec2State(state string) string {
+	switch state {
+	case ec2.InstanceStateNamePending:
+		return cloud.StatePending
+	case ec2.InstanceStateNameRunning:
+		return cloud.StateRunning
+	case ec2.InstanceStateNameShuttingDown, ec2.InstanceStateNameStopping, ec2.InstanceStateNameStopped:
+		return cloud.StateStopped
+	default:
+		return cloud.StateUnknown
+	}
+}
+
+// asgState returns the lifecycle state of an instance in the given auto scaling lifecycle state, or its EC2 state if
+// the lifecycle state doesn't change it.
+func asgState(lifecycleState, state string) string {
+	switch {
+	case lifecycleState == autoscaling.LifecycleStateStandby,
+		lifecycleState == autoscaling.LifecycleStateEnteringStandby:
+		return cloud.StateStandby
+	case strings.HasPrefix(lifecycleState, autoscaling.LifecycleStatePending) && state == cloud.StateRunning:
+		return cloud.StatePending
+	default:
+		return state
+	}
+}
+
+// tagMap returns the tags as a map, or nil if there are none.
+func tagMap(tags []*ec2.Tag) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	m := make(map[string]string)
+	for _, tag := range tags {
+		m[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return m
+}
+
+// ec2NetworkInterfaces returns the network interfaces of the instance by device index, named by their VPC and subnet
+// IDs. The primary private IP address of each interface is first, followed by its secondary and IPv6 addresses.
+func ec2NetworkInterfaces(instance *ec2.Instance) []cloud.NetworkInterface {
+	var interfaces []cloud.NetworkInterface
+	for _, eni := range instance.NetworkInterfaces {
+		networkInterface := cloud.NetworkInterface{
+			Network: aws.StringValue(eni.VpcId),
+			Subnet:  aws.StringValue(eni.SubnetId),
+		}
+		if eni.Attachment != nil {
+			networkInterface.Index = int(aws.Int64Value(eni.Attachment.DeviceIndex))
+		}
+		var secondary []string
+		for _, address := range eni.PrivateIpAddresses {
+			if aws.BoolValue(address.Primary) {
+				networkInterface.Addresses = append(networkInterface.Addresses, aws.StringValue(address.PrivateIpAddress))
+			} else {
+				secondary = append(secondary, aws.StringValue(address.PrivateIpAddress))
+			}
+		}
+		networkInterface.Addresses = append(networkInterface.Addresses, secondary...)
+		for _, address := range eni.Ipv6Addresses {
+			networkInterface.Addresses = append(networkInterface.Addresses, aws.StringValue(address.Ipv6Address))
+		}
+		interfaces = append(interfaces, networkInterface)
+	}
+	sort.Slice(interfaces, func(i, j int) bool {
+		return interfaces[i].Index < interfaces[j].Index
+	})
+	return interfaces
 }
 
 func getASGName(instanceID string, a awsASG) (string, error) {
@@ -149,23 +431,100 @@ func getASGName(instanceID string, a awsASG) (string, error) {
 	return *out.AutoScalingInstances[0].AutoScalingGroupName, nil
 }
 
-func getASGInstanceIDs(asgName string, awsASG awsASG) ([]string, error) {
+func getASGInstances(asgNames []string, awsASG awsASG) ([]*autoscaling.Instance, error) {
+	asgNames = uniqueStrings(asgNames)
 	req := &autoscaling.DescribeAutoScalingGroupsInput{
-		AutoScalingGroupNames: aws.StringSlice([]string{asgName}),
+		AutoScalingGroupNames: aws.StringSlice(asgNames),
 	}
-	out, err := awsASG.DescribeAutoScalingGroups(req)
-
+	groups, err := describeAutoScalingGroups(req, awsASG)
 	if err != nil {
-		return nil, fmt.Errorf("failed to describe AWS ASG groups: %v", err)
+		return nil, err
 	}
-	if len(out.AutoScalingGroups) != 1 {
-		return nil, fmt.Errorf("expected a single autoscaling group for %s, but found %d", asgName,
-			len(out.AutoScalingGroups))
+	if len(groups) != len(asgNames) {
+		return nil, fmt.Errorf("expected %d autoscaling groups for %v, but found %d", len(asgNames), asgNames,
+			len(groups))
 	}
 
-	var instanceIDs []string
-	for _, instance := range out.AutoScalingGroups[0].Instances {
-		instanceIDs = append(instanceIDs, *instance.InstanceId)
+	var instances []*autoscaling.Instance
+	for _, group := range groups {
+		instances = append(instances, group.Instances...)
+	}
+	return instances, nil
+}
+
+// getASGNamesByTags returns the names of all auto scaling groups which have every one of the given tags. The tags are
+// filtered by the API, rather than describing every group in the account.
+func getASGNamesByTags(tags map[string]string, awsASG awsASG) ([]string, error) {
+	var keys, values []string
+	for key, value := range tags {
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	sort.Strings(keys)
+	sort.Strings(values)
+	req := &autoscaling.DescribeTagsInput{
+		Filters: []*autoscaling.Filter{
+			{Name: aws.String("key"), Values: aws.StringSlice(keys)},
+			{Name: aws.String("value"), Values: aws.StringSlice(uniqueStrings(values))},
+		},
+	}
+
+	// The filters also match tags with one of the keys and another key's value, so each tag is checked exactly.
+	var asgNames []string
+	matches := make(map[string]int)
+	for {
+		out, err := awsASG.DescribeTags(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe AWS ASG tags: %v", err)
+		}
+		for _, tag := range out.Tags {
+			value, ok := tags[aws.StringValue(tag.Key)]
+			if !ok || value != aws.StringValue(tag.Value) || aws.StringValue(tag.ResourceType) != "auto-scaling-group" {
+				continue
+			}
+			asgName := aws.StringValue(tag.ResourceId)
+			if matches[asgName]++; matches[asgName] == len(tags) {
+				asgNames = append(asgNames, asgName)
+			}
+		}
+		if out.NextToken == nil || *out.NextToken == "" {
+			break
+		}
+		req.NextToken = out.NextToken
+	}
+	if len(asgNames) == 0 {
+		return nil, fmt.Errorf("no autoscaling groups found with tags %v", tags)
+	}
+	sort.Strings(asgNames)
+	return asgNames, nil
+}
+
+// uniqueStrings returns the values without duplicates, in the order they're first found.
+func uniqueStrings(values []string) []string {
+	var unique []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// describeAutoScalingGroups returns the auto scaling groups matching req, following any pagination.
+func describeAutoScalingGroups(req *autoscaling.DescribeAutoScalingGroupsInput, awsASG awsASG) ([]*autoscaling.Group, error) {
+	var groups []*autoscaling.Group
+	for {
+		out, err := awsASG.DescribeAutoScalingGroups(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe AWS ASG groups: %v", err)
+		}
+		groups = append(groups, out.AutoScalingGroups...)
+
+		if out.NextToken == nil || *out.NextToken == "" {
+			return groups, nil
+		}
+		req.NextToken = out.NextToken
 	}
-	return instanceIDs, nil
 }
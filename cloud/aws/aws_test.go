@@ -3,6 +3,7 @@ package aws
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
@@ -29,16 +30,19 @@ const (
 var (
 	testInstances = []cloud.Instance{
 		{
-			Name:     "test-instance-id-1",
-			Endpoint: "192.168.0.1",
+			Name:       "test-instance-id-1",
+			Endpoint:   "192.168.0.1",
+			ProviderID: "test-instance-id-1",
 		},
 		{
-			Name:     "test-instance-id-2",
-			Endpoint: "192.168.0.2",
+			Name:       "test-instance-id-2",
+			Endpoint:   "192.168.0.2",
+			ProviderID: "test-instance-id-2",
 		},
 		{
-			Name:     "test-instance-id-3",
-			Endpoint: "192.168.0.3",
+			Name:       "test-instance-id-3",
+			Endpoint:   "192.168.0.3",
+			ProviderID: "test-instance-id-3",
 		},
 	}
 )
@@ -69,8 +73,9 @@ var _ = Describe("AWS Provider", func() {
 
 		It("run GetLocalInstance successfully", func() {
 			Expect(awsProvider.GetLocalInstance()).To(Equal(cloud.Instance{
-				Name:     localInstanceID,
-				Endpoint: localPrivateIP,
+				Name:       localInstanceID,
+				Endpoint:   localPrivateIP,
+				ProviderID: localInstanceID,
 			}))
 		})
 
@@ -82,10 +87,10 @@ var _ = Describe("AWS Provider", func() {
 	Context("AWS clients", func() {
 		var awsASGClient mock.AWSASGClient
 		var awsEC2Client mock.AWSEC2Client
+		asgNames := []string{autoscalingGroupName}
 
 		BeforeEach(func() {
 			By("Generating instance arrays based on the test data")
-			var nonTerminatedStates = []string{"pending", "running", "shutting-down", "stopped", "stopping"}
 			var autoscalingInstances []*autoscaling.Instance
 			var autoscalingInstanceIDs []string
 			var ec2Instances []*ec2.Instance
@@ -143,30 +148,211 @@ var _ = Describe("AWS Provider", func() {
 			}
 		})
 
-		It("queryInstances fails when getASGName errors", func() {
+		It("GetInstances fails when getASGName errors", func() {
 			awsASGClient.MockDescribeAutoScalingInstances.Err = fmt.Errorf("failed to describe autoscaling instances")
-			_, err := queryInstances(identityDoc, awsASGClient, awsEC2Client)
+			awsProvider := &AWS{identityDocument: identityDoc, asgClient: awsASGClient, ec2Client: awsEC2Client}
+			_, err := awsProvider.GetInstances()
 			Expect(err).ToNot(BeNil())
 		})
 
-		It("queryInstances fails when getASGInstanceIDs errors", func() {
+		It("GetInstances returns the instances of the local autoscaling group", func() {
+			awsProvider := &AWS{identityDocument: identityDoc, asgClient: awsASGClient, ec2Client: awsEC2Client}
+			Expect(awsProvider.GetInstances()).To(Equal(testInstances))
+		})
+
+		It("queryASGInstances fails when getASGInstances errors", func() {
 			awsASGClient.MockDescribeAutoScalingGroups.Err = fmt.Errorf("failed to describe autoscaling groups")
-			_, err := queryInstances(identityDoc, awsASGClient, awsEC2Client)
+			_, err := queryASGInstances(asgNames, awsASGClient, awsEC2Client, cloud.EndpointSelector{})
 			Expect(err).ToNot(BeNil())
 		})
 
-		It("queryInstances fails when DescribeInstances errors", func() {
+		It("queryASGInstances fails when DescribeInstances errors", func() {
+			awsEC2Client.MockDescribeInstances.Err = fmt.Errorf("failed to describe instances")
+			_, err := queryASGInstances(asgNames, awsASGClient, awsEC2Client, cloud.EndpointSelector{})
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("queryASGInstances returns correct instance array", func() {
+			instances, err := queryASGInstances(asgNames, awsASGClient, awsEC2Client, cloud.EndpointSelector{})
+			Expect(err).To(BeNil())
+			Expect(instances).To(Equal(testInstances))
+		})
+
+		It("queryASGInstances returns the private DNS name and tags of each instance", func() {
+			ec2Instances := awsEC2Client.MockDescribeInstances.DescribeInstancesOutput.Reservations[0].Instances
+			for i, instance := range ec2Instances {
+				instance.PrivateDnsName = aws.String(fmt.Sprintf("ip-10-0-0-%d.eu-west-1.compute.internal", i))
+				instance.Tags = []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String(fmt.Sprintf("etcd-%d", i))}}
+			}
+			instances, err := queryASGInstances(asgNames, awsASGClient, awsEC2Client, cloud.EndpointSelector{})
+			Expect(err).To(BeNil())
+			for i, instance := range instances {
+				Expect(instance.PrivateDNSName).To(Equal(fmt.Sprintf("ip-10-0-0-%d.eu-west-1.compute.internal", i)))
+				Expect(instance.Tags).To(Equal(map[string]string{"Name": fmt.Sprintf("etcd-%d", i)}))
+			}
+		})
+
+		It("queryASGInstances returns the zone, state and launch time of each instance", func() {
+			launchTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			ec2Instances := awsEC2Client.MockDescribeInstances.DescribeInstancesOutput.Reservations[0].Instances
+			for _, instance := range ec2Instances {
+				instance.Placement = &ec2.Placement{AvailabilityZone: aws.String("eu-west-1a")}
+				instance.State = &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)}
+				instance.LaunchTime = aws.Time(launchTime)
+			}
+			ec2Instances[2].State.Name = aws.String(ec2.InstanceStateNameStopped)
+			asgGroups := awsASGClient.MockDescribeAutoScalingGroups.DescribeAutoScalingGroupsOutput.AutoScalingGroups
+			asgInstances := asgGroups[0].Instances
+			asgInstances[0].LifecycleState = aws.String(autoscaling.LifecycleStateInService)
+			asgInstances[1].LifecycleState = aws.String(autoscaling.LifecycleStateStandby)
+
+			instances, err := queryASGInstances(asgNames, awsASGClient, awsEC2Client, cloud.EndpointSelector{})
+			Expect(err).To(BeNil())
+			for i, instance := range instances {
+				Expect(instance.Zone).To(Equal("eu-west-1a"))
+				Expect(instance.ProviderID).To(Equal(testInstances[i].Name))
+				Expect(instance.LaunchTime).To(Equal(launchTime))
+			}
+			Expect(instances[0].State).To(Equal(cloud.StateRunning))
+			Expect(instances[1].State).To(Equal(cloud.StateStandby))
+			Expect(instances[2].State).To(Equal(cloud.StateStopped))
+		})
+
+		It("queryASGInstances selects the endpoint of instances with several network interfaces", func() {
+			ec2Instances := awsEC2Client.MockDescribeInstances.DescribeInstancesOutput.Reservations[0].Instances
+			for i, instance := range ec2Instances {
+				instance.NetworkInterfaces = []*ec2.InstanceNetworkInterface{
+					{
+						Attachment: &ec2.InstanceNetworkInterfaceAttachment{DeviceIndex: aws.Int64(1)},
+						SubnetId:   aws.String("subnet-backend"),
+						PrivateIpAddresses: []*ec2.InstancePrivateIpAddress{
+							{PrivateIpAddress: aws.String(fmt.Sprintf("192.168.1.%d", i)), Primary: aws.Bool(false)},
+							{PrivateIpAddress: aws.String(fmt.Sprintf("192.168.0.%d", i)), Primary: aws.Bool(true)},
+						},
+					},
+					{
+						Attachment:         &ec2.InstanceNetworkInterfaceAttachment{DeviceIndex: aws.Int64(0)},
+						SubnetId:           aws.String("subnet-service"),
+						PrivateIpAddresses: []*ec2.InstancePrivateIpAddress{{PrivateIpAddress: instance.PrivateIpAddress}},
+					},
+				}
+			}
+			instances, err := queryASGInstances(asgNames, awsASGClient, awsEC2Client,
+				cloud.EndpointSelector{Network: cloud.NetworkSelector{Network: "subnet-backend"}})
+			Expect(err).To(BeNil())
+			for i, instance := range instances {
+				Expect(instance.Endpoint).To(Equal(fmt.Sprintf("192.168.0.%d", i)))
+			}
+
+			_, err = queryASGInstances(asgNames, awsASGClient, awsEC2Client,
+				cloud.EndpointSelector{Network: cloud.NetworkSelector{Network: "subnet-other"}})
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("queryInstancesByTags filters by every tag and non-terminated states", func() {
+			awsEC2Client.MockDescribeInstances.ExpectedInput = &ec2.DescribeInstancesInput{
+				Filters: []*ec2.Filter{
+					{
+						Name:   aws.String("tag:etcd-cluster"),
+						Values: aws.StringSlice([]string{"prod-a"}),
+					},
+					{
+						Name:   aws.String("tag:role"),
+						Values: aws.StringSlice([]string{"etcd"}),
+					},
+					{
+						Name:   aws.String("instance-state-name"),
+						Values: aws.StringSlice(nonTerminatedStates),
+					},
+				},
+			}
+			instances, err := queryInstancesByTags(map[string]string{"role": "etcd", "etcd-cluster": "prod-a"}, awsEC2Client,
+				cloud.EndpointSelector{})
+			Expect(err).To(BeNil())
+			Expect(instances).To(Equal(testInstances))
+		})
+
+		It("queryInstancesByTags fails when DescribeInstances errors", func() {
+			awsEC2Client.MockDescribeInstances.ExpectedInput = &ec2.DescribeInstancesInput{
+				Filters: []*ec2.Filter{
+					{
+						Name:   aws.String("tag:etcd-cluster"),
+						Values: aws.StringSlice([]string{"prod-a"}),
+					},
+					nonTerminatedFilter(),
+				},
+			}
 			awsEC2Client.MockDescribeInstances.Err = fmt.Errorf("failed to describe instances")
-			_, err := queryInstances(identityDoc, awsASGClient, awsEC2Client)
+			_, err := queryInstancesByTags(map[string]string{"etcd-cluster": "prod-a"}, awsEC2Client,
+				cloud.EndpointSelector{})
 			Expect(err).ToNot(BeNil())
 		})
 
-		It("queryInstances returns correct instance array", func() {
-			instances, err := queryInstances(identityDoc, awsASGClient, awsEC2Client)
+		It("queryASGInstances returns the instances across multiple autoscaling groups", func() {
+			otherGroupName := "test-other-autoscaling-group"
+			groupInstances := awsASGClient.MockDescribeAutoScalingGroups.DescribeAutoScalingGroupsOutput.AutoScalingGroups[0].Instances
+			awsASGClient.MockDescribeAutoScalingGroups.ExpectedInput.AutoScalingGroupNames = aws.StringSlice(
+				[]string{autoscalingGroupName, otherGroupName})
+			awsASGClient.MockDescribeAutoScalingGroups.DescribeAutoScalingGroupsOutput.AutoScalingGroups = []*autoscaling.Group{
+				{Instances: groupInstances[:1]},
+				{Instances: groupInstances[1:]},
+			}
+			instances, err := queryASGInstances([]string{autoscalingGroupName, otherGroupName}, awsASGClient, awsEC2Client,
+				cloud.EndpointSelector{})
 			Expect(err).To(BeNil())
 			Expect(instances).To(Equal(testInstances))
 		})
 
+		It("getASGInstances fails when not all of the autoscaling groups are found", func() {
+			awsASGClient.MockDescribeAutoScalingGroups.ExpectedInput.AutoScalingGroupNames = aws.StringSlice(
+				[]string{autoscalingGroupName, "test-missing-autoscaling-group"})
+			_, err := getASGInstances([]string{autoscalingGroupName, "test-missing-autoscaling-group"}, awsASGClient)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("getASGInstances describes each autoscaling group once", func() {
+			groups := awsASGClient.MockDescribeAutoScalingGroups.DescribeAutoScalingGroupsOutput.AutoScalingGroups
+			Expect(getASGInstances([]string{autoscalingGroupName, autoscalingGroupName}, awsASGClient)).To(
+				Equal(groups[0].Instances))
+		})
+
+		It("getASGNamesByTags returns the autoscaling groups with all of the tags", func() {
+			awsASGClient.MockDescribeASGTags = mock.DescribeASGTags{
+				ExpectedInput: &autoscaling.DescribeTagsInput{
+					Filters: []*autoscaling.Filter{
+						{Name: aws.String("key"), Values: aws.StringSlice([]string{"etcd-cluster", "team"})},
+						{Name: aws.String("value"), Values: aws.StringSlice([]string{"infra", "prod"})},
+					},
+				},
+				DescribeTagsOutput: &autoscaling.DescribeTagsOutput{
+					Tags: []*autoscaling.TagDescription{
+						asgTag("etcd-a", "etcd-cluster", "prod"),
+						asgTag("etcd-b", "etcd-cluster", "prod"),
+						asgTag("etcd-b", "team", "infra"),
+						asgTag("etcd-c", "etcd-cluster", "infra"),
+						asgTag("etcd-c", "team", "prod"),
+						asgTag("etcd-d", "team", "infra"),
+					},
+				},
+			}
+			Expect(getASGNamesByTags(map[string]string{"etcd-cluster": "prod", "team": "infra"}, awsASGClient)).To(
+				Equal([]string{"etcd-b"}))
+		})
+
+		It("getASGNamesByTags fails when no autoscaling groups have the tags", func() {
+			awsASGClient.MockDescribeASGTags = mock.DescribeASGTags{
+				ExpectedInput: &autoscaling.DescribeTagsInput{
+					Filters: []*autoscaling.Filter{
+						{Name: aws.String("key"), Values: aws.StringSlice([]string{"etcd-cluster"})},
+						{Name: aws.String("value"), Values: aws.StringSlice([]string{"prod"})},
+					},
+				},
+				DescribeTagsOutput: &autoscaling.DescribeTagsOutput{},
+			}
+			_, err := getASGNamesByTags(map[string]string{"etcd-cluster": "prod"}, awsASGClient)
+			Expect(err).ToNot(BeNil())
+		})
+
 		It("getASGName fails when there are more than 1 autoscaling groups returned for an instance", func() {
 			awsASGClient.MockDescribeAutoScalingInstances.DescribeAutoScalingInstancesOutput.AutoScalingInstances = []*autoscaling.InstanceDetails{{}, {}}
 			_, err := getASGName(localInstanceID, awsASGClient)
@@ -179,16 +365,25 @@ var _ = Describe("AWS Provider", func() {
 			Expect(err).ToNot(BeNil())
 		})
 
-		It("getASGInstanceIDs fails when there are more than 1 autoscaling groups returned", func() {
+		It("getASGInstances fails when there are more than 1 autoscaling groups returned", func() {
 			awsASGClient.MockDescribeAutoScalingGroups.DescribeAutoScalingGroupsOutput.AutoScalingGroups = []*autoscaling.Group{{}, {}}
-			_, err := getASGInstanceIDs(autoscalingGroupName, awsASGClient)
+			_, err := getASGInstances([]string{autoscalingGroupName}, awsASGClient)
 			Expect(err).ToNot(BeNil())
 		})
 
-		It("getASGInstanceIDs fails when there are 0 autoscaling groups returned", func() {
+		It("getASGInstances fails when there are 0 autoscaling groups returned", func() {
 			awsASGClient.MockDescribeAutoScalingGroups.DescribeAutoScalingGroupsOutput.AutoScalingGroups = []*autoscaling.Group{}
-			_, err := getASGInstanceIDs(autoscalingGroupName, awsASGClient)
+			_, err := getASGInstances([]string{autoscalingGroupName}, awsASGClient)
 			Expect(err).ToNot(BeNil())
 		})
 	})
 })
+
+func asgTag(asgName, key, value string) *autoscaling.TagDescription {
+	return &autoscaling.TagDescription{
+		ResourceId:   aws.String(asgName),
+		ResourceType: aws.String("auto-scaling-group"),
+		Key:          aws.String(key),
+		Value:        aws.String(value),
+	}
+}
@@ -0,0 +1,40 @@
+package aws
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// pollInterval is how often to poll while waiting for an attachment to complete.
+var pollInterval = 2 * time.Second
+
+// waitFor polls condition until it returns true, or the timeout is reached.
+func waitFor(description string, timeout time.Duration, condition func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		done, err := condition()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v waiting for %s", timeout, description)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// tagValue returns the value of the tag with the given key, or "" if there is no such tag.
+func tagValue(tags []*ec2.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,289 @@
+package aws
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+)
+
+const (
+	defaultENINameTag     = "Name"
+	defaultENIDeviceIndex = 1
+	defaultENITimeout     = 5 * time.Minute
+)
+
+// ENIPoolConfig configures claiming a network interface from a pool of pre-created interfaces. The interface's
+// private IP and name are used in place of the instance's own, so a replacement instance keeps the same network
+// identity as the instance it replaces.
+type ENIPoolConfig struct {
+	// Tags identify the network interfaces in the pool. All tags must match.
+	Tags map[string]string
+	// NameTag is the tag key holding the stable etcd member name for a network interface. If the
+	// network interface doesn't have this tag, its ID is used instead. Defaults to "Name".
+	NameTag string
+	// DeviceIndex to attach the network interface at. Defaults to 1.
+	DeviceIndex int64
+	// Timeout to wait for the network interface to attach, and for the other instances in the cluster
+	// to attach theirs. Defaults to 5 minutes.
+	Timeout time.Duration
+	// WaitForLocalAddress waits for the network interface's IP to be assigned to a local interface once attached.
+	// This requires the guest OS to configure secondary network interfaces.
+	WaitForLocalAddress bool
+}
+
+func (c *ENIPoolConfig) nameTag() string {
+	if c.NameTag == "" {
+		return defaultENINameTag
+	}
+	return c.NameTag
+}
+
+func (c *ENIPoolConfig) deviceIndex() int64 {
+	if c.DeviceIndex == 0 {
+		return defaultENIDeviceIndex
+	}
+	return c.DeviceIndex
+}
+
+func (c *ENIPoolConfig) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return defaultENITimeout
+	}
+	return c.Timeout
+}
+
+// localAddressExists returns true if the IP is assigned to one of the local network interfaces.
+var localAddressExists = func(ip string) (bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.String() == ip {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *AWS) eniInstance(eni *ec2.NetworkInterface) cloud.Instance {
+	name := tagValue(eni.TagSet, m.config.ENIPool.nameTag())
+	if name == "" {
+		name = *eni.NetworkInterfaceId
+	}
+	instance := cloud.Instance{
+		Name:           name,
+		Endpoint:       *eni.PrivateIpAddress,
+		PrivateDNSName: aws.StringValue(eni.PrivateDnsName),
+		Zone:           aws.StringValue(eni.AvailabilityZone),
+	}
+	if eni.Attachment != nil {
+		instance.ProviderID = aws.StringValue(eni.Attachment.InstanceId)
+	}
+	return instance
+}
+
+// withPoolENIs replaces the name and endpoint of each instance with those of its pooled network interface.
+// It waits until every running instance has attached a network interface from the pool, as otherwise the instance's
+// identity would change once it does. If some haven't by the timeout, it continues with those which have as long as
+// they're a quorum of the running instances, so a single instance without a network interface can't stop the
+// cluster from bootstrapping. Instances which aren't running are only included if they have a network interface.
+func (m *AWS) withPoolENIs(identityDoc *ec2metadata.EC2InstanceIdentityDocument, instanceIDs []string,
+	instances []cloud.Instance, awsEC2Client awsEC2) ([]cloud.Instance, error) {
+	// Claim the local network interface first, so other instances waiting on this one can make progress.
+	if _, err := m.getLocalENI(identityDoc, awsEC2Client); err != nil {
+		return nil, err
+	}
+
+	var running int
+	for _, instance := range instances {
+		if isRunning(instance) {
+			running++
+		}
+	}
+	var eniInstances []cloud.Instance
+	var runningENIs int
+	var describeErr error
+	err := waitFor("all instances to attach a network interface from the pool", m.config.ENIPool.timeout(), func() (bool, error) {
+		var enis []*ec2.NetworkInterface
+		enis, describeErr = describeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{
+			Filters: append(tagFilters(m.config.ENIPool.Tags), &ec2.Filter{
+				Name:   aws.String("status"),
+				Values: aws.StringSlice([]string{ec2.NetworkInterfaceStatusInUse}),
+			}),
+		}, awsEC2Client)
+		if describeErr != nil {
+			return false, describeErr
+		}
+		attached := make(map[string]*ec2.NetworkInterface)
+		for _, eni := range enis {
+			if eni.Attachment != nil {
+				attached[aws.StringValue(eni.Attachment.InstanceId)] = eni
+			}
+		}
+
+		eniInstances = nil
+		runningENIs = 0
+		var waiting bool
+		for i, instance := range instances {
+			eni, ok := attached[instanceIDs[i]]
+			if !ok {
+				if isRunning(instance) {
+					log.Infof("Waiting for %s to attach a network interface from the pool", instanceIDs[i])
+					waiting = true
+				}
+				continue
+			}
+			if isRunning(instance) {
+				runningENIs++
+			}
+			// The network interface only replaces the identity of the instance, so it keeps its metadata.
+			eniInstance := m.eniInstance(eni)
+			eniInstance.Tags = instance.Tags
+			eniInstance.State = instance.State
+			eniInstance.LaunchTime = instance.LaunchTime
+			eniInstances = append(eniInstances, eniInstance)
+		}
+		return !waiting, nil
+	})
+	if err != nil {
+		if describeErr != nil || runningENIs < running/2+1 {
+			return nil, err
+		}
+		log.Warnf("Continuing with the %d of %d running instances which have attached a network interface from the "+
+			"pool: %v", runningENIs, running, err)
+	}
+	return eniInstances, nil
+}
+
+// isRunning returns true if the instance is running, or its state is unknown.
+func isRunning(instance cloud.Instance) bool {
+	return instance.State == cloud.StateRunning || instance.State == cloud.StateUnknown
+}
+
+// getLocalENI returns the network interface from the pool attached to the local instance, claiming and attaching
+// one if needed.
+func (m *AWS) getLocalENI(identityDoc *ec2metadata.EC2InstanceIdentityDocument, awsEC2Client awsEC2) (*ec2.NetworkInterface, error) {
+	if m.localENI == nil {
+		eni, err := claimENI(m.config.ENIPool, identityDoc, awsEC2Client)
+		if err != nil {
+			return nil, fmt.Errorf("unable to claim a network interface from the pool: %w", err)
+		}
+		m.localENI = eni
+	}
+	return m.localENI, nil
+}
+
+func claimENI(cfg *ENIPoolConfig, identityDoc *ec2metadata.EC2InstanceIdentityDocument, awsEC2Client awsEC2) (*ec2.NetworkInterface, error) {
+	instanceID := identityDoc.InstanceID
+
+	// A network interface may already be attached if etcd-bootstrap has been run before on this instance.
+	attached, err := describeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{
+		Filters: append(tagFilters(cfg.Tags), &ec2.Filter{
+			Name:   aws.String("attachment.instance-id"),
+			Values: aws.StringSlice([]string{instanceID}),
+		}),
+	}, awsEC2Client)
+	if err != nil {
+		return nil, err
+	}
+	if len(attached) > 0 {
+		log.Infof("Network interface %s from the pool is already attached", *attached[0].NetworkInterfaceId)
+		return waitForENI(cfg, *attached[0].NetworkInterfaceId, instanceID, awsEC2Client)
+	}
+
+	available, err := describeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{
+		Filters: append(tagFilters(cfg.Tags),
+			&ec2.Filter{
+				Name:   aws.String("availability-zone"),
+				Values: aws.StringSlice([]string{identityDoc.AvailabilityZone}),
+			},
+			&ec2.Filter{
+				Name:   aws.String("status"),
+				Values: aws.StringSlice([]string{ec2.NetworkInterfaceStatusAvailable}),
+			}),
+	}, awsEC2Client)
+	if err != nil {
+		return nil, err
+	}
+	// Sort so that booting instances try the network interfaces in a consistent order.
+	sort.Slice(available, func(i, j int) bool {
+		return *available[i].NetworkInterfaceId < *available[j].NetworkInterfaceId
+	})
+
+	for _, eni := range available {
+		// Attaching is the claim, as a network interface which is already attached to another instance is rejected.
+		eniID := *eni.NetworkInterfaceId
+		log.Infof("Attaching network interface %s", eniID)
+		_, err := awsEC2Client.AttachNetworkInterface(&ec2.AttachNetworkInterfaceInput{
+			NetworkInterfaceId: aws.String(eniID),
+			InstanceId:         aws.String(instanceID),
+			DeviceIndex:        aws.Int64(cfg.deviceIndex()),
+		})
+		if err != nil {
+			log.Warnf("Unable to attach network interface %s, it may have been attached by another instance: %v", eniID, err)
+			continue
+		}
+		return waitForENI(cfg, eniID, instanceID, awsEC2Client)
+	}
+
+	return nil, fmt.Errorf("no available network interfaces in the pool with tags %v in %s",
+		cfg.Tags, identityDoc.AvailabilityZone)
+}
+
+// waitForENI waits for the network interface to be attached to the instance. If configured, it also waits for its IP
+// to appear locally, which depends on the guest OS configuring secondary network interfaces.
+func waitForENI(cfg *ENIPoolConfig, eniID, instanceID string, awsEC2Client awsEC2) (*ec2.NetworkInterface, error) {
+	var eni *ec2.NetworkInterface
+	err := waitFor("network interface "+eniID+" to attach", cfg.timeout(), func() (bool, error) {
+		enis, err := describeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{
+			NetworkInterfaceIds: aws.StringSlice([]string{eniID}),
+		}, awsEC2Client)
+		if err != nil {
+			return false, err
+		}
+		if len(enis) != 1 {
+			return false, fmt.Errorf("expected a single network interface for %s, but found %d", eniID, len(enis))
+		}
+		eni = enis[0]
+		if eni.Attachment == nil || aws.StringValue(eni.Attachment.InstanceId) != instanceID {
+			return false, fmt.Errorf("network interface %s is not attached to %s", eniID, instanceID)
+		}
+		if aws.StringValue(eni.Attachment.Status) != ec2.AttachmentStatusAttached {
+			return false, nil
+		}
+		if !cfg.WaitForLocalAddress {
+			return true, nil
+		}
+		return localAddressExists(aws.StringValue(eni.PrivateIpAddress))
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Network interface %s is attached with IP %s", eniID, *eni.PrivateIpAddress)
+	return eni, nil
+}
+
+// describeNetworkInterfaces returns the network interfaces matching req, following any pagination.
+func describeNetworkInterfaces(req *ec2.DescribeNetworkInterfacesInput, awsEC2Client awsEC2) ([]*ec2.NetworkInterface, error) {
+	var enis []*ec2.NetworkInterface
+	for {
+		out, err := awsEC2Client.DescribeNetworkInterfaces(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe network interfaces: %v", err)
+		}
+		enis = append(enis, out.NetworkInterfaces...)
+
+		if out.NextToken == nil || *out.NextToken == "" {
+			return enis, nil
+		}
+		req.NextToken = out.NextToken
+	}
+}
@@ -0,0 +1,169 @@
+package aws
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/mock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	testENIID = "eni-0123456789"
+	testENIIP = "10.0.0.10"
+)
+
+var _ = Describe("ENI pool", func() {
+	var (
+		awsEC2Client mock.AWSEC2Client
+		awsProvider  *AWS
+		poolConfig   *ENIPoolConfig
+	)
+
+	BeforeEach(func() {
+		pollInterval = time.Millisecond
+		localAddressExists = func(ip string) (bool, error) {
+			return ip == testENIIP, nil
+		}
+
+		poolConfig = &ENIPoolConfig{
+			Tags:    map[string]string{"etcd-pool": "prod-a"},
+			Timeout: 50 * time.Millisecond,
+		}
+		awsProvider = &AWS{config: Config{ENIPool: poolConfig}}
+		awsEC2Client = mock.AWSEC2Client{}
+	})
+
+	Context("waiting for attachment", func() {
+		BeforeEach(func() {
+			awsEC2Client.MockDescribeNetworkInterfaces = mock.DescribeNetworkInterfaces{
+				ExpectedInput: &ec2.DescribeNetworkInterfacesInput{
+					NetworkInterfaceIds: aws.StringSlice([]string{testENIID}),
+				},
+				DescribeNetworkInterfacesOutput: &ec2.DescribeNetworkInterfacesOutput{
+					NetworkInterfaces: []*ec2.NetworkInterface{{
+						NetworkInterfaceId: aws.String(testENIID),
+						PrivateIpAddress:   aws.String(testENIIP),
+						Attachment: &ec2.NetworkInterfaceAttachment{
+							InstanceId: aws.String(localInstanceID),
+							Status:     aws.String(ec2.AttachmentStatusAttached),
+						},
+					}},
+				},
+			}
+		})
+
+		It("returns the network interface once attached", func() {
+			localAddressExists = func(ip string) (bool, error) {
+				return false, nil
+			}
+			eni, err := waitForENI(poolConfig, testENIID, localInstanceID, awsEC2Client)
+			Expect(err).To(BeNil())
+			Expect(*eni.PrivateIpAddress).To(Equal(testENIIP))
+		})
+
+		It("times out when the network interface never finishes attaching", func() {
+			eni := awsEC2Client.MockDescribeNetworkInterfaces.DescribeNetworkInterfacesOutput.NetworkInterfaces[0]
+			eni.Attachment.Status = aws.String(ec2.AttachmentStatusAttaching)
+			_, err := waitForENI(poolConfig, testENIID, localInstanceID, awsEC2Client)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("returns the network interface once its IP is assigned locally when configured to", func() {
+			poolConfig.WaitForLocalAddress = true
+			eni, err := waitForENI(poolConfig, testENIID, localInstanceID, awsEC2Client)
+			Expect(err).To(BeNil())
+			Expect(*eni.PrivateIpAddress).To(Equal(testENIIP))
+		})
+
+		It("times out when the IP is never assigned locally when configured to wait for it", func() {
+			poolConfig.WaitForLocalAddress = true
+			localAddressExists = func(ip string) (bool, error) {
+				return false, nil
+			}
+			_, err := waitForENI(poolConfig, testENIID, localInstanceID, awsEC2Client)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("fails when the network interface is attached to another instance", func() {
+			awsEC2Client.MockDescribeNetworkInterfaces.DescribeNetworkInterfacesOutput.NetworkInterfaces[0].Attachment.InstanceId =
+				aws.String("other-instance-id")
+			_, err := waitForENI(poolConfig, testENIID, localInstanceID, awsEC2Client)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Context("cluster instances", func() {
+		var instances []cloud.Instance
+		var enis []*ec2.NetworkInterface
+
+		BeforeEach(func() {
+			awsProvider.localENI = &ec2.NetworkInterface{}
+			instances = []cloud.Instance{
+				{Name: "i-1", Endpoint: "192.168.0.1"},
+				{Name: "i-2", Endpoint: "192.168.0.2"},
+			}
+			enis = []*ec2.NetworkInterface{
+				{
+					NetworkInterfaceId: aws.String("eni-1"),
+					PrivateIpAddress:   aws.String("10.0.0.1"),
+					Attachment:         &ec2.NetworkInterfaceAttachment{InstanceId: aws.String("i-1")},
+					TagSet:             []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("etcd-1")}},
+				},
+				{
+					NetworkInterfaceId: aws.String("eni-2"),
+					PrivateIpAddress:   aws.String("10.0.0.2"),
+					Attachment:         &ec2.NetworkInterfaceAttachment{InstanceId: aws.String("i-2")},
+				},
+			}
+			awsEC2Client.MockDescribeNetworkInterfaces = mock.DescribeNetworkInterfaces{
+				ExpectedInput: &ec2.DescribeNetworkInterfacesInput{
+					Filters: []*ec2.Filter{
+						{
+							Name:   aws.String("tag:etcd-pool"),
+							Values: aws.StringSlice([]string{"prod-a"}),
+						},
+						{
+							Name:   aws.String("status"),
+							Values: aws.StringSlice([]string{ec2.NetworkInterfaceStatusInUse}),
+						},
+					},
+				},
+				DescribeNetworkInterfacesOutput: &ec2.DescribeNetworkInterfacesOutput{NetworkInterfaces: enis},
+			}
+		})
+
+		It("uses the name tag and IP of each instance's network interface", func() {
+			Expect(awsProvider.withPoolENIs(nil, []string{"i-1", "i-2"}, instances, awsEC2Client)).To(Equal([]cloud.Instance{
+				{Name: "etcd-1", Endpoint: "10.0.0.1", ProviderID: "i-1"},
+				{Name: "eni-2", Endpoint: "10.0.0.2", ProviderID: "i-2"},
+			}))
+		})
+
+		It("times out when a running instance never attaches a network interface", func() {
+			awsEC2Client.MockDescribeNetworkInterfaces.DescribeNetworkInterfacesOutput.NetworkInterfaces = enis[:1]
+			_, err := awsProvider.withPoolENIs(nil, []string{"i-1", "i-2"}, instances, awsEC2Client)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("doesn't wait for instances which aren't running", func() {
+			instances[1].State = cloud.StatePending
+			awsEC2Client.MockDescribeNetworkInterfaces.DescribeNetworkInterfacesOutput.NetworkInterfaces = enis[:1]
+			Expect(awsProvider.withPoolENIs(nil, []string{"i-1", "i-2"}, instances, awsEC2Client)).To(Equal(
+				[]cloud.Instance{{Name: "etcd-1", Endpoint: "10.0.0.1", ProviderID: "i-1"}}))
+		})
+
+		It("continues with a quorum of the running instances once timed out", func() {
+			instances = append(instances, cloud.Instance{Name: "i-3", Endpoint: "192.168.0.3"})
+			Expect(awsProvider.withPoolENIs(nil, []string{"i-1", "i-2", "i-3"}, instances, awsEC2Client)).To(Equal(
+				[]cloud.Instance{
+					{Name: "etcd-1", Endpoint: "10.0.0.1", ProviderID: "i-1"},
+					{Name: "eni-2", Endpoint: "10.0.0.2", ProviderID: "i-2"},
+				}))
+		})
+	})
+})
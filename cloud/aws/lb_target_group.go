@@ -2,17 +2,32 @@ package aws
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/elbv2"
+	log "github.com/sirupsen/logrus"
 	"github.com/sky-uk/etcd-bootstrap/cloud"
 )
 
 // LBTargetGroupRegistrationProviderConfig contains configuration when creating a default LBTargetGroupRegistrationProvider
 type LBTargetGroupRegistrationProviderConfig struct {
-	TargetGroupName string
+	TargetGroups []TargetGroupConfig
+	// DrainTimeout is how long to wait for deregistered targets to finish draining. If zero, Update returns as soon as
+	// the targets have been deregistered.
+	DrainTimeout time.Duration
+}
+
+// TargetGroupConfig is a target group to register the etcd instances with.
+type TargetGroupConfig struct {
+	Name string
+	// Port to register the targets on. Defaults to the port of the target group.
+	Port int64
+	// AvailabilityZone of the targets, e.g. "all" for IP targets outside of the VPC. Defaults to the availability
+	// zone of the target's subnet.
+	AvailabilityZone string
 }
 
 // elb interface to abstract away from AWS commands
@@ -21,42 +36,62 @@ type elb interface {
 	DescribeTargetGroups(e *elbv2.DescribeTargetGroupsInput) (*elbv2.DescribeTargetGroupsOutput, error)
 	// RegisterTargets registers instance or ip targets with an aws elb target group
 	RegisterTargets(e *elbv2.RegisterTargetsInput) (*elbv2.RegisterTargetsOutput, error)
+	// DeregisterTargets deregisters instance or ip targets from an aws elb target group
+	DeregisterTargets(e *elbv2.DeregisterTargetsInput) (*elbv2.DeregisterTargetsOutput, error)
+	// DescribeTargetHealth returns the targets registered with an aws elb target group
+	DescribeTargetHealth(e *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error)
 }
 
 // LBTargetGroupRegistrationProvider contains an aws elb client and a target group name used for registering etcd
 // cluster information with an aws elb target group
 type LBTargetGroupRegistrationProvider struct {
-	targetGroupName string
-	elb             elb
+	targetGroups []TargetGroupConfig
+	drainTimeout time.Duration
+	elb          elb
 }
 
 // NewLBTargetGroupRegistrationProvider returns a default LBTargetGroupRegistrationProvider and initiates a new aws elb
 // client
-func NewLBTargetGroupRegistrationProvider(c *LBTargetGroupRegistrationProviderConfig) (*LBTargetGroupRegistrationProvider, error) {
-	awsSession, err := session.NewSession()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create new AWS session: %v", err)
-	}
-
-	meta := ec2metadata.New(awsSession)
-	identityDoc, err := meta.GetInstanceIdentityDocument()
+func NewLBTargetGroupRegistrationProvider(session *Session, c *LBTargetGroupRegistrationProviderConfig) (*LBTargetGroupRegistrationProvider, error) {
+	elbClient, err := session.newELBClient()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get AWS local instance data: %v", err)
+		return nil, err
 	}
-	config := &aws.Config{Region: aws.String(identityDoc.Region)}
-	elbClient := elbv2.New(awsSession, config)
 
 	return &LBTargetGroupRegistrationProvider{
-		targetGroupName: c.TargetGroupName,
-		elb:             elbClient,
+		targetGroups: c.TargetGroups,
+		drainTimeout: c.DrainTimeout,
+		elb:          elbClient,
 	}, nil
 }
 
-// Update will update the aws lb target group with the discovered etcd instances
+// Update will reconcile each of the aws lb target groups with the discovered etcd instances, registering any which are
+// missing and deregistering targets which no longer belong to an instance
 func (l LBTargetGroupRegistrationProvider) Update(instances []cloud.Instance) error {
+	var failures []string
+	for i, targetGroup := range l.targetGroups {
+		// The same target group can be configured on several ports, whose targets are left to their own config.
+		var otherPorts []int64
+		for j, other := range l.targetGroups {
+			if j != i && other.Name == targetGroup.Name {
+				otherPorts = append(otherPorts, other.Port)
+			}
+		}
+		if err := l.updateTargetGroup(targetGroup, otherPorts, instances); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", targetGroup.Name, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("unable to update loadbalancer target groups: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func (l LBTargetGroupRegistrationProvider) updateTargetGroup(cfg TargetGroupConfig, otherPorts []int64,
+	instances []cloud.Instance) error {
 	targetGroups, err := l.elb.DescribeTargetGroups(&elbv2.DescribeTargetGroupsInput{
 		Names: []*string{
-			aws.String(l.targetGroupName),
+			aws.String(cfg.Name),
 		},
 	})
 	if err != nil {
@@ -68,23 +103,181 @@ func (l LBTargetGroupRegistrationProvider) Update(instances []cloud.Instance) er
 		return fmt.Errorf("target group validation failed: %v", err)
 	}
 
-	var targets []*elbv2.TargetDescription
-	for _, instance := range instances {
-		targets = append(targets, &elbv2.TargetDescription{
-			Id: aws.String(instance.Endpoint),
-		})
+	targetGroup := targetGroups.TargetGroups[0]
+	ids, err := targetIDs(aws.StringValue(targetGroup.TargetType), instances)
+	if err != nil {
+		return err
+	}
+	// Registered targets are matched on their port too, as the same ID can be registered on several ports.
+	port := cfg.Port
+	if port == 0 {
+		port = aws.Int64Value(targetGroup.Port)
+	}
+	registered, err := l.registeredTargets(targetGroupARN, port)
+	if err != nil {
+		return err
+	}
+	for _, otherPort := range otherPorts {
+		if otherPort == 0 {
+			otherPort = aws.Int64Value(targetGroup.Port)
+		}
+		if otherPort == port {
+			continue
+		}
+		for key := range registered {
+			if strings.HasSuffix(key, fmt.Sprintf(":%d", otherPort)) {
+				delete(registered, key)
+			}
+		}
+	}
+
+	var desired []string
+	var missing []*elbv2.TargetDescription
+	for _, id := range ids {
+		key := targetKey(id, port)
+		desired = append(desired, key)
+		if _, ok := registered[key]; !ok {
+			target := &elbv2.TargetDescription{Id: aws.String(id)}
+			if cfg.Port != 0 {
+				target.Port = aws.Int64(cfg.Port)
+			}
+			if cfg.AvailabilityZone != "" {
+				target.AvailabilityZone = aws.String(cfg.AvailabilityZone)
+			}
+			missing = append(missing, target)
+		}
+	}
+	var stale []*elbv2.TargetDescription
+	for _, key := range sortedKeys(registered) {
+		if !contains(desired, key) {
+			stale = append(stale, registered[key])
+		}
+	}
+
+	if len(missing) > 0 {
+		registerEtcdInstances := &elbv2.RegisterTargetsInput{
+			TargetGroupArn: targetGroupARN,
+			Targets:        missing,
+		}
+		if _, err := l.elb.RegisterTargets(registerEtcdInstances); err != nil {
+			return fmt.Errorf("unable to register etcd instances with loadbalancer target group: %v", err)
+		}
+		log.Infof("Registered %v with target group %s", targetDescriptionIDs(missing), cfg.Name)
 	}
 
-	registerEtcdInstances := &elbv2.RegisterTargetsInput{
+	if len(stale) == 0 {
+		return nil
+	}
+	if len(desired) == 0 {
+		log.Warnf("Not deregistering %v from target group %s as there are no etcd instances",
+			targetDescriptionIDs(stale), cfg.Name)
+		return nil
+	}
+	return l.deregister(cfg.Name, targetGroupARN, stale)
+}
+
+// registeredTargets returns the targets registered with the target group, by ID and port. Targets without a port
+// use the default port. Targets which are already draining are excluded.
+func (l LBTargetGroupRegistrationProvider) registeredTargets(targetGroupARN *string, defaultPort int64) (map[string]*elbv2.TargetDescription, error) {
+	out, err := l.elb.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{TargetGroupArn: targetGroupARN})
+	if err != nil {
+		return nil, fmt.Errorf("unable to describe loadbalancer target health: %v", err)
+	}
+	targets := make(map[string]*elbv2.TargetDescription)
+	for _, description := range out.TargetHealthDescriptions {
+		if description.TargetHealth != nil &&
+			aws.StringValue(description.TargetHealth.State) == elbv2.TargetHealthStateEnumDraining {
+			continue
+		}
+		port := defaultPort
+		if description.Target.Port != nil {
+			port = *description.Target.Port
+		}
+		targets[targetKey(aws.StringValue(description.Target.Id), port)] = description.Target
+	}
+	return targets, nil
+}
+
+// deregister deregisters the targets, and waits for them to finish draining if a drain timeout is set.
+func (l LBTargetGroupRegistrationProvider) deregister(name string, targetGroupARN *string, targets []*elbv2.TargetDescription) error {
+	ids := targetDescriptionIDs(targets)
+	if _, err := l.elb.DeregisterTargets(&elbv2.DeregisterTargetsInput{
 		TargetGroupArn: targetGroupARN,
 		Targets:        targets,
+	}); err != nil {
+		return fmt.Errorf("unable to deregister stale targets from loadbalancer target group: %v", err)
 	}
+	log.Infof("Deregistered stale targets %v from target group %s", ids, name)
 
-	if _, err := l.elb.RegisterTargets(registerEtcdInstances); err != nil {
-		return fmt.Errorf("unable to register etcd instances with loadbalancer target group: %v", err)
+	if l.drainTimeout == 0 {
+		return nil
 	}
+	return waitFor(fmt.Sprintf("targets %v to drain from %s", ids, name), l.drainTimeout,
+		func() (bool, error) {
+			out, err := l.elb.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{TargetGroupArn: targetGroupARN})
+			if err != nil {
+				return false, fmt.Errorf("unable to describe loadbalancer target health: %v", err)
+			}
+			for _, description := range out.TargetHealthDescriptions {
+				for _, target := range targets {
+					if aws.StringValue(description.Target.Id) == aws.StringValue(target.Id) &&
+						aws.Int64Value(description.Target.Port) == aws.Int64Value(target.Port) {
+						return false, nil
+					}
+				}
+			}
+			return true, nil
+		})
+}
 
-	return nil
+// targetIDs returns the IDs of the instances' targets for the target type of the target group.
+func targetIDs(targetType string, instances []cloud.Instance) ([]string, error) {
+	var ids []string
+	for _, instance := range instances {
+		switch targetType {
+		case elbv2.TargetTypeEnumIp:
+			ids = append(ids, instance.Endpoint)
+		case elbv2.TargetTypeEnumInstance:
+			if instance.ProviderID == "" {
+				return nil, fmt.Errorf("instance target groups require the instance ID of %s, which is unknown",
+					instance.Name)
+			}
+			ids = append(ids, instance.ProviderID)
+		default:
+			return nil, fmt.Errorf("unsupported target type %q", targetType)
+		}
+	}
+	return ids, nil
+}
+
+func targetKey(id string, port int64) string {
+	return fmt.Sprintf("%s:%d", id, port)
+}
+
+func targetDescriptionIDs(targets []*elbv2.TargetDescription) []string {
+	var ids []string
+	for _, target := range targets {
+		ids = append(ids, aws.StringValue(target.Id))
+	}
+	return ids
+}
+
+func sortedKeys(targets map[string]*elbv2.TargetDescription) []string {
+	var keys []string
+	for key := range targets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
 
 func getTargetGroupARN(targetGroups *elbv2.DescribeTargetGroupsOutput) (*string, error) {
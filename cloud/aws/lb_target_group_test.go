@@ -2,7 +2,9 @@ package aws
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/elbv2"
@@ -48,9 +50,17 @@ var _ = Describe("Loadbalancer Target Group Registration Provider", func() {
 				DescribeTargetGroupsOutput: &elbv2.DescribeTargetGroupsOutput{
 					TargetGroups: []*elbv2.TargetGroup{{
 						TargetGroupArn: aws.String(targetGroupARN),
+						TargetType:     aws.String(elbv2.TargetTypeEnumIp),
+						Port:           aws.Int64(2379),
 					}},
 				},
 			},
+			MockDescribeTargetHealth: mock.DescribeTargetHealth{
+				ExpectedInput: &elbv2.DescribeTargetHealthInput{
+					TargetGroupArn: aws.String(targetGroupARN),
+				},
+				DescribeTargetHealthOutput: &elbv2.DescribeTargetHealthOutput{},
+			},
 			MockRegisterTargets: mock.RegisterTargets{
 				ExpectedInput: &elbv2.RegisterTargetsInput{
 					TargetGroupArn: aws.String(targetGroupARN),
@@ -59,8 +69,8 @@ var _ = Describe("Loadbalancer Target Group Registration Provider", func() {
 			},
 		}
 		registrationProvider = LBTargetGroupRegistrationProvider{
-			targetGroupName: targetGroupName,
-			elb:             elbClient,
+			targetGroups: []TargetGroupConfig{{Name: targetGroupName}},
+			elb:          elbClient,
 		}
 	})
 
@@ -69,8 +79,8 @@ var _ = Describe("Loadbalancer Target Group Registration Provider", func() {
 			Expect(registrationProvider.Update(testInstances)).To(BeNil())
 		})
 
-		It("passes when DescribeTargetGroups and RegisterTargets return expected values with no instances", func() {
-			elbClient.MockRegisterTargets.ExpectedInput.Targets = nil
+		It("passes without registering targets when there are no instances", func() {
+			elbClient.MockRegisterTargets.Err = fmt.Errorf("unexpected call to register targets")
 			registrationProvider.elb = elbClient
 			Expect(registrationProvider.Update([]cloud.Instance{})).To(BeNil())
 		})
@@ -103,4 +113,152 @@ var _ = Describe("Loadbalancer Target Group Registration Provider", func() {
 			Expect(registrationProvider.Update(testInstances)).ToNot(BeNil())
 		})
 	})
+	Context("Update() reconciling targets", func() {
+		targetHealth := func(id, state string) *elbv2.TargetHealthDescription {
+			return &elbv2.TargetHealthDescription{
+				Target:       &elbv2.TargetDescription{Id: aws.String(id), Port: aws.Int64(2379)},
+				TargetHealth: &elbv2.TargetHealth{State: aws.String(state)},
+			}
+		}
+
+		BeforeEach(func() {
+			pollInterval = time.Millisecond
+			elbClient.MockDescribeTargetHealth.DescribeTargetHealthOutput.TargetHealthDescriptions =
+				[]*elbv2.TargetHealthDescription{
+					targetHealth("192.168.0.1", elbv2.TargetHealthStateEnumHealthy),
+					targetHealth("192.168.0.2", elbv2.TargetHealthStateEnumDraining),
+					targetHealth("192.168.0.9", elbv2.TargetHealthStateEnumHealthy),
+				}
+			elbClient.MockRegisterTargets.ExpectedInput.Targets = []*elbv2.TargetDescription{
+				{Id: aws.String("192.168.0.2")},
+				{Id: aws.String("192.168.0.3")},
+			}
+			elbClient.MockDeregisterTargets = mock.DeregisterTargets{
+				ExpectedInput: &elbv2.DeregisterTargetsInput{
+					TargetGroupArn: aws.String(targetGroupARN),
+					Targets:        []*elbv2.TargetDescription{{Id: aws.String("192.168.0.9"), Port: aws.Int64(2379)}},
+				},
+			}
+			registrationProvider.elb = elbClient
+		})
+
+		It("registers missing targets and deregisters stale targets", func() {
+			Expect(registrationProvider.Update(testInstances)).To(BeNil())
+		})
+
+		It("does not deregister every target when there are no instances", func() {
+			elbClient.MockDeregisterTargets.Err = fmt.Errorf("unexpected call to deregister targets")
+			elbClient.MockRegisterTargets.Err = fmt.Errorf("unexpected call to register targets")
+			registrationProvider.elb = elbClient
+			Expect(registrationProvider.Update([]cloud.Instance{})).To(BeNil())
+		})
+
+		It("fails when DescribeTargetHealth errors", func() {
+			elbClient.MockDescribeTargetHealth.Err = fmt.Errorf("failed to describe target health")
+			registrationProvider.elb = elbClient
+			Expect(registrationProvider.Update(testInstances)).ToNot(BeNil())
+		})
+
+		It("fails when DeregisterTargets errors", func() {
+			elbClient.MockDeregisterTargets.Err = fmt.Errorf("failed to deregister targets")
+			registrationProvider.elb = elbClient
+			Expect(registrationProvider.Update(testInstances)).ToNot(BeNil())
+		})
+
+		It("times out when deregistered targets don't finish draining", func() {
+			registrationProvider.drainTimeout = 10 * time.Millisecond
+			Expect(registrationProvider.Update(testInstances)).ToNot(BeNil())
+		})
+
+		It("uses instance IDs for instance target groups", func() {
+			elbClient.MockDescribeTargetGroups.DescribeTargetGroupsOutput.TargetGroups[0].TargetType =
+				aws.String(elbv2.TargetTypeEnumInstance)
+			elbClient.MockDescribeTargetHealth.DescribeTargetHealthOutput.TargetHealthDescriptions =
+				[]*elbv2.TargetHealthDescription{
+					targetHealth("i-1", elbv2.TargetHealthStateEnumHealthy),
+					targetHealth("i-9", elbv2.TargetHealthStateEnumUnhealthy),
+				}
+			elbClient.MockRegisterTargets.ExpectedInput.Targets = []*elbv2.TargetDescription{{Id: aws.String("i-2")}}
+			elbClient.MockDeregisterTargets.ExpectedInput.Targets = []*elbv2.TargetDescription{
+				{Id: aws.String("i-9"), Port: aws.Int64(2379)},
+			}
+			registrationProvider.elb = elbClient
+			Expect(registrationProvider.Update([]cloud.Instance{
+				{Name: "etcd-1", Endpoint: "192.168.0.1", ProviderID: "i-1"},
+				{Name: "etcd-2", Endpoint: "192.168.0.2", ProviderID: "i-2"},
+			})).To(BeNil())
+		})
+
+		It("fails for instance target groups when the instance IDs are unknown", func() {
+			elbClient.MockDescribeTargetGroups.DescribeTargetGroupsOutput.TargetGroups[0].TargetType =
+				aws.String(elbv2.TargetTypeEnumInstance)
+			registrationProvider.elb = elbClient
+			Expect(registrationProvider.Update([]cloud.Instance{{Name: "etcd-1", Endpoint: "192.168.0.1"}})).ToNot(BeNil())
+		})
+	})
+	Context("Update() with target group options", func() {
+		BeforeEach(func() {
+			elbClient.MockDescribeTargetHealth.DescribeTargetHealthOutput.TargetHealthDescriptions =
+				[]*elbv2.TargetHealthDescription{{
+					Target: &elbv2.TargetDescription{Id: aws.String("192.168.0.1"), Port: aws.Int64(2379)},
+				}}
+			registrationProvider.targetGroups = []TargetGroupConfig{{
+				Name:             targetGroupName,
+				Port:             2381,
+				AvailabilityZone: "all",
+			}}
+		})
+
+		It("registers targets on the configured port and availability zone", func() {
+			var targets []*elbv2.TargetDescription
+			for _, instance := range testInstances {
+				targets = append(targets, &elbv2.TargetDescription{
+					Id:               aws.String(instance.Endpoint),
+					Port:             aws.Int64(2381),
+					AvailabilityZone: aws.String("all"),
+				})
+			}
+			elbClient.MockRegisterTargets.ExpectedInput.Targets = targets
+			elbClient.MockDeregisterTargets = mock.DeregisterTargets{
+				ExpectedInput: &elbv2.DeregisterTargetsInput{
+					TargetGroupArn: aws.String(targetGroupARN),
+					Targets:        []*elbv2.TargetDescription{{Id: aws.String("192.168.0.1"), Port: aws.Int64(2379)}},
+				},
+			}
+			registrationProvider.elb = elbClient
+			Expect(registrationProvider.Update(testInstances)).To(BeNil())
+		})
+
+		It("leaves the targets of the same target group on another configured port", func() {
+			var registered []*elbv2.TargetHealthDescription
+			for _, port := range []int64{2379, 2381} {
+				for _, instance := range testInstances {
+					registered = append(registered, &elbv2.TargetHealthDescription{
+						Target: &elbv2.TargetDescription{Id: aws.String(instance.Endpoint), Port: aws.Int64(port)},
+					})
+				}
+			}
+			elbClient.MockDescribeTargetHealth.DescribeTargetHealthOutput.TargetHealthDescriptions = registered
+			elbClient.MockRegisterTargets.Err = fmt.Errorf("unexpected call to register targets")
+			elbClient.MockDeregisterTargets.Err = fmt.Errorf("unexpected call to deregister targets")
+			registrationProvider.elb = elbClient
+			registrationProvider.targetGroups = []TargetGroupConfig{
+				{Name: targetGroupName},
+				{Name: targetGroupName, Port: 2381},
+			}
+			Expect(registrationProvider.Update(testInstances)).To(BeNil())
+		})
+
+		It("updates every target group", func() {
+			elbClient.MockDescribeTargetGroups.Err = fmt.Errorf("failed to describe target group")
+			registrationProvider.elb = elbClient
+			registrationProvider.targetGroups = []TargetGroupConfig{
+				{Name: targetGroupName},
+				{Name: targetGroupName, Port: 2381},
+			}
+			err := registrationProvider.Update(testInstances)
+			Expect(err).ToNot(BeNil())
+			Expect(strings.Count(err.Error(), "failed to describe target group")).To(Equal(2))
+		})
+	})
 })
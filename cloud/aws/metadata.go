@@ -0,0 +1,159 @@
+package aws
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMetadataEndpoint = "http://169.254.169.254/latest"
+	defaultMetadataTimeout  = 5 * time.Second
+
+	metadataTokenHeader    = "X-aws-ec2-metadata-token"
+	metadataTokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+	metadataTokenTTL       = 6 * time.Hour
+)
+
+// MetadataConfig configures access to the EC2 instance metadata service (IMDS).
+type MetadataConfig struct {
+	// Timeout for each request to the instance metadata service. Defaults to 5 seconds.
+	Timeout time.Duration
+	// IMDSv1Fallback falls back to IMDSv1 requests without a session token, if a token can't be obtained.
+	// This is typically because the metadata hop limit is too low for the token response to reach a container.
+	IMDSv1Fallback bool
+}
+
+// imdsClient is a client for the EC2 instance metadata service, which uses IMDSv2 session tokens.
+type imdsClient struct {
+	endpoint    string
+	client      *http.Client
+	v1Fallback  bool
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+func newIMDSClient(cfg MetadataConfig) *imdsClient {
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultMetadataTimeout
+	}
+	return &imdsClient{
+		endpoint:   defaultMetadataEndpoint,
+		client:     &http.Client{Timeout: timeout},
+		v1Fallback: cfg.IMDSv1Fallback,
+	}
+}
+
+// getIdentityDocument returns the instance identity document of the local instance.
+func (c *imdsClient) getIdentityDocument() (*ec2metadata.EC2InstanceIdentityDocument, error) {
+	body, err := c.get("/dynamic/instance-identity/document")
+	if err != nil {
+		return nil, err
+	}
+	var identityDoc ec2metadata.EC2InstanceIdentityDocument
+	if err := json.Unmarshal(body, &identityDoc); err != nil {
+		return nil, fmt.Errorf("unable to parse instance identity document: %v", err)
+	}
+	return &identityDoc, nil
+}
+
+func (c *imdsClient) get(path string) ([]byte, error) {
+	token, err := c.sessionToken()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.endpoint+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set(metadataTokenHeader, token)
+	}
+	return c.do(req)
+}
+
+// tokenHandler adds the IMDSv2 session token to the requests of the SDK's instance metadata clients, such as the one
+// used by the EC2 role credentials provider, which only make IMDSv1 requests in this version of the SDK.
+func (c *imdsClient) tokenHandler() request.NamedHandler {
+	return request.NamedHandler{
+		Name: "etcd-bootstrap.IMDSv2TokenHandler",
+		Fn: func(r *request.Request) {
+			if r.ClientInfo.ServiceName != ec2metadata.ServiceName {
+				return
+			}
+			token, err := c.sessionToken()
+			if err != nil {
+				r.Error = err
+				return
+			}
+			if token != "" {
+				r.HTTPRequest.Header.Set(metadataTokenHeader, token)
+			}
+		},
+	}
+}
+
+// sessionToken returns the IMDSv2 session token, or an empty token if one can't be obtained and falling back to IMDSv1
+// is allowed.
+func (c *imdsClient) sessionToken() (string, error) {
+	token, err := c.getToken()
+	if err != nil {
+		if !c.v1Fallback {
+			return "", fmt.Errorf("unable to get IMDSv2 session token: %v", err)
+		}
+		log.Warnf("Unable to get IMDSv2 session token, falling back to IMDSv1. This may be due to the metadata "+
+			"hop limit being too low: %v", err)
+	}
+	return token, nil
+}
+
+// getToken returns a cached IMDSv2 session token, requesting a new one if needed.
+func (c *imdsClient) getToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Refresh a little early, so the token doesn't expire mid request.
+	if c.token != "" && time.Now().Add(time.Minute).Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPut, c.endpoint+"/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(metadataTokenTTLHeader, fmt.Sprintf("%d", int(metadataTokenTTL.Seconds())))
+	token, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+
+	c.token = string(token)
+	c.tokenExpiry = time.Now().Add(metadataTokenTTL)
+	return c.token, nil
+}
+
+func (c *imdsClient) do(req *http.Request) ([]byte, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s returned %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return body, nil
+}
@@ -0,0 +1,141 @@
+package aws
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/sky-uk/etcd-bootstrap/mock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	testMetadataToken = "test-token"
+	testIdentityDoc   = `{"instanceId": "test-local-instance-id", "privateIp": "127.0.0.1", "region": "eu-west-1"}`
+)
+
+var _ = Describe("Instance metadata", func() {
+	var (
+		server         *httptest.Server
+		tokenRequests  int
+		tokenSupported bool
+		tokenRequired  bool
+		imds           *imdsClient
+	)
+
+	BeforeEach(func() {
+		tokenRequests = 0
+		tokenSupported = true
+		tokenRequired = true
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+				tokenRequests++
+				Expect(r.Header.Get(metadataTokenTTLHeader)).ToNot(BeEmpty())
+				if !tokenSupported {
+					// Simulate the token response being dropped due to the hop limit.
+					time.Sleep(100 * time.Millisecond)
+					return
+				}
+				fmt.Fprint(w, testMetadataToken)
+			case r.Method == http.MethodGet && r.URL.Path == "/latest/dynamic/instance-identity/document":
+				if tokenRequired && r.Header.Get(metadataTokenHeader) != testMetadataToken {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				fmt.Fprint(w, testIdentityDoc)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		imds = newIMDSClient(MetadataConfig{Timeout: 50 * time.Millisecond})
+		imds.endpoint = server.URL + "/latest"
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("gets the identity document using a session token", func() {
+		Expect(imds.getIdentityDocument()).To(Equal(&ec2metadata.EC2InstanceIdentityDocument{
+			InstanceID: localInstanceID,
+			PrivateIP:  localPrivateIP,
+			Region:     "eu-west-1",
+		}))
+	})
+
+	It("reuses the session token", func() {
+		_, err := imds.getIdentityDocument()
+		Expect(err).To(BeNil())
+		_, err = imds.getIdentityDocument()
+		Expect(err).To(BeNil())
+		Expect(tokenRequests).To(Equal(1))
+	})
+
+	It("fails when a session token can't be obtained", func() {
+		tokenSupported = false
+		_, err := imds.getIdentityDocument()
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("falls back to IMDSv1 when a session token can't be obtained and fallback is enabled", func() {
+		tokenSupported = false
+		tokenRequired = false
+		imds.v1Fallback = true
+		identityDoc, err := imds.getIdentityDocument()
+		Expect(err).To(BeNil())
+		Expect(identityDoc.InstanceID).To(Equal(localInstanceID))
+	})
+
+	It("fails when the instance metadata service rejects the request", func() {
+		tokenSupported = false
+		imds.v1Fallback = true
+		_, err := imds.getIdentityDocument()
+		Expect(err).ToNot(BeNil())
+	})
+
+	Context("without the instance metadata service", func() {
+		var awsEC2Client mock.AWSEC2Client
+
+		BeforeEach(func() {
+			awsEC2Client = mock.AWSEC2Client{
+				MockDescribeInstances: mock.DescribeInstances{
+					ExpectedInput: &ec2.DescribeInstancesInput{
+						InstanceIds: aws.StringSlice([]string{localInstanceID}),
+					},
+					DescribeInstancesOutput: &ec2.DescribeInstancesOutput{
+						Reservations: []*ec2.Reservation{{
+							Instances: []*ec2.Instance{{
+								InstanceId:       aws.String(localInstanceID),
+								PrivateIpAddress: aws.String(localPrivateIP),
+								Placement:        &ec2.Placement{AvailabilityZone: aws.String("eu-west-1a")},
+							}},
+						}},
+					},
+				},
+			}
+		})
+
+		It("builds the identity document from the EC2 API", func() {
+			Expect(describeIdentity("eu-west-1", localInstanceID, awsEC2Client)).To(Equal(
+				&ec2metadata.EC2InstanceIdentityDocument{
+					InstanceID:       localInstanceID,
+					PrivateIP:        localPrivateIP,
+					Region:           "eu-west-1",
+					AvailabilityZone: "eu-west-1a",
+				}))
+		})
+
+		It("fails when the instance doesn't exist", func() {
+			awsEC2Client.MockDescribeInstances.DescribeInstancesOutput = &ec2.DescribeInstancesOutput{}
+			_, err := describeIdentity("eu-west-1", localInstanceID, awsEC2Client)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+})
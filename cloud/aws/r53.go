@@ -1,20 +1,51 @@
 package aws
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/route53"
 	log "github.com/sirupsen/logrus"
 	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/registration/dnsrecords"
 )
 
+// dnsTimeout is the timeout for each lookup when verifying the records.
+const dnsTimeout = 5 * time.Second
+
 // Route53RegistrationProviderConfig contains configuration when creating a default Route53RegistrationProvider
 type Route53RegistrationProviderConfig struct {
-	ZoneID   string
+	// ZoneID of the hosted zone to update. Either ZoneID or ZoneName must be set.
+	ZoneID string
+	// ZoneName looks up the hosted zone by its domain name instead of its ID.
+	ZoneName string
+	// PrivateZone selects a private rather than public hosted zone when looking up the zone by name.
+	PrivateZone bool
+	// VPCID selects the private hosted zone associated with the VPC when looking up the zone by name.
+	VPCID string
+	// Hostname is the name of the record, relative to the zone. If it ends with a '.' it's treated as fully qualified,
+	// and must be inside the zone.
 	Hostname string
+	// NodeRecords publishes an A, AAAA and TXT record for each node under the hostname, along with an SRV record
+	// listing them. This is the layout expected by the SRV instance lookup method.
+	NodeRecords bool
+	// SRVService is the service of the SRV record when NodeRecords is set.
+	SRVService string
+	// SRVPort is the port of the SRV record targets when NodeRecords is set, which should be the etcd client port.
+	// Defaults to 2379.
+	SRVPort int
+	// WaitTimeout is how long to wait for the change to propagate to all of the Route53 name servers. If zero, Update
+	// returns as soon as the change has been accepted.
+	WaitTimeout time.Duration
+	// Verify resolves the hostname against each of the zone's name servers once the change has propagated, and
+	// waits until they all return the expected endpoints. Requires WaitTimeout.
+	Verify bool
 }
 
 // r53 interface to abstract away from AWS commands
@@ -23,74 +54,340 @@ type r53 interface {
 	GetHostedZone(r *route53.GetHostedZoneInput) (*route53.GetHostedZoneOutput, error)
 	// ChangeResourceRecordSets will update a given hosted zone using the aws route53 client
 	ChangeResourceRecordSets(r *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error)
+	// ListResourceRecordSets lists the records in a given hosted zone using the aws route53 client
+	ListResourceRecordSets(r *route53.ListResourceRecordSetsInput) (*route53.ListResourceRecordSetsOutput, error)
+	// GetChange gets the status of a change using the aws route53 client
+	GetChange(r *route53.GetChangeInput) (*route53.GetChangeOutput, error)
+	// ListHostedZonesByName lists the hosted zones in order of their domain name using the aws route53 client
+	ListHostedZonesByName(r *route53.ListHostedZonesByNameInput) (*route53.ListHostedZonesByNameOutput, error)
+}
+
+// hostResolver looks up the addresses of a host, e.g. net.Resolver.
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// nameServerResolver returns a resolver which sends all queries to the given name server.
+func nameServerResolver(nameServer string) hostResolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, net.JoinHostPort(nameServer, "53"))
+		},
+	}
 }
 
 // Route53RegistrationProvider contains an aws route53 client and information about the desired hosted zone the user
 // wants to update
 type Route53RegistrationProvider struct {
-	zoneID   string
-	hostname string
-	r53      r53
+	zoneID      string
+	zoneName    string
+	privateZone bool
+	vpcID       string
+	hostname    string
+	records     dnsrecords.Layout
+	waitTimeout time.Duration
+	verify      bool
+	r53         r53
+	resolverFor func(nameServer string) hostResolver
 }
 
 // NewRoute53RegistrationProvider returns a default Route53RegistrationProvider and initiates an new aws route53 client
-func NewRoute53RegistrationProvider(c *Route53RegistrationProviderConfig) (*Route53RegistrationProvider, error) {
-	awsSession, err := session.NewSession()
+func NewRoute53RegistrationProvider(session *Session, c *Route53RegistrationProviderConfig) (*Route53RegistrationProvider, error) {
+	r53Client, err := session.newRoute53Client()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new AWS session: %v", err)
+		return nil, err
 	}
 
-	meta := ec2metadata.New(awsSession)
-	identityDoc, err := meta.GetInstanceIdentityDocument()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get AWS local instance data: %v", err)
+	if (c.ZoneID == "") == (c.ZoneName == "") {
+		return nil, fmt.Errorf("exactly one of the route53 zone ID or zone name must be provided")
+	}
+	if c.Verify && c.WaitTimeout == 0 {
+		return nil, fmt.Errorf("a wait timeout is required to verify route53 changes")
 	}
-	config := &aws.Config{Region: aws.String(identityDoc.Region)}
-	r53Client := route53.New(awsSession, config)
 
 	return &Route53RegistrationProvider{
-		zoneID:   c.ZoneID,
-		hostname: c.Hostname,
-		r53:      r53Client,
+		zoneID:      c.ZoneID,
+		zoneName:    c.ZoneName,
+		privateZone: c.PrivateZone || c.VPCID != "",
+		vpcID:       c.VPCID,
+		hostname:    c.Hostname,
+		records: dnsrecords.Layout{
+			NodeRecords: c.NodeRecords,
+			SRVService:  c.SRVService,
+			SRVPort:     c.SRVPort,
+		},
+		waitTimeout: c.WaitTimeout,
+		verify:      c.Verify,
+		r53:         r53Client,
+		resolverFor: nameServerResolver,
 	}, nil
 }
 
 // Update will update the specified hostname in the route53 zone with discovered etcd ip addresses
 func (r Route53RegistrationProvider) Update(instances []cloud.Instance) error {
-	zoneInput := &route53.GetHostedZoneInput{Id: aws.String(r.zoneID)}
+	zoneID := r.zoneID
+	if zoneID == "" {
+		var err error
+		if zoneID, err = r.lookupZoneID(); err != nil {
+			return err
+		}
+	}
+
+	zoneInput := &route53.GetHostedZoneInput{Id: aws.String(zoneID)}
 	zone, err := r.r53.GetHostedZone(zoneInput)
 	if err != nil {
 		return fmt.Errorf("unable to retrieve hosted zone - are you sure it exists?: %v", err)
 	}
 
-	fqdn := r.hostname + "." + *zone.HostedZone.Name
+	fqdn, err := r.fqdn(*zone.HostedZone.Name)
+	if err != nil {
+		return err
+	}
 
-	var resourceRecords []*route53.ResourceRecord
-	for _, instance := range instances {
-		resourceRecords = append(resourceRecords, &route53.ResourceRecord{Value: aws.String(instance.Endpoint)})
+	existing, err := r.listRecordSets(zone.HostedZone.Id, fqdn)
+	if err != nil {
+		return err
 	}
 
-	change := &route53.Change{
-		Action: aws.String(route53.ChangeActionUpsert),
-		ResourceRecordSet: &route53.ResourceRecordSet{
-			Name: aws.String(fqdn),
-			Type: aws.String(route53.RRTypeA),
-			// Completely arbitrary amount that is not too long or too short.
-			TTL:             aws.Int64(300),
-			ResourceRecords: resourceRecords,
-		},
+	desired, err := r.records.RecordSets(fqdn, instances)
+	if err != nil {
+		return err
+	}
+	var changes []*route53.Change
+	for _, recordSet := range desired {
+		changes = append(changes, upsert(recordSet))
+	}
+	// Delete the records of removed nodes, and the records of an address family without addresses.
+	for _, i := range r.records.Stale(fqdn, layoutRecordSets(existing), desired) {
+		changes = append(changes, &route53.Change{
+			Action:            aws.String(route53.ChangeActionDelete),
+			ResourceRecordSet: existing[i],
+		})
+	}
+
+	var addresses []string
+	for _, instance := range instances {
+		addresses = append(addresses, instance.ClientAddresses()...)
 	}
 
 	changeInput := &route53.ChangeResourceRecordSetsInput{
 		HostedZoneId: zone.HostedZone.Id,
-		ChangeBatch:  &route53.ChangeBatch{Changes: []*route53.Change{change}},
+		ChangeBatch:  &route53.ChangeBatch{Changes: changes},
 	}
 
-	if _, err := r.r53.ChangeResourceRecordSets(changeInput); err != nil {
+	changeOutput, err := r.r53.ChangeResourceRecordSets(changeInput)
+	if err != nil {
 		return fmt.Errorf("unable to change resource record set: %v", err)
 	}
 
-	log.Infof("Successfully set %q to %v", fqdn, resourceRecords)
+	log.Infof("Successfully set %q to %v", fqdn, addresses)
+
+	if r.waitTimeout == 0 {
+		return nil
+	}
+	if err := r.waitForChange(changeOutput.ChangeInfo.Id); err != nil {
+		return err
+	}
+	if r.verify && len(instances) > 0 {
+		return r.verifyRecord(zone.DelegationSet, fqdn, instances)
+	}
+	return nil
+}
+
+// fqdn returns the fully qualified name of the hostname in the zone.
+func (r Route53RegistrationProvider) fqdn(zoneName string) (string, error) {
+	if !strings.HasSuffix(r.hostname, ".") {
+		return r.hostname + "." + zoneName, nil
+	}
+	if !strings.HasSuffix(strings.ToLower(r.hostname), "."+strings.ToLower(zoneName)) {
+		return "", fmt.Errorf("hostname %q is not inside the hosted zone %q", r.hostname, zoneName)
+	}
+	return r.hostname, nil
+}
+
+// lookupZoneID returns the ID of the hosted zone with the zone name, filtered by whether it's private and its VPC.
+func (r Route53RegistrationProvider) lookupZoneID() (string, error) {
+	zoneName := strings.ToLower(strings.TrimSuffix(r.zoneName, ".") + ".")
+	var candidates []*route53.HostedZone
+	input := &route53.ListHostedZonesByNameInput{DNSName: aws.String(zoneName)}
+	for {
+		out, err := r.r53.ListHostedZonesByName(input)
+		if err != nil {
+			return "", fmt.Errorf("unable to list hosted zones: %v", err)
+		}
+		for _, zone := range out.HostedZones {
+			if aws.StringValue(zone.Name) != zoneName {
+				continue
+			}
+			if zone.Config != nil && aws.BoolValue(zone.Config.PrivateZone) != r.privateZone {
+				continue
+			}
+			candidates = append(candidates, zone)
+		}
+		// Zones are listed in order of name, so stop once past the zone name.
+		if !aws.BoolValue(out.IsTruncated) || aws.StringValue(out.NextDNSName) != zoneName {
+			break
+		}
+		input.DNSName = out.NextDNSName
+		input.HostedZoneId = out.NextHostedZoneId
+	}
+
+	if r.vpcID != "" {
+		var err error
+		if candidates, err = r.zonesWithVPC(candidates); err != nil {
+			return "", err
+		}
+	}
+
+	zoneType := "public"
+	if r.privateZone {
+		zoneType = "private"
+	}
+	switch len(candidates) {
+	case 0:
+		return "", fmt.Errorf("no %s hosted zone found with name %q", zoneType, zoneName)
+	case 1:
+		return aws.StringValue(candidates[0].Id), nil
+	default:
+		var ids []string
+		for _, zone := range candidates {
+			ids = append(ids, aws.StringValue(zone.Id))
+		}
+		return "", fmt.Errorf("multiple %s hosted zones found with name %q: %v", zoneType, zoneName, ids)
+	}
+}
+
+// zonesWithVPC returns the zones which are associated with the VPC.
+func (r Route53RegistrationProvider) zonesWithVPC(zones []*route53.HostedZone) ([]*route53.HostedZone, error) {
+	var matches []*route53.HostedZone
+	for _, zone := range zones {
+		out, err := r.r53.GetHostedZone(&route53.GetHostedZoneInput{Id: zone.Id})
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve hosted zone %s: %v", aws.StringValue(zone.Id), err)
+		}
+		for _, vpc := range out.VPCs {
+			if aws.StringValue(vpc.VPCId) == r.vpcID {
+				matches = append(matches, zone)
+				break
+			}
+		}
+	}
+	return matches, nil
+}
+
+// waitForChange waits until the change has propagated to all of the Route53 name servers.
+func (r Route53RegistrationProvider) waitForChange(changeID *string) error {
+	log.Infof("Waiting for route53 change %s to be in sync", aws.StringValue(changeID))
+	return waitFor(fmt.Sprintf("route53 change %s to be in sync", aws.StringValue(changeID)), r.waitTimeout,
+		func() (bool, error) {
+			out, err := r.r53.GetChange(&route53.GetChangeInput{Id: changeID})
+			if err != nil {
+				return false, fmt.Errorf("unable to get route53 change status: %v", err)
+			}
+			return aws.StringValue(out.ChangeInfo.Status) == route53.ChangeStatusInsync, nil
+		})
+}
+
+// verifyRecord waits until each of the zone's name servers resolves fqdn to the endpoints of the instances.
+func (r Route53RegistrationProvider) verifyRecord(delegationSet *route53.DelegationSet, fqdn string, instances []cloud.Instance) error {
+	if delegationSet == nil || len(delegationSet.NameServers) == 0 {
+		log.Warnf("Unable to verify %q as the hosted zone has no name servers, e.g. as it's private", fqdn)
+		return nil
+	}
+
+	var expected []string
+	for _, instance := range instances {
+		expected = append(expected, instance.ClientAddresses()...)
+	}
+	sort.Strings(expected)
 
+	for _, nameServer := range aws.StringValueSlice(delegationSet.NameServers) {
+		resolver := r.resolverFor(nameServer)
+		var addrs []string
+		err := waitFor(fmt.Sprintf("%s to resolve %q to %v", nameServer, fqdn, expected), r.waitTimeout,
+			func() (bool, error) {
+				ctx, cancelFn := context.WithTimeout(context.Background(), dnsTimeout)
+				defer cancelFn()
+				var err error
+				addrs, err = resolver.LookupHost(ctx, fqdn)
+				if err != nil {
+					log.Debugf("Unable to resolve %q with %s: %v", fqdn, nameServer, err)
+					return false, nil
+				}
+				sort.Strings(addrs)
+				return reflect.DeepEqual(addrs, expected), nil
+			})
+		if err != nil {
+			return fmt.Errorf("%v, last resolved to %v", err, addrs)
+		}
+	}
+
+	log.Infof("Verified %q resolves to %v", fqdn, expected)
 	return nil
 }
+
+// listRecordSets returns the existing records of fqdn and of the names directly under it, in the order they're listed.
+func (r Route53RegistrationProvider) listRecordSets(zoneID *string, fqdn string) ([]*route53.ResourceRecordSet, error) {
+	var recordSets []*route53.ResourceRecordSet
+	input := &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    zoneID,
+		StartRecordName: aws.String(fqdn),
+	}
+	for {
+		out, err := r.r53.ListResourceRecordSets(input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list resource record sets: %v", err)
+		}
+		for _, recordSet := range out.ResourceRecordSets {
+			name := aws.StringValue(recordSet.Name)
+			if name != fqdn && !strings.HasSuffix(name, "."+fqdn) {
+				// Records are listed in order, with subdomains following their parent domain.
+				return recordSets, nil
+			}
+			if name != fqdn && strings.Contains(strings.TrimSuffix(name, "."+fqdn), ".") {
+				continue
+			}
+			recordSets = append(recordSets, recordSet)
+		}
+		if !aws.BoolValue(out.IsTruncated) {
+			return recordSets, nil
+		}
+		input.StartRecordName = out.NextRecordName
+		input.StartRecordType = out.NextRecordType
+		input.StartRecordIdentifier = out.NextRecordIdentifier
+	}
+}
+
+// layoutRecordSets returns the record sets as the record sets of the DNS record layout.
+func layoutRecordSets(recordSets []*route53.ResourceRecordSet) []dnsrecords.RecordSet {
+	var layoutRecordSets []dnsrecords.RecordSet
+	for _, recordSet := range recordSets {
+		layoutRecordSet := dnsrecords.RecordSet{
+			Name: aws.StringValue(recordSet.Name),
+			Type: aws.StringValue(recordSet.Type),
+		}
+		for _, record := range recordSet.ResourceRecords {
+			layoutRecordSet.Values = append(layoutRecordSet.Values, aws.StringValue(record.Value))
+		}
+		layoutRecordSets = append(layoutRecordSets, layoutRecordSet)
+	}
+	return layoutRecordSets
+}
+
+func upsert(recordSet dnsrecords.RecordSet) *route53.Change {
+	var resourceRecords []*route53.ResourceRecord
+	for _, value := range recordSet.Values {
+		resourceRecords = append(resourceRecords, &route53.ResourceRecord{Value: aws.String(value)})
+	}
+	return &route53.Change{
+		Action: aws.String(route53.ChangeActionUpsert),
+		ResourceRecordSet: &route53.ResourceRecordSet{
+			Name:            aws.String(recordSet.Name),
+			Type:            aws.String(recordSet.Type),
+			TTL:             aws.Int64(dnsrecords.TTL),
+			ResourceRecords: resourceRecords,
+		},
+	}
+}
@@ -1,13 +1,16 @@
 package aws
 
 import (
+	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/route53"
 	"github.com/sky-uk/etcd-bootstrap/cloud"
 	"github.com/sky-uk/etcd-bootstrap/mock"
+	"github.com/sky-uk/etcd-bootstrap/registration/dnsrecords"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -69,6 +72,13 @@ var _ = Describe("Route53 Registration Provider", func() {
 					HostedZoneId: aws.String(hostedZoneID),
 				},
 			},
+			MockListResourceRecordSets: mock.ListResourceRecordSets{
+				ExpectedInput: &route53.ListResourceRecordSetsInput{
+					HostedZoneId:    aws.String(hostedZoneID),
+					StartRecordName: aws.String(fmt.Sprintf("%v.%v", hostname, hostedZoneName)),
+				},
+				ListResourceRecordSetsOutput: &route53.ListResourceRecordSetsOutput{},
+			},
 		}
 		registrationProvider = Route53RegistrationProvider{
 			zoneID:   hostedZoneID,
@@ -96,6 +106,36 @@ var _ = Describe("Route53 Registration Provider", func() {
 			Expect(registrationProvider.Update([]cloud.Instance{})).To(BeNil())
 		})
 
+		It("deletes the round robin AAAA record once there are no IPv6 addresses", func() {
+			aaaaRecord := &route53.ResourceRecordSet{
+				Name:            aws.String(fmt.Sprintf("%v.%v", hostname, hostedZoneName)),
+				Type:            aws.String(route53.RRTypeAaaa),
+				TTL:             aws.Int64(300),
+				ResourceRecords: []*route53.ResourceRecord{{Value: aws.String("fd00::1")}},
+			}
+			r53Client.MockListResourceRecordSets.ListResourceRecordSetsOutput.ResourceRecordSets = []*route53.ResourceRecordSet{
+				aaaaRecord,
+				{Name: aws.String("other." + hostedZoneName), Type: aws.String(route53.RRTypeAaaa)},
+			}
+			r53Client.MockChangeResourceRecordSets.ExpectedInput.ChangeBatch.Changes = append(
+				r53Client.MockChangeResourceRecordSets.ExpectedInput.ChangeBatch.Changes,
+				&route53.Change{Action: aws.String(route53.ChangeActionDelete), ResourceRecordSet: aaaaRecord},
+			)
+			registrationProvider.r53 = r53Client
+			Expect(registrationProvider.Update(testInstances)).To(BeNil())
+		})
+
+		It("fails when an endpoint isn't an IP address", func() {
+			instances := []cloud.Instance{{Name: "etcd-1", Endpoint: "etcd-1.example.com"}}
+			Expect(registrationProvider.Update(instances)).ToNot(BeNil())
+		})
+
+		It("fails when ListResourceRecordSets returns an error", func() {
+			r53Client.MockListResourceRecordSets.Err = fmt.Errorf("failed to list resource record sets")
+			registrationProvider.r53 = r53Client
+			Expect(registrationProvider.Update(testInstances)).ToNot(BeNil())
+		})
+
 		It("fails when GetHostedZone returns an error", func() {
 			r53Client.MockGetHostedZone.Err = fmt.Errorf("failed to get hosted zones")
 			registrationProvider.r53 = r53Client
@@ -108,4 +148,272 @@ var _ = Describe("Route53 Registration Provider", func() {
 			Expect(registrationProvider.Update(testInstances))
 		})
 	})
+	Context("Update() with node records", func() {
+		var fqdn string
+
+		nodeRecord := func(action, name, recordType, value string) *route53.Change {
+			return &route53.Change{
+				Action: aws.String(action),
+				ResourceRecordSet: &route53.ResourceRecordSet{
+					Name:            aws.String(name),
+					Type:            aws.String(recordType),
+					TTL:             aws.Int64(300),
+					ResourceRecords: []*route53.ResourceRecord{{Value: aws.String(value)}},
+				},
+			}
+		}
+
+		BeforeEach(func() {
+			fqdn = fmt.Sprintf("%v.%v", hostname, hostedZoneName)
+			instances := testInstances[:2]
+
+			var roundRobin []*route53.ResourceRecord
+			for _, instance := range instances {
+				roundRobin = append(roundRobin, &route53.ResourceRecord{Value: aws.String(instance.Endpoint)})
+			}
+			r53Client.MockChangeResourceRecordSets.ExpectedInput.ChangeBatch.Changes = []*route53.Change{
+				{
+					Action: aws.String(route53.ChangeActionUpsert),
+					ResourceRecordSet: &route53.ResourceRecordSet{
+						Name:            aws.String(fqdn),
+						Type:            aws.String(route53.RRTypeA),
+						TTL:             aws.Int64(300),
+						ResourceRecords: roundRobin,
+					},
+				},
+				nodeRecord(route53.ChangeActionUpsert, "test-instance-id-1."+fqdn, route53.RRTypeA, "192.168.0.1"),
+				nodeRecord(route53.ChangeActionUpsert, "test-instance-id-1."+fqdn, route53.RRTypeTxt,
+					`"name=test-instance-id-1"`),
+				nodeRecord(route53.ChangeActionUpsert, "test-instance-id-2."+fqdn, route53.RRTypeA, "192.168.0.2"),
+				nodeRecord(route53.ChangeActionUpsert, "test-instance-id-2."+fqdn, route53.RRTypeTxt,
+					`"name=test-instance-id-2"`),
+				{
+					Action: aws.String(route53.ChangeActionUpsert),
+					ResourceRecordSet: &route53.ResourceRecordSet{
+						Name: aws.String("_etcd-bootstrap._tcp." + fqdn),
+						Type: aws.String(route53.RRTypeSrv),
+						TTL:  aws.Int64(300),
+						ResourceRecords: []*route53.ResourceRecord{
+							{Value: aws.String("0 0 2379 test-instance-id-1." + fqdn)},
+							{Value: aws.String("0 0 2379 test-instance-id-2." + fqdn)},
+						},
+					},
+				},
+			}
+			r53Client.MockListResourceRecordSets = mock.ListResourceRecordSets{
+				ExpectedInput: &route53.ListResourceRecordSetsInput{
+					HostedZoneId:    aws.String(hostedZoneID),
+					StartRecordName: aws.String(fqdn),
+				},
+				ListResourceRecordSetsOutput: &route53.ListResourceRecordSetsOutput{
+					ResourceRecordSets: []*route53.ResourceRecordSet{
+						nodeRecord(route53.ChangeActionUpsert, fqdn, route53.RRTypeA, "192.168.0.1").ResourceRecordSet,
+						nodeRecord(route53.ChangeActionUpsert, "test-instance-id-1."+fqdn, route53.RRTypeA,
+							"192.168.0.1").ResourceRecordSet,
+						nodeRecord(route53.ChangeActionUpsert, "test-instance-id-1."+fqdn, route53.RRTypeTxt,
+							`"name=test-instance-id-1"`).ResourceRecordSet,
+						nodeRecord(route53.ChangeActionUpsert, "unrelated."+fqdn, route53.RRTypeCname,
+							"example.com").ResourceRecordSet,
+						nodeRecord(route53.ChangeActionUpsert, "removed-instance."+fqdn, route53.RRTypeA,
+							"192.168.0.9").ResourceRecordSet,
+						nodeRecord(route53.ChangeActionUpsert, "removed-instance."+fqdn, route53.RRTypeTxt,
+							`"name=removed-instance"`).ResourceRecordSet,
+						nodeRecord(route53.ChangeActionUpsert, "other."+hostedZoneName, route53.RRTypeA,
+							"192.168.1.1").ResourceRecordSet,
+					},
+				},
+			}
+			registrationProvider.records = dnsrecords.Layout{NodeRecords: true, SRVService: "etcd-bootstrap"}
+			registrationProvider.r53 = r53Client
+		})
+
+		It("publishes per node and SRV records in a single change", func() {
+			r53Client.MockListResourceRecordSets.ListResourceRecordSetsOutput.ResourceRecordSets =
+				r53Client.MockListResourceRecordSets.ListResourceRecordSetsOutput.ResourceRecordSets[:4]
+			registrationProvider.r53 = r53Client
+			Expect(registrationProvider.Update(testInstances[:2])).To(BeNil())
+		})
+
+		It("deletes the records of removed nodes", func() {
+			r53Client.MockChangeResourceRecordSets.ExpectedInput.ChangeBatch.Changes = append(
+				r53Client.MockChangeResourceRecordSets.ExpectedInput.ChangeBatch.Changes,
+				nodeRecord(route53.ChangeActionDelete, "removed-instance."+fqdn, route53.RRTypeA, "192.168.0.9"),
+				nodeRecord(route53.ChangeActionDelete, "removed-instance."+fqdn, route53.RRTypeTxt,
+					`"name=removed-instance"`),
+			)
+			registrationProvider.r53 = r53Client
+			Expect(registrationProvider.Update(testInstances[:2])).To(BeNil())
+		})
+
+		It("publishes AAAA records for IPv6 endpoints, and deletes the A records of IPv6 only nodes", func() {
+			instances := []cloud.Instance{
+				{Name: "test-instance-id-1", Endpoint: "fd00::1"},
+				{Name: "test-instance-id-2", Endpoint: "192.168.0.2", AdditionalEndpoints: []string{"fd00::2"}},
+			}
+			aaaaRecord := func(name string, values ...string) *route53.Change {
+				change := nodeRecord(route53.ChangeActionUpsert, name, route53.RRTypeAaaa, values[0])
+				for _, value := range values[1:] {
+					change.ResourceRecordSet.ResourceRecords = append(change.ResourceRecordSet.ResourceRecords,
+						&route53.ResourceRecord{Value: aws.String(value)})
+				}
+				return change
+			}
+			changes := r53Client.MockChangeResourceRecordSets.ExpectedInput.ChangeBatch.Changes
+			r53Client.MockChangeResourceRecordSets.ExpectedInput.ChangeBatch.Changes = []*route53.Change{
+				nodeRecord(route53.ChangeActionUpsert, fqdn, route53.RRTypeA, "192.168.0.2"),
+				aaaaRecord(fqdn, "fd00::1", "fd00::2"),
+				aaaaRecord("test-instance-id-1."+fqdn, "fd00::1"),
+				changes[2],
+				changes[3],
+				aaaaRecord("test-instance-id-2."+fqdn, "fd00::2"),
+				changes[4],
+				changes[5],
+				nodeRecord(route53.ChangeActionDelete, "test-instance-id-1."+fqdn, route53.RRTypeA, "192.168.0.1"),
+			}
+			r53Client.MockListResourceRecordSets.ListResourceRecordSetsOutput.ResourceRecordSets =
+				r53Client.MockListResourceRecordSets.ListResourceRecordSetsOutput.ResourceRecordSets[:4]
+			registrationProvider.r53 = r53Client
+			Expect(registrationProvider.Update(instances)).To(BeNil())
+		})
+
+		It("fails when ListResourceRecordSets returns an error", func() {
+			r53Client.MockListResourceRecordSets.Err = fmt.Errorf("failed to list resource record sets")
+			registrationProvider.r53 = r53Client
+			Expect(registrationProvider.Update(testInstances[:2])).ToNot(BeNil())
+		})
+	})
+	Context("Update() waiting for the change", func() {
+		var resolvedAddrs map[string][]string
+
+		BeforeEach(func() {
+			pollInterval = time.Millisecond
+			resolvedAddrs = map[string][]string{
+				"ns-1.example.com": {"192.168.0.3", "192.168.0.1", "192.168.0.2"},
+				"ns-2.example.com": {"192.168.0.1", "192.168.0.2", "192.168.0.3"},
+			}
+			r53Client.MockGetHostedZone.GetHostedZoneOutput.DelegationSet = &route53.DelegationSet{
+				NameServers: aws.StringSlice([]string{"ns-1.example.com", "ns-2.example.com"}),
+			}
+			r53Client.MockChangeResourceRecordSets.ChangeResourceRecordSetsOutput = &route53.ChangeResourceRecordSetsOutput{
+				ChangeInfo: &route53.ChangeInfo{Id: aws.String("test-change-id")},
+			}
+			r53Client.MockGetChange = mock.GetChange{
+				ExpectedInput: &route53.GetChangeInput{Id: aws.String("test-change-id")},
+				GetChangeOutput: &route53.GetChangeOutput{
+					ChangeInfo: &route53.ChangeInfo{Status: aws.String(route53.ChangeStatusInsync)},
+				},
+			}
+			registrationProvider.r53 = r53Client
+			registrationProvider.waitTimeout = 50 * time.Millisecond
+			registrationProvider.resolverFor = func(nameServer string) hostResolver {
+				return testHostResolver{nameServer: nameServer, addrs: resolvedAddrs}
+			}
+		})
+
+		It("returns once the change is in sync", func() {
+			Expect(registrationProvider.Update(testInstances)).To(BeNil())
+		})
+
+		It("times out when the change is never in sync", func() {
+			r53Client.MockGetChange.GetChangeOutput.ChangeInfo.Status = aws.String(route53.ChangeStatusPending)
+			registrationProvider.r53 = r53Client
+			Expect(registrationProvider.Update(testInstances)).ToNot(BeNil())
+		})
+
+		It("fails when GetChange returns an error", func() {
+			r53Client.MockGetChange.Err = fmt.Errorf("failed to get change")
+			registrationProvider.r53 = r53Client
+			Expect(registrationProvider.Update(testInstances)).ToNot(BeNil())
+		})
+
+		It("verifies each name server resolves the expected endpoints", func() {
+			registrationProvider.verify = true
+			Expect(registrationProvider.Update(testInstances)).To(BeNil())
+		})
+
+		It("fails verification when a name server resolves stale endpoints", func() {
+			registrationProvider.verify = true
+			resolvedAddrs["ns-2.example.com"] = []string{"192.168.0.1"}
+			Expect(registrationProvider.Update(testInstances)).ToNot(BeNil())
+		})
+	})
+
+	Context("Update() with a zone name", func() {
+		zone := func(id string, private bool) *route53.HostedZone {
+			return &route53.HostedZone{
+				Id:     aws.String(id),
+				Name:   aws.String(hostedZoneName),
+				Config: &route53.HostedZoneConfig{PrivateZone: aws.Bool(private)},
+			}
+		}
+
+		BeforeEach(func() {
+			r53Client.MockListHostedZonesByName = mock.ListHostedZonesByName{
+				ExpectedInput: &route53.ListHostedZonesByNameInput{DNSName: aws.String(hostedZoneName)},
+				ListHostedZonesByNameOutput: &route53.ListHostedZonesByNameOutput{
+					HostedZones: []*route53.HostedZone{
+						zone(hostedZoneID, false),
+						zone("private-zone-id", true),
+						{Id: aws.String("other-zone-id"), Name: aws.String("other." + hostedZoneName)},
+					},
+				},
+			}
+			registrationProvider.zoneID = ""
+			registrationProvider.zoneName = "test.hosted.zone"
+			registrationProvider.r53 = r53Client
+		})
+
+		It("uses the public zone with the name", func() {
+			Expect(registrationProvider.Update(testInstances)).To(BeNil())
+		})
+
+		It("uses the private zone associated with the VPC", func() {
+			r53Client.MockListHostedZonesByName.ListHostedZonesByNameOutput.HostedZones = []*route53.HostedZone{
+				zone("public-zone-id", false),
+				zone(hostedZoneID, true),
+			}
+			r53Client.MockGetHostedZone.GetHostedZoneOutput.VPCs = []*route53.VPC{{VPCId: aws.String("vpc-1")}}
+			registrationProvider.r53 = r53Client
+			registrationProvider.privateZone = true
+			registrationProvider.vpcID = "vpc-1"
+			Expect(registrationProvider.Update(testInstances)).To(BeNil())
+		})
+
+		It("fails when no zone has the name", func() {
+			registrationProvider.zoneName = "missing.zone"
+			r53Client.MockListHostedZonesByName.ExpectedInput.DNSName = aws.String("missing.zone.")
+			registrationProvider.r53 = r53Client
+			Expect(registrationProvider.Update(testInstances)).ToNot(BeNil())
+		})
+
+		It("fails when the zone name is ambiguous", func() {
+			r53Client.MockListHostedZonesByName.ListHostedZonesByNameOutput.HostedZones = []*route53.HostedZone{
+				zone(hostedZoneID, true),
+				zone("private-zone-id", true),
+			}
+			registrationProvider.r53 = r53Client
+			registrationProvider.privateZone = true
+			Expect(registrationProvider.Update(testInstances)).ToNot(BeNil())
+		})
+
+		It("uses a fully qualified hostname as is", func() {
+			registrationProvider.hostname = fmt.Sprintf("%v.%v", hostname, hostedZoneName)
+			Expect(registrationProvider.Update(testInstances)).To(BeNil())
+		})
+
+		It("fails when a fully qualified hostname is outside the zone", func() {
+			registrationProvider.hostname = "etcd.example.com."
+			Expect(registrationProvider.Update(testInstances)).ToNot(BeNil())
+		})
+	})
 })
+
+type testHostResolver struct {
+	nameServer string
+	addrs      map[string][]string
+}
+
+func (r testHostResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	Expect(host).To(Equal(fmt.Sprintf("%v.%v", hostname, hostedZoneName)))
+	return r.addrs[r.nameServer], nil
+}
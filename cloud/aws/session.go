@@ -0,0 +1,263 @@
+package aws
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// SessionConfig contains configuration shared by all of the AWS components.
+type SessionConfig struct {
+	// Metadata configures access to the instance metadata service.
+	Metadata MetadataConfig
+	// Region for all of the AWS service clients. Defaults to the region of the local instance, or the region
+	// of the profile if set.
+	Region string
+	// Profile is the shared config profile to use for credentials and configuration.
+	Profile string
+	// Endpoints overrides the AWS service endpoints, e.g. to use local stand-ins for testing.
+	Endpoints Endpoints
+	// InstanceID, when set, identifies the local instance without using the instance metadata service.
+	// Region must also be set.
+	InstanceID string
+	// PrivateIP and AvailabilityZone of the local instance, when set along with InstanceID, are used rather
+	// than looking the instance up with the EC2 API.
+	PrivateIP        string
+	AvailabilityZone string
+	// DiscoveryRole is assumed by the EC2 and Auto Scaling clients used to look up the cluster instances.
+	DiscoveryRole AssumeRoleConfig
+	// RegistrationRole is assumed by the Route53 and ELBv2 clients used by the registration providers.
+	RegistrationRole AssumeRoleConfig
+}
+
+// AssumeRoleConfig is an IAM role to assume with STS. If ARN is empty, the default credentials are used instead.
+type AssumeRoleConfig struct {
+	ARN string
+	// ExternalID is passed to STS when the role's trust policy requires one.
+	ExternalID string
+	// SessionName identifies the role session, e.g. in CloudTrail. Defaults to a generated name.
+	SessionName string
+}
+
+// Endpoints are custom URLs for the AWS services. Services without an endpoint use the default AWS endpoint.
+type Endpoints struct {
+	EC2         string
+	AutoScaling string
+	Route53     string
+	ELBv2       string
+	STS         string
+}
+
+// resolver returns an endpoint resolver which uses the custom endpoints, falling back to the default endpoints.
+// The SDK's instance metadata clients use the metadata endpoint.
+func (e Endpoints) resolver(metadataEndpoint string) endpoints.Resolver {
+	custom := map[string]string{
+		ec2.EndpointsID:                e.EC2,
+		autoscaling.EndpointsID:        e.AutoScaling,
+		route53.EndpointsID:            e.Route53,
+		elbv2.EndpointsID:              e.ELBv2,
+		sts.EndpointsID:                e.STS,
+		endpoints.Ec2metadataServiceID: metadataEndpoint,
+	}
+	return endpoints.ResolverFunc(func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		if url := custom[service]; url != "" {
+			return endpoints.ResolvedEndpoint{
+				URL:           url,
+				SigningRegion: region,
+			}, nil
+		}
+		return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+	})
+}
+
+// Session is shared by all of the AWS components. It provides the local instance identity, and the configuration
+// for creating AWS service clients.
+type Session struct {
+	config           SessionConfig
+	awsSession       *session.Session
+	imds             *imdsClient
+	identityDocument *ec2metadata.EC2InstanceIdentityDocument
+	roleCredentials  map[AssumeRoleConfig]*credentials.Credentials
+}
+
+// NewSession returns a new Session. Credentials from the EC2 instance role are retrieved with IMDSv2 session tokens,
+// the same as the local instance's identity.
+func NewSession(cfg *SessionConfig) (*Session, error) {
+	return newSession(cfg, newIMDSClient(cfg.Metadata))
+}
+
+func newSession(cfg *SessionConfig, imds *imdsClient) (*Session, error) {
+	if cfg.InstanceID != "" && cfg.Region == "" {
+		return nil, fmt.Errorf("region must be provided along with the instance ID to skip the instance metadata service")
+	}
+	if (cfg.PrivateIP != "" || cfg.AvailabilityZone != "") && cfg.InstanceID == "" {
+		return nil, fmt.Errorf("instance ID must be provided along with the private IP and availability zone")
+	}
+	// The session's handlers are shared with the EC2 role credentials provider of the default credential chain.
+	handlers := defaults.Handlers()
+	handlers.Build.PushBackNamed(imds.tokenHandler())
+	awsSession, err := session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{
+			EndpointResolver: cfg.Endpoints.resolver(imds.endpoint),
+		},
+		Handlers:          handlers,
+		Profile:           cfg.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new AWS session: %v", err)
+	}
+	return &Session{
+		config:          *cfg,
+		awsSession:      awsSession,
+		imds:            imds,
+		roleCredentials: make(map[AssumeRoleConfig]*credentials.Credentials),
+	}, nil
+}
+
+// IdentityDocument returns the identity of the local instance. It's retrieved from the instance metadata
+// service, unless the region and instance ID have been provided, in which case it's built from the provided
+// identity or looked up with the EC2 API.
+func (s *Session) IdentityDocument() (*ec2metadata.EC2InstanceIdentityDocument, error) {
+	if s.identityDocument == nil {
+		var identityDoc *ec2metadata.EC2InstanceIdentityDocument
+		var err error
+		switch {
+		case s.config.InstanceID != "" && s.config.PrivateIP != "":
+			identityDoc = &ec2metadata.EC2InstanceIdentityDocument{
+				InstanceID:       s.config.InstanceID,
+				Region:           s.config.Region,
+				PrivateIP:        s.config.PrivateIP,
+				AvailabilityZone: s.config.AvailabilityZone,
+			}
+		case s.config.InstanceID != "":
+			identityDoc, err = describeIdentity(s.config.Region, s.config.InstanceID, ec2.New(s.awsSession,
+				s.clientConfig(s.config.Region, s.config.DiscoveryRole)))
+		default:
+			identityDoc, err = s.imds.getIdentityDocument()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get AWS local instance data: %v", err)
+		}
+		s.identityDocument = identityDoc
+	}
+	return s.identityDocument, nil
+}
+
+// region returns the region to use for the AWS service clients.
+func (s *Session) region() (string, error) {
+	if s.config.Region != "" {
+		return s.config.Region, nil
+	}
+	if region := aws.StringValue(s.awsSession.Config.Region); region != "" {
+		return region, nil
+	}
+	identityDoc, err := s.IdentityDocument()
+	if err != nil {
+		return "", err
+	}
+	return identityDoc.Region, nil
+}
+
+// serviceConfig returns the configuration for creating a client for an AWS service, which assumes the role if set.
+func (s *Session) serviceConfig(role AssumeRoleConfig) (*aws.Config, error) {
+	region, err := s.region()
+	if err != nil {
+		return nil, err
+	}
+	return s.clientConfig(region, role), nil
+}
+
+func (s *Session) clientConfig(region string, role AssumeRoleConfig) *aws.Config {
+	config := &aws.Config{Region: aws.String(region)}
+	if role.ARN != "" {
+		config.Credentials = s.assumeRole(region, role)
+	}
+	return config
+}
+
+// assumeRole returns credentials for the role. They're shared by all clients using the role, and are refreshed
+// with STS before they expire.
+func (s *Session) assumeRole(region string, role AssumeRoleConfig) *credentials.Credentials {
+	if creds, ok := s.roleCredentials[role]; ok {
+		return creds
+	}
+	stsSession := s.awsSession.Copy(&aws.Config{Region: aws.String(region)})
+	creds := stscreds.NewCredentials(stsSession, role.ARN, func(p *stscreds.AssumeRoleProvider) {
+		if role.ExternalID != "" {
+			p.ExternalID = aws.String(role.ExternalID)
+		}
+		if role.SessionName != "" {
+			p.RoleSessionName = role.SessionName
+		}
+	})
+	s.roleCredentials[role] = creds
+	return creds
+}
+
+func (s *Session) newEC2Client() (*ec2.EC2, error) {
+	config, err := s.serviceConfig(s.config.DiscoveryRole)
+	if err != nil {
+		return nil, err
+	}
+	return ec2.New(s.awsSession, config), nil
+}
+
+func (s *Session) newASGClient() (*autoscaling.AutoScaling, error) {
+	config, err := s.serviceConfig(s.config.DiscoveryRole)
+	if err != nil {
+		return nil, err
+	}
+	return autoscaling.New(s.awsSession, config), nil
+}
+
+func (s *Session) newRoute53Client() (*route53.Route53, error) {
+	config, err := s.serviceConfig(s.config.RegistrationRole)
+	if err != nil {
+		return nil, err
+	}
+	return route53.New(s.awsSession, config), nil
+}
+
+func (s *Session) newELBClient() (*elbv2.ELBV2, error) {
+	config, err := s.serviceConfig(s.config.RegistrationRole)
+	if err != nil {
+		return nil, err
+	}
+	return elbv2.New(s.awsSession, config), nil
+}
+
+// describeIdentity builds the identity of an instance from the EC2 API.
+func describeIdentity(region, instanceID string, awsEC2Client awsEC2) (*ec2metadata.EC2InstanceIdentityDocument, error) {
+	out, err := awsEC2Client.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice([]string{instanceID}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Reservations) != 1 || len(out.Reservations[0].Instances) != 1 {
+		return nil, fmt.Errorf("expected a single instance for %s", instanceID)
+	}
+	instance := out.Reservations[0].Instances[0]
+	var availabilityZone string
+	if instance.Placement != nil {
+		availabilityZone = aws.StringValue(instance.Placement.AvailabilityZone)
+	}
+	return &ec2metadata.EC2InstanceIdentityDocument{
+		InstanceID:       instanceID,
+		Region:           region,
+		AvailabilityZone: availabilityZone,
+		PrivateIP:        aws.StringValue(instance.PrivateIpAddress),
+	}, nil
+}
@@ -0,0 +1,214 @@
+package aws
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Session", func() {
+	It("uses custom endpoints when provided", func() {
+		resolver := Endpoints{EC2: "http://localhost:4566"}.resolver(defaultMetadataEndpoint)
+
+		endpoint, err := resolver.EndpointFor(ec2.EndpointsID, "eu-west-1")
+		Expect(err).To(BeNil())
+		Expect(endpoint.URL).To(Equal("http://localhost:4566"))
+		Expect(endpoint.SigningRegion).To(Equal("eu-west-1"))
+
+		endpoint, err = resolver.EndpointFor(autoscaling.EndpointsID, "eu-west-1")
+		Expect(err).To(BeNil())
+		Expect(endpoint.URL).To(Equal("https://autoscaling.eu-west-1.amazonaws.com"))
+	})
+
+	It("uses the provided identity without calling AWS", func() {
+		session, err := NewSession(&SessionConfig{
+			Region:           "eu-west-1",
+			InstanceID:       localInstanceID,
+			PrivateIP:        localPrivateIP,
+			AvailabilityZone: "eu-west-1a",
+		})
+		Expect(err).To(BeNil())
+		Expect(session.IdentityDocument()).To(Equal(&ec2metadata.EC2InstanceIdentityDocument{
+			InstanceID:       localInstanceID,
+			Region:           "eu-west-1",
+			PrivateIP:        localPrivateIP,
+			AvailabilityZone: "eu-west-1a",
+		}))
+	})
+
+	It("requires a region with the instance ID", func() {
+		_, err := NewSession(&SessionConfig{InstanceID: localInstanceID})
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("requires an instance ID with the private IP", func() {
+		_, err := NewSession(&SessionConfig{Region: "eu-west-1", PrivateIP: localPrivateIP})
+		Expect(err).ToNot(BeNil())
+	})
+
+	Context("assuming roles", func() {
+		var (
+			server         *httptest.Server
+			assumeRequests []*http.Request
+			session        *Session
+		)
+
+		BeforeEach(func() {
+			assumeRequests = nil
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.ParseForm()).To(Succeed())
+				assumeRequests = append(assumeRequests, r)
+				fmt.Fprint(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials>
+					<AccessKeyId>role-access-key</AccessKeyId>
+					<SecretAccessKey>role-secret-key</SecretAccessKey>
+					<SessionToken>role-session-token</SessionToken>
+					<Expiration>2100-01-01T00:00:00Z</Expiration>
+				</Credentials></AssumeRoleResult></AssumeRoleResponse>`)
+			}))
+			os.Setenv("AWS_ACCESS_KEY_ID", "instance-access-key")
+			os.Setenv("AWS_SECRET_ACCESS_KEY", "instance-secret-key")
+
+			var err error
+			session, err = NewSession(&SessionConfig{
+				Region:    "eu-west-1",
+				Endpoints: Endpoints{STS: server.URL},
+				RegistrationRole: AssumeRoleConfig{
+					ARN:         "arn:aws:iam::123456789012:role/dns",
+					ExternalID:  "test-external-id",
+					SessionName: "etcd-bootstrap",
+				},
+			})
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			server.Close()
+			os.Unsetenv("AWS_ACCESS_KEY_ID")
+			os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+		})
+
+		It("uses the registration role for registration clients", func() {
+			config, err := session.serviceConfig(session.config.RegistrationRole)
+			Expect(err).To(BeNil())
+
+			creds, err := config.Credentials.Get()
+			Expect(err).To(BeNil())
+			Expect(creds.AccessKeyID).To(Equal("role-access-key"))
+			Expect(assumeRequests).To(HaveLen(1))
+			Expect(assumeRequests[0].Form.Get("RoleArn")).To(Equal("arn:aws:iam::123456789012:role/dns"))
+			Expect(assumeRequests[0].Form.Get("ExternalId")).To(Equal("test-external-id"))
+			Expect(assumeRequests[0].Form.Get("RoleSessionName")).To(Equal("etcd-bootstrap"))
+		})
+
+		It("shares role credentials between clients", func() {
+			first, err := session.serviceConfig(session.config.RegistrationRole)
+			Expect(err).To(BeNil())
+			second, err := session.serviceConfig(session.config.RegistrationRole)
+			Expect(err).To(BeNil())
+			Expect(first.Credentials).To(BeIdenticalTo(second.Credentials))
+		})
+
+		It("uses the default credentials when no role is set", func() {
+			config, err := session.serviceConfig(session.config.DiscoveryRole)
+			Expect(err).To(BeNil())
+			Expect(config.Credentials).To(BeNil())
+			Expect(assumeRequests).To(BeEmpty())
+		})
+	})
+
+	Context("using instance role credentials", func() {
+		var (
+			server         *httptest.Server
+			roleRequests   int
+			tokenSupported bool
+			tokenRequired  bool
+			imds           *imdsClient
+		)
+
+		BeforeEach(func() {
+			roleRequests = 0
+			tokenSupported = true
+			tokenRequired = true
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPut && r.URL.Path == "/latest/api/token" {
+					if !tokenSupported {
+						w.WriteHeader(http.StatusForbidden)
+						return
+					}
+					fmt.Fprint(w, testMetadataToken)
+					return
+				}
+				if tokenRequired && r.Header.Get(metadataTokenHeader) != testMetadataToken {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				switch r.URL.Path {
+				case "/latest/meta-data/iam/security-credentials/":
+					fmt.Fprint(w, "etcd")
+				case "/latest/meta-data/iam/security-credentials/etcd":
+					roleRequests++
+					fmt.Fprint(w, `{"Code": "Success", "AccessKeyId": "instance-role-access-key",
+						"SecretAccessKey": "instance-role-secret-key", "Token": "instance-role-token",
+						"Expiration": "2100-01-01T00:00:00Z"}`)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			// Leave the instance role as the only credentials in the default chain.
+			os.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/nonexistent/credentials")
+			os.Setenv("AWS_CONFIG_FILE", "/nonexistent/config")
+			imds = newIMDSClient(MetadataConfig{Timeout: 50 * time.Millisecond})
+			imds.endpoint = server.URL + "/latest"
+		})
+
+		AfterEach(func() {
+			server.Close()
+			os.Unsetenv("AWS_SHARED_CREDENTIALS_FILE")
+			os.Unsetenv("AWS_CONFIG_FILE")
+		})
+
+		It("gets the credentials using a session token", func() {
+			session, err := newSession(&SessionConfig{Region: "eu-west-1"}, imds)
+			Expect(err).To(BeNil())
+
+			creds, err := session.awsSession.Config.Credentials.Get()
+			Expect(err).To(BeNil())
+			Expect(creds.AccessKeyID).To(Equal("instance-role-access-key"))
+			Expect(creds.SecretAccessKey).To(Equal("instance-role-secret-key"))
+			Expect(creds.SessionToken).To(Equal("instance-role-token"))
+			Expect(roleRequests).To(Equal(1))
+		})
+
+		It("fails without a session token if falling back to IMDSv1 is disabled", func() {
+			tokenSupported = false
+			tokenRequired = false
+			session, err := newSession(&SessionConfig{Region: "eu-west-1"}, imds)
+			Expect(err).To(BeNil())
+
+			_, err = session.awsSession.Config.Credentials.Get()
+			Expect(err).ToNot(BeNil())
+			Expect(roleRequests).To(Equal(0))
+		})
+
+		It("falls back to IMDSv1 if enabled", func() {
+			tokenSupported = false
+			tokenRequired = false
+			imds.v1Fallback = true
+			session, err := newSession(&SessionConfig{Region: "eu-west-1"}, imds)
+			Expect(err).To(BeNil())
+
+			creds, err := session.awsSession.Config.Credentials.Get()
+			Expect(err).To(BeNil())
+			Expect(creds.AccessKeyID).To(Equal("instance-role-access-key"))
+		})
+	})
+})
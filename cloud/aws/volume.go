@@ -0,0 +1,249 @@
+package aws
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+)
+
+const (
+	defaultVolumeNameTag = "etcd-bootstrap/member-name"
+	defaultVolumeDevice  = "/dev/xvdf"
+	defaultVolumeTimeout = 5 * time.Minute
+)
+
+// DataVolumeConfig configures claiming a persistent EBS data volume. The volume records the etcd member name of
+// the instance which first used it, so a replacement instance which attaches the volume rejoins the cluster as
+// the same member with its existing data.
+type DataVolumeConfig struct {
+	// Tags identify the data volumes for this cluster. All tags must match.
+	Tags map[string]string
+	// NameTag is the tag key holding the etcd member name for a volume. Defaults to "etcd-bootstrap/member-name".
+	NameTag string
+	// Device to attach the volume as. Defaults to "/dev/xvdf".
+	Device string
+	// Timeout to wait for the volume to attach. Defaults to 5 minutes.
+	Timeout time.Duration
+}
+
+func (c *DataVolumeConfig) nameTag() string {
+	if c.NameTag == "" {
+		return defaultVolumeNameTag
+	}
+	return c.NameTag
+}
+
+func (c *DataVolumeConfig) device() string {
+	if c.Device == "" {
+		return defaultVolumeDevice
+	}
+	return c.Device
+}
+
+func (c *DataVolumeConfig) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return defaultVolumeTimeout
+	}
+	return c.Timeout
+}
+
+// deviceExists returns true if the block device is present on the local instance.
+var deviceExists = func(device string) (bool, error) {
+	_, err := os.Stat(device)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// withVolumeNames replaces the name of each instance with the member name stored on its attached data volume.
+// Instances which haven't attached a data volume yet keep their existing name.
+func (m *AWS) withVolumeNames(instanceIDs []string, instances []cloud.Instance, awsEC2Client awsEC2) ([]cloud.Instance, error) {
+	volumes, err := describeVolumes(&ec2.DescribeVolumesInput{
+		Filters: append(tagFilters(m.config.DataVolume.Tags), &ec2.Filter{
+			Name:   aws.String("attachment.status"),
+			Values: aws.StringSlice([]string{ec2.VolumeAttachmentStateAttached}),
+		}),
+	}, awsEC2Client)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string)
+	for _, volume := range volumes {
+		name := tagValue(volume.Tags, m.config.DataVolume.nameTag())
+		for _, attachment := range volume.Attachments {
+			if name != "" {
+				names[aws.StringValue(attachment.InstanceId)] = name
+			}
+		}
+	}
+
+	var namedInstances []cloud.Instance
+	for i, instance := range instances {
+		if name, ok := names[instanceIDs[i]]; ok {
+			instance.Name = name
+		}
+		namedInstances = append(namedInstances, instance)
+	}
+	return namedInstances, nil
+}
+
+// claimLocalVolume returns the data volume attached to the local instance, claiming and attaching one if needed. A
+// volume without a member name is named after the local instance, or its network interface from the pool.
+func (m *AWS) claimLocalVolume(identityDoc *ec2metadata.EC2InstanceIdentityDocument, awsEC2Client awsEC2) (*ec2.Volume, error) {
+	defaultName := identityDoc.InstanceID
+	if m.config.ENIPool != nil {
+		eni, err := m.getLocalENI(identityDoc, awsEC2Client)
+		if err != nil {
+			return nil, err
+		}
+		defaultName = m.eniInstance(eni).Name
+	}
+	return m.getLocalVolume(identityDoc, defaultName, awsEC2Client)
+}
+
+// getLocalVolume returns the data volume attached to the local instance, claiming and attaching one if needed.
+// If the volume has no member name yet, it's tagged with defaultName.
+func (m *AWS) getLocalVolume(identityDoc *ec2metadata.EC2InstanceIdentityDocument, defaultName string,
+	awsEC2Client awsEC2) (*ec2.Volume, error) {
+	if m.localVolume == nil {
+		cfg := m.config.DataVolume
+		volume, err := claimVolume(cfg, identityDoc, awsEC2Client)
+		if err != nil {
+			return nil, fmt.Errorf("unable to claim a data volume: %w", err)
+		}
+
+		if tagValue(volume.Tags, cfg.nameTag()) == "" {
+			log.Infof("Data volume %s has no member name, setting it to %s", *volume.VolumeId, defaultName)
+			nameTag := &ec2.Tag{
+				Key:   aws.String(cfg.nameTag()),
+				Value: aws.String(defaultName),
+			}
+			_, err := awsEC2Client.CreateTags(&ec2.CreateTagsInput{
+				Resources: []*string{volume.VolumeId},
+				Tags:      []*ec2.Tag{nameTag},
+			})
+			if err != nil {
+				return nil, fmt.Errorf("unable to tag data volume %s with member name: %v", *volume.VolumeId, err)
+			}
+			volume.Tags = append(volume.Tags, nameTag)
+		}
+		m.localVolume = volume
+	}
+	return m.localVolume, nil
+}
+
+func claimVolume(cfg *DataVolumeConfig, identityDoc *ec2metadata.EC2InstanceIdentityDocument, awsEC2Client awsEC2) (*ec2.Volume, error) {
+	instanceID := identityDoc.InstanceID
+
+	// A volume may already be attached if etcd-bootstrap has been run before on this instance.
+	attached, err := describeVolumes(&ec2.DescribeVolumesInput{
+		Filters: append(tagFilters(cfg.Tags), &ec2.Filter{
+			Name:   aws.String("attachment.instance-id"),
+			Values: aws.StringSlice([]string{instanceID}),
+		}),
+	}, awsEC2Client)
+	if err != nil {
+		return nil, err
+	}
+	if len(attached) > 0 {
+		log.Infof("Data volume %s is already attached", *attached[0].VolumeId)
+		return waitForVolume(cfg, *attached[0].VolumeId, instanceID, awsEC2Client)
+	}
+
+	available, err := describeVolumes(&ec2.DescribeVolumesInput{
+		Filters: append(tagFilters(cfg.Tags),
+			&ec2.Filter{
+				Name:   aws.String("availability-zone"),
+				Values: aws.StringSlice([]string{identityDoc.AvailabilityZone}),
+			},
+			&ec2.Filter{
+				Name:   aws.String("status"),
+				Values: aws.StringSlice([]string{ec2.VolumeStateAvailable}),
+			}),
+	}, awsEC2Client)
+	if err != nil {
+		return nil, err
+	}
+	// Prefer volumes which already belong to a member, so existing data is reused before starting afresh.
+	// Otherwise sort so that booting instances try the volumes in a consistent order.
+	sort.Slice(available, func(i, j int) bool {
+		iNamed := tagValue(available[i].Tags, cfg.nameTag()) != ""
+		jNamed := tagValue(available[j].Tags, cfg.nameTag()) != ""
+		if iNamed != jNamed {
+			return iNamed
+		}
+		return *available[i].VolumeId < *available[j].VolumeId
+	})
+
+	for _, volume := range available {
+		// Attaching is the claim, as a volume which is already attached to another instance is rejected.
+		volumeID := *volume.VolumeId
+		log.Infof("Attaching data volume %s as %s", volumeID, cfg.device())
+		_, err := awsEC2Client.AttachVolume(&ec2.AttachVolumeInput{
+			VolumeId:   aws.String(volumeID),
+			InstanceId: aws.String(instanceID),
+			Device:     aws.String(cfg.device()),
+		})
+		if err != nil {
+			log.Warnf("Unable to attach data volume %s, it may have been attached by another instance: %v", volumeID, err)
+			continue
+		}
+		return waitForVolume(cfg, volumeID, instanceID, awsEC2Client)
+	}
+
+	return nil, fmt.Errorf("no available data volumes with tags %v in %s", cfg.Tags, identityDoc.AvailabilityZone)
+}
+
+// waitForVolume waits for the volume to be attached to the instance and its device to appear locally.
+func waitForVolume(cfg *DataVolumeConfig, volumeID, instanceID string, awsEC2Client awsEC2) (*ec2.Volume, error) {
+	var volume *ec2.Volume
+	err := waitFor("data volume "+volumeID+" to attach", cfg.timeout(), func() (bool, error) {
+		volumes, err := describeVolumes(&ec2.DescribeVolumesInput{
+			VolumeIds: aws.StringSlice([]string{volumeID}),
+		}, awsEC2Client)
+		if err != nil {
+			return false, err
+		}
+		if len(volumes) != 1 {
+			return false, fmt.Errorf("expected a single volume for %s, but found %d", volumeID, len(volumes))
+		}
+		volume = volumes[0]
+		if len(volume.Attachments) != 1 || aws.StringValue(volume.Attachments[0].InstanceId) != instanceID {
+			return false, fmt.Errorf("data volume %s is not attached to %s", volumeID, instanceID)
+		}
+		if aws.StringValue(volume.Attachments[0].State) != ec2.VolumeAttachmentStateAttached {
+			return false, nil
+		}
+		return deviceExists(cfg.device())
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Data volume %s is attached as %s", volumeID, cfg.device())
+	return volume, nil
+}
+
+// describeVolumes returns the volumes matching req, following any pagination.
+func describeVolumes(req *ec2.DescribeVolumesInput, awsEC2Client awsEC2) ([]*ec2.Volume, error) {
+	var volumes []*ec2.Volume
+	for {
+		out, err := awsEC2Client.DescribeVolumes(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe volumes: %v", err)
+		}
+		volumes = append(volumes, out.Volumes...)
+
+		if out.NextToken == nil || *out.NextToken == "" {
+			return volumes, nil
+		}
+		req.NextToken = out.NextToken
+	}
+}
@@ -0,0 +1,147 @@
+package aws
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/mock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	testVolumeID     = "vol-0123456789"
+	testVolumeDevice = "/dev/xvdz"
+)
+
+var _ = Describe("Data volume", func() {
+	var (
+		awsEC2Client mock.AWSEC2Client
+		awsProvider  *AWS
+		volumeConfig *DataVolumeConfig
+	)
+
+	BeforeEach(func() {
+		pollInterval = time.Millisecond
+		deviceExists = func(device string) (bool, error) {
+			return device == testVolumeDevice, nil
+		}
+
+		volumeConfig = &DataVolumeConfig{
+			Tags:    map[string]string{"etcd-cluster": "prod-a"},
+			Device:  testVolumeDevice,
+			Timeout: 50 * time.Millisecond,
+		}
+		awsEC2Client = mock.AWSEC2Client{
+			MockDescribeVolumes: mock.DescribeVolumes{
+				ExpectedInput: &ec2.DescribeVolumesInput{
+					VolumeIds: aws.StringSlice([]string{testVolumeID}),
+				},
+				DescribeVolumesOutput: &ec2.DescribeVolumesOutput{
+					Volumes: []*ec2.Volume{{
+						VolumeId: aws.String(testVolumeID),
+						Attachments: []*ec2.VolumeAttachment{{
+							InstanceId: aws.String(localInstanceID),
+							State:      aws.String(ec2.VolumeAttachmentStateAttached),
+						}},
+					}},
+				},
+			},
+		}
+		awsProvider = &AWS{
+			config: Config{DataVolume: volumeConfig},
+			identityDocument: &ec2metadata.EC2InstanceIdentityDocument{
+				InstanceID: localInstanceID,
+				PrivateIP:  localPrivateIP,
+			},
+			ec2Client: awsEC2Client,
+		}
+	})
+
+	Context("waiting for attachment", func() {
+		It("returns the volume once attached and its device exists", func() {
+			volume, err := waitForVolume(volumeConfig, testVolumeID, localInstanceID, awsEC2Client)
+			Expect(err).To(BeNil())
+			Expect(*volume.VolumeId).To(Equal(testVolumeID))
+		})
+
+		It("times out when the device never appears", func() {
+			deviceExists = func(device string) (bool, error) {
+				return false, nil
+			}
+			_, err := waitForVolume(volumeConfig, testVolumeID, localInstanceID, awsEC2Client)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("fails when the volume is attached to another instance", func() {
+			awsEC2Client.MockDescribeVolumes.DescribeVolumesOutput.Volumes[0].Attachments[0].InstanceId =
+				aws.String("other-instance-id")
+			_, err := waitForVolume(volumeConfig, testVolumeID, localInstanceID, awsEC2Client)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Context("member names", func() {
+		BeforeEach(func() {
+			awsProvider.localVolume = &ec2.Volume{
+				VolumeId: aws.String(testVolumeID),
+				Tags: []*ec2.Tag{{
+					Key:   aws.String(defaultVolumeNameTag),
+					Value: aws.String("i-replaced"),
+				}},
+			}
+			awsEC2Client.MockDescribeVolumes = mock.DescribeVolumes{
+				ExpectedInput: &ec2.DescribeVolumesInput{
+					Filters: []*ec2.Filter{
+						{
+							Name:   aws.String("tag:etcd-cluster"),
+							Values: aws.StringSlice([]string{"prod-a"}),
+						},
+						{
+							Name:   aws.String("attachment.status"),
+							Values: aws.StringSlice([]string{ec2.VolumeAttachmentStateAttached}),
+						},
+					},
+				},
+				DescribeVolumesOutput: &ec2.DescribeVolumesOutput{
+					Volumes: []*ec2.Volume{
+						{
+							VolumeId:    aws.String(testVolumeID),
+							Attachments: []*ec2.VolumeAttachment{{InstanceId: aws.String(localInstanceID)}},
+							Tags:        awsProvider.localVolume.Tags,
+						},
+						{
+							VolumeId:    aws.String("vol-unnamed"),
+							Attachments: []*ec2.VolumeAttachment{{InstanceId: aws.String("i-2")}},
+						},
+					},
+				},
+			}
+			awsProvider.ec2Client = awsEC2Client
+		})
+
+		It("uses the member name stored on the local volume", func() {
+			Expect(awsProvider.GetLocalInstance()).To(Equal(cloud.Instance{
+				Name:       "i-replaced",
+				Endpoint:   localPrivateIP,
+				ProviderID: localInstanceID,
+			}))
+		})
+
+		It("uses the member name stored on each instance's volume", func() {
+			instances := []cloud.Instance{
+				{Name: localInstanceID, Endpoint: localPrivateIP},
+				{Name: "i-2", Endpoint: "192.168.0.2"},
+			}
+			Expect(awsProvider.withVolumeNames([]string{localInstanceID, "i-2"}, instances, awsEC2Client)).To(Equal(
+				[]cloud.Instance{
+					{Name: "i-replaced", Endpoint: localPrivateIP},
+					{Name: "i-2", Endpoint: "192.168.0.2"},
+				}))
+		})
+	})
+})
@@ -1,12 +1,83 @@
 package cloud
 
+import "time"
+
+// Lifecycle states of an instance, normalised across providers.
+const (
+	// StateUnknown is the state of instances whose provider doesn't report one.
+	StateUnknown = ""
+	// StatePending instances are starting, e.g. an EC2 instance which is pending or an ASG instance in a launch
+	// lifecycle hook.
+	StatePending = "pending"
+	// StateRunning instances are running and in service.
+	StateRunning = "running"
+	// StateStandby instances are running, but temporarily out of service, e.g. an ASG instance in Standby.
+	StateStandby = "standby"
+	// StateStopped instances are stopping or stopped, and may be started again.
+	StateStopped = "stopped"
+)
+
 // Instance represents a cloud instance which is intended to be part of an etcd cluster.
 type Instance struct {
 	// Name is the unique name to identify this instance in an etcd cluster.
 	Name string
 
 	// Endpoint is the address to reach this instance from an etcd client.
-	// It is used to construct the peer and client URLs.
-	// It should be of the form `hostname` or `x.x.x.x`.
+	// It is used to construct the client URLs, and the peer URLs unless PeerEndpoint is set.
+	// It should be of the form `hostname`, `x.x.x.x` or an IPv6 address such as `fd00::1`.
 	Endpoint string
+
+	// AdditionalEndpoints are further addresses to reach this instance from an etcd client, e.g. the IPv6 address of
+	// a dual-stack instance whose Endpoint is its IPv4 address.
+	AdditionalEndpoints []string
+
+	// PeerEndpoint, when set, is the address other members use to reach this instance, e.g. on a dedicated network
+	// for replication traffic. It's used to construct the peer URLs.
+	PeerEndpoint string
+
+	// AdditionalPeerEndpoints are further addresses other members use to reach this instance when PeerEndpoint is
+	// set, e.g. the IPv6 address of a dual-stack peer network.
+	AdditionalPeerEndpoints []string
+
+	// PrivateDNSName is the provider's private DNS name for this instance, if it has one, e.g.
+	// `ip-10-0-0-1.eu-west-1.compute.internal` on AWS.
+	PrivateDNSName string
+
+	// Tags are the provider's metadata for this instance: the tags on AWS, the labels on GCP, and the `tags_` extra
+	// config on VMware, without its prefix.
+	Tags map[string]string
+
+	// Zone is the availability zone of this instance, if the provider has the concept, e.g. `eu-west-1a`.
+	Zone string
+
+	// ProviderID is the provider's unique identifier of this instance, e.g. the EC2 instance ID. It doesn't change
+	// when Name is replaced, e.g. by the name of a pooled network interface.
+	ProviderID string
+
+	// State is the lifecycle state of this instance, one of the State constants.
+	State string
+
+	// LaunchTime is when this instance was launched, or zero if unknown.
+	LaunchTime time.Time
+}
+
+// OutOfService returns true if the instance is in standby or stopped, so shouldn't receive client traffic. It's still
+// expected to return, so remains a member of the cluster.
+func (i Instance) OutOfService() bool {
+	return i.State == StateStandby || i.State == StateStopped
+}
+
+// PeerAddresses returns the addresses other members use to reach this instance, which are the PeerEndpoint followed by
+// any AdditionalPeerEndpoints if set, or the ClientAddresses otherwise. A dual-stack instance has one of each family.
+func (i Instance) PeerAddresses() []string {
+	if i.PeerEndpoint != "" {
+		return append([]string{i.PeerEndpoint}, i.AdditionalPeerEndpoints...)
+	}
+	return i.ClientAddresses()
+}
+
+// ClientAddresses returns the addresses to reach this instance from an etcd client, which is the Endpoint followed by
+// any AdditionalEndpoints.
+func (i Instance) ClientAddresses() []string {
+	return append([]string{i.Endpoint}, i.AdditionalEndpoints...)
 }
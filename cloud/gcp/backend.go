@@ -0,0 +1,315 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+// BackendType is the type of load balancer backend kept in sync by a BackendRegistrationProvider.
+type BackendType string
+
+const (
+	// InstanceGroupBackend is an unmanaged instance group.
+	InstanceGroupBackend BackendType = "instance-group"
+	// NetworkEndpointGroupBackend is a zonal network endpoint group of GCE_VM_IP_PORT endpoints.
+	NetworkEndpointGroupBackend BackendType = "neg"
+)
+
+// BackendRegistrationProviderConfig contains configuration when creating a BackendRegistrationProvider.
+type BackendRegistrationProviderConfig struct {
+	// ProjectID of the project containing the groups and the instances.
+	ProjectID string
+	// Type of the groups.
+	Type BackendType
+	// Groups to keep in sync with the etcd instances.
+	Groups []BackendGroupConfig
+	// Endpoint overrides the Compute Engine API endpoint, e.g. http://localhost:8080/compute/v1/projects/.
+	Endpoint string
+	// WithoutAuthentication disables authentication, e.g. for a local stand-in of the Compute Engine API.
+	WithoutAuthentication bool
+}
+
+// BackendGroupConfig is a zonal group to register the etcd instances with. Only the instances in the group's zone
+// are added to it, so there is usually a group per zone of the cluster.
+type BackendGroupConfig struct {
+	Zone string
+	Name string
+	// Port of the network endpoints. Defaults to the default port of the network endpoint group. It isn't used by
+	// instance groups.
+	Port int64
+}
+
+// BackendRegistrationProvider keeps the members of load balancer backend groups in sync with the etcd instances, so
+// the etcd cluster can be put behind e.g. an internal TCP load balancer.
+type BackendRegistrationProvider struct {
+	projectID   string
+	backendType BackendType
+	groups      []BackendGroupConfig
+	compute     *compute.Service
+}
+
+// NewBackendRegistrationProvider returns a BackendRegistrationProvider with a new Compute Engine API client.
+func NewBackendRegistrationProvider(cfg *BackendRegistrationProviderConfig) (*BackendRegistrationProvider, error) {
+	if cfg.Type != InstanceGroupBackend && cfg.Type != NetworkEndpointGroupBackend {
+		return nil, fmt.Errorf("unsupported backend type %q", cfg.Type)
+	}
+	if len(cfg.Groups) == 0 {
+		return nil, fmt.Errorf("at least one %s must be provided", cfg.Type)
+	}
+
+	opts := []option.ClientOption{option.WithScopes(compute.ComputeScope)}
+	if cfg.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(cfg.Endpoint))
+	}
+	if cfg.WithoutAuthentication {
+		opts = append(opts, option.WithoutAuthentication(), option.WithHTTPClient(http.DefaultClient))
+	}
+	computeService, err := compute.NewService(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create GCP compute API client: %v", err)
+	}
+
+	return &BackendRegistrationProvider{
+		projectID:   cfg.ProjectID,
+		backendType: cfg.Type,
+		groups:      cfg.Groups,
+		compute:     computeService,
+	}, nil
+}
+
+// Update adds the etcd instances which are missing from each group, and removes the members which no longer belong
+// to an etcd instance.
+func (b *BackendRegistrationProvider) Update(instances []cloud.Instance) error {
+	if len(instances) == 0 {
+		log.Warnf("No etcd instances to register with the %s backends, keeping the existing members", b.backendType)
+		return nil
+	}
+
+	var failures []string
+	for _, group := range b.groups {
+		if err := b.updateGroup(group, instances); err != nil {
+			failures = append(failures, fmt.Sprintf("%s/%s: %v", group.Zone, group.Name, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("unable to update %s backends: %s", b.backendType, strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func (b *BackendRegistrationProvider) updateGroup(group BackendGroupConfig, instances []cloud.Instance) error {
+	zoneInstances, err := b.zoneInstances(group.Zone, instances)
+	if err != nil {
+		return err
+	}
+	if b.backendType == InstanceGroupBackend {
+		return b.updateInstanceGroup(group, zoneInstances)
+	}
+	endpoints := make(map[string]string)
+	for _, instance := range instances {
+		endpoints[instance.Name] = instance.Endpoint
+	}
+	return b.updateNetworkEndpointGroup(group, zoneInstances, endpoints)
+}
+
+// zoneInstances returns the compute instances of the etcd instances in the zone, by name.
+func (b *BackendRegistrationProvider) zoneInstances(zone string, instances []cloud.Instance) (map[string]*compute.Instance, error) {
+	names := make(map[string]bool)
+	for _, instance := range instances {
+		names[instance.Name] = true
+	}
+	zoneInstances := make(map[string]*compute.Instance)
+	err := b.compute.Instances.List(b.projectID, zone).Pages(context.Background(),
+		func(page *compute.InstanceList) error {
+			for _, instance := range page.Items {
+				if names[instance.Name] {
+					zoneInstances[instance.Name] = instance
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list instances in zone %s: %v", zone, err)
+	}
+	return zoneInstances, nil
+}
+
+func (b *BackendRegistrationProvider) updateInstanceGroup(group BackendGroupConfig, instances map[string]*compute.Instance) error {
+	registered := make(map[string]bool)
+	err := b.compute.InstanceGroups.ListInstances(b.projectID, group.Zone, group.Name,
+		&compute.InstanceGroupsListInstancesRequest{}).Pages(context.Background(),
+		func(page *compute.InstanceGroupsListInstances) error {
+			for _, member := range page.Items {
+				registered[member.Instance] = true
+			}
+			return nil
+		})
+	if err != nil {
+		return fmt.Errorf("unable to list instance group members: %v", err)
+	}
+
+	desired := make(map[string]bool)
+	var missing []*compute.InstanceReference
+	for _, name := range sortedNames(instances) {
+		selfLink := instances[name].SelfLink
+		desired[selfLink] = true
+		if !registered[selfLink] {
+			missing = append(missing, &compute.InstanceReference{Instance: selfLink})
+		}
+	}
+	var stale []*compute.InstanceReference
+	for _, selfLink := range sortedSet(registered) {
+		if !desired[selfLink] {
+			stale = append(stale, &compute.InstanceReference{Instance: selfLink})
+		}
+	}
+	if len(desired) == 0 && len(stale) > 0 {
+		log.Warnf("Not removing %v from instance group %s as none of the etcd instances are in zone %s",
+			instanceReferenceNames(stale), group.Name, group.Zone)
+		stale = nil
+	}
+
+	if len(missing) > 0 {
+		if _, err := b.compute.InstanceGroups.AddInstances(b.projectID, group.Zone, group.Name,
+			&compute.InstanceGroupsAddInstancesRequest{Instances: missing}).Do(); err != nil {
+			return fmt.Errorf("unable to add etcd instances to instance group: %v", err)
+		}
+		log.Infof("Added %v to instance group %s", instanceReferenceNames(missing), group.Name)
+	}
+	if len(stale) > 0 {
+		if _, err := b.compute.InstanceGroups.RemoveInstances(b.projectID, group.Zone, group.Name,
+			&compute.InstanceGroupsRemoveInstancesRequest{Instances: stale}).Do(); err != nil {
+			return fmt.Errorf("unable to remove stale instances from instance group: %v", err)
+		}
+		log.Infof("Removed stale instances %v from instance group %s", instanceReferenceNames(stale), group.Name)
+	}
+	return nil
+}
+
+// updateNetworkEndpointGroup attaches an endpoint for each instance in the zone, with the endpoint of its etcd instance.
+func (b *BackendRegistrationProvider) updateNetworkEndpointGroup(group BackendGroupConfig, instances map[string]*compute.Instance,
+	endpoints map[string]string) error {
+	neg, err := b.compute.NetworkEndpointGroups.Get(b.projectID, group.Zone, group.Name).Do()
+	if err != nil {
+		return fmt.Errorf("unable to get network endpoint group: %v", err)
+	}
+	// Endpoints are matched on their resolved port, as the group lists endpoints without a port with its default port.
+	defaultPort := neg.DefaultPort
+
+	registered := make(map[string]*compute.NetworkEndpoint)
+	err = b.compute.NetworkEndpointGroups.ListNetworkEndpoints(b.projectID, group.Zone, group.Name,
+		&compute.NetworkEndpointGroupsListEndpointsRequest{}).Pages(context.Background(),
+		func(page *compute.NetworkEndpointGroupsListNetworkEndpoints) error {
+			for _, item := range page.Items {
+				if item.NetworkEndpoint != nil {
+					registered[networkEndpointKey(item.NetworkEndpoint, defaultPort)] = item.NetworkEndpoint
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return fmt.Errorf("unable to list network endpoints: %v", err)
+	}
+
+	desired := make(map[string]bool)
+	var missing []*compute.NetworkEndpoint
+	for _, name := range sortedNames(instances) {
+		endpoint := &compute.NetworkEndpoint{
+			Instance:  name,
+			IpAddress: endpoints[name],
+			Port:      group.Port,
+		}
+		key := networkEndpointKey(endpoint, defaultPort)
+		desired[key] = true
+		if _, ok := registered[key]; !ok {
+			missing = append(missing, endpoint)
+		}
+	}
+	var stale []*compute.NetworkEndpoint
+	for _, key := range sortedEndpointKeys(registered) {
+		if !desired[key] {
+			stale = append(stale, registered[key])
+		}
+	}
+	if len(desired) == 0 && len(stale) > 0 {
+		log.Warnf("Not detaching %v from network endpoint group %s as none of the etcd instances are in zone %s",
+			networkEndpointKeys(stale, defaultPort), group.Name, group.Zone)
+		stale = nil
+	}
+
+	if len(missing) > 0 {
+		if _, err := b.compute.NetworkEndpointGroups.AttachNetworkEndpoints(b.projectID, group.Zone, group.Name,
+			&compute.NetworkEndpointGroupsAttachEndpointsRequest{NetworkEndpoints: missing}).Do(); err != nil {
+			return fmt.Errorf("unable to attach etcd instances to network endpoint group: %v", err)
+		}
+		log.Infof("Attached %v to network endpoint group %s", networkEndpointKeys(missing, defaultPort), group.Name)
+	}
+	if len(stale) > 0 {
+		if _, err := b.compute.NetworkEndpointGroups.DetachNetworkEndpoints(b.projectID, group.Zone, group.Name,
+			&compute.NetworkEndpointGroupsDetachEndpointsRequest{NetworkEndpoints: stale}).Do(); err != nil {
+			return fmt.Errorf("unable to detach stale endpoints from network endpoint group: %v", err)
+		}
+		log.Infof("Detached stale endpoints %v from network endpoint group %s", networkEndpointKeys(stale, defaultPort), group.Name)
+	}
+	return nil
+}
+
+// networkEndpointKey identifies an endpoint by instance, IP and port. A port of 0 is the group's default port.
+func networkEndpointKey(endpoint *compute.NetworkEndpoint, defaultPort int64) string {
+	port := endpoint.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	return fmt.Sprintf("%s/%s:%d", endpoint.Instance, endpoint.IpAddress, port)
+}
+
+func networkEndpointKeys(endpoints []*compute.NetworkEndpoint, defaultPort int64) []string {
+	var keys []string
+	for _, endpoint := range endpoints {
+		keys = append(keys, networkEndpointKey(endpoint, defaultPort))
+	}
+	return keys
+}
+
+func instanceReferenceNames(references []*compute.InstanceReference) []string {
+	var names []string
+	for _, reference := range references {
+		names = append(names, resourceName(reference.Instance))
+	}
+	return names
+}
+
+func sortedNames(instances map[string]*compute.Instance) []string {
+	var names []string
+	for name := range instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedEndpointKeys(endpoints map[string]*compute.NetworkEndpoint) []string {
+	var keys []string
+	for key := range endpoints {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedSet(set map[string]bool) []string {
+	var values []string
+	for value := range set {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values
+}
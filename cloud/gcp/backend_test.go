@@ -0,0 +1,213 @@
+package gcp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"google.golang.org/api/compute/v1"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	testZone      = "europe-west1-b"
+	testGroup     = "etcd"
+	testZonePath  = "/projects/" + testProjectID + "/zones/" + testZone
+	testSelfLink1 = "https://www.googleapis.com/compute/v1" + testZonePath + "/instances/etcd-1"
+	testSelfLink2 = "https://www.googleapis.com/compute/v1" + testZonePath + "/instances/etcd-2"
+	testSelfLink9 = "https://www.googleapis.com/compute/v1" + testZonePath + "/instances/removed"
+)
+
+// fakeCompute is a minimal stand-in for the Compute Engine API, recording the requests which change a group.
+type fakeCompute struct {
+	instances      []*compute.Instance
+	groupInstances []*compute.InstanceWithNamedPorts
+	endpoints      []*compute.NetworkEndpointWithHealthStatus
+	defaultPort    int64
+	requests       map[string]interface{}
+}
+
+func (f *fakeCompute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, testZonePath+"/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, testZonePath+"/")
+	switch path {
+	case "instances":
+		json.NewEncoder(w).Encode(&compute.InstanceList{Items: f.instances})
+	case "instanceGroups/" + testGroup + "/listInstances":
+		json.NewEncoder(w).Encode(&compute.InstanceGroupsListInstances{Items: f.groupInstances})
+	case "networkEndpointGroups/" + testGroup:
+		json.NewEncoder(w).Encode(&compute.NetworkEndpointGroup{Name: testGroup, DefaultPort: f.defaultPort})
+	case "networkEndpointGroups/" + testGroup + "/listNetworkEndpoints":
+		json.NewEncoder(w).Encode(&compute.NetworkEndpointGroupsListNetworkEndpoints{Items: f.endpoints})
+	case "instanceGroups/" + testGroup + "/addInstances", "instanceGroups/" + testGroup + "/removeInstances":
+		var request compute.InstanceGroupsAddInstancesRequest
+		Expect(json.NewDecoder(r.Body).Decode(&request)).To(Succeed())
+		f.requests[path] = request.Instances
+		json.NewEncoder(w).Encode(&compute.Operation{})
+	case "networkEndpointGroups/" + testGroup + "/attachNetworkEndpoints",
+		"networkEndpointGroups/" + testGroup + "/detachNetworkEndpoints":
+		var request compute.NetworkEndpointGroupsAttachEndpointsRequest
+		Expect(json.NewDecoder(r.Body).Decode(&request)).To(Succeed())
+		f.requests[path] = request.NetworkEndpoints
+		json.NewEncoder(w).Encode(&compute.Operation{})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+var _ = Describe("Backend Registration Provider", func() {
+	var (
+		fake      *fakeCompute
+		server    *httptest.Server
+		instances []cloud.Instance
+	)
+
+	newProvider := func(backendType BackendType, port int64) *BackendRegistrationProvider {
+		provider, err := NewBackendRegistrationProvider(&BackendRegistrationProviderConfig{
+			ProjectID:             testProjectID,
+			Type:                  backendType,
+			Groups:                []BackendGroupConfig{{Zone: testZone, Name: testGroup, Port: port}},
+			Endpoint:              server.URL + "/projects/",
+			WithoutAuthentication: true,
+		})
+		Expect(err).To(BeNil())
+		return provider
+	}
+
+	BeforeEach(func() {
+		fake = &fakeCompute{
+			instances: []*compute.Instance{
+				computeInstance("etcd-1", "192.168.0.1", testSelfLink1),
+				computeInstance("etcd-2", "192.168.0.2", testSelfLink2),
+				computeInstance("unrelated", "192.168.0.3", testZonePath+"/instances/unrelated"),
+			},
+			defaultPort: 2379,
+			requests:    make(map[string]interface{}),
+		}
+		server = httptest.NewServer(fake)
+
+		instances = []cloud.Instance{
+			{Name: "etcd-1", Endpoint: "192.168.0.1"},
+			{Name: "etcd-2", Endpoint: "192.168.0.2"},
+			{Name: "elsewhere", Endpoint: "192.168.1.1"},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("requires a supported type and at least one group", func() {
+		_, err := NewBackendRegistrationProvider(&BackendRegistrationProviderConfig{
+			Type:   "unknown",
+			Groups: []BackendGroupConfig{{Zone: testZone, Name: testGroup}},
+		})
+		Expect(err).ToNot(BeNil())
+		_, err = NewBackendRegistrationProvider(&BackendRegistrationProviderConfig{Type: InstanceGroupBackend})
+		Expect(err).ToNot(BeNil())
+	})
+
+	Context("instance groups", func() {
+		It("adds the missing instances in the group's zone and removes stale instances", func() {
+			fake.groupInstances = []*compute.InstanceWithNamedPorts{
+				{Instance: testSelfLink1},
+				{Instance: testSelfLink9},
+			}
+			Expect(newProvider(InstanceGroupBackend, 0).Update(instances)).To(Succeed())
+			Expect(fake.requests).To(Equal(map[string]interface{}{
+				"instanceGroups/etcd/addInstances":    []*compute.InstanceReference{{Instance: testSelfLink2}},
+				"instanceGroups/etcd/removeInstances": []*compute.InstanceReference{{Instance: testSelfLink9}},
+			}))
+		})
+
+		It("makes no change when the group is up to date", func() {
+			fake.groupInstances = []*compute.InstanceWithNamedPorts{
+				{Instance: testSelfLink2},
+				{Instance: testSelfLink1},
+			}
+			Expect(newProvider(InstanceGroupBackend, 0).Update(instances)).To(Succeed())
+			Expect(fake.requests).To(BeEmpty())
+		})
+
+		It("keeps the existing members when there are no instances", func() {
+			fake.groupInstances = []*compute.InstanceWithNamedPorts{{Instance: testSelfLink1}}
+			Expect(newProvider(InstanceGroupBackend, 0).Update(nil)).To(Succeed())
+			Expect(fake.requests).To(BeEmpty())
+		})
+
+		It("keeps the existing members when none of the instances are found in the group's zone", func() {
+			fake.groupInstances = []*compute.InstanceWithNamedPorts{{Instance: testSelfLink1}}
+			Expect(newProvider(InstanceGroupBackend, 0).Update(instances[2:])).To(Succeed())
+			Expect(fake.requests).To(BeEmpty())
+		})
+	})
+
+	Context("network endpoint groups", func() {
+		It("attaches the missing endpoints and detaches stale endpoints", func() {
+			fake.endpoints = []*compute.NetworkEndpointWithHealthStatus{
+				{NetworkEndpoint: &compute.NetworkEndpoint{Instance: "etcd-1", IpAddress: "192.168.0.1", Port: 2379}},
+				{NetworkEndpoint: &compute.NetworkEndpoint{Instance: "etcd-2", IpAddress: "192.168.0.2", Port: 2380}},
+			}
+			Expect(newProvider(NetworkEndpointGroupBackend, 2379).Update(instances)).To(Succeed())
+			Expect(fake.requests).To(Equal(map[string]interface{}{
+				"networkEndpointGroups/etcd/attachNetworkEndpoints": []*compute.NetworkEndpoint{
+					{Instance: "etcd-2", IpAddress: "192.168.0.2", Port: 2379},
+				},
+				"networkEndpointGroups/etcd/detachNetworkEndpoints": []*compute.NetworkEndpoint{
+					{Instance: "etcd-2", IpAddress: "192.168.0.2", Port: 2380},
+				},
+			}))
+		})
+
+		It("uses the group's default port when no port is set", func() {
+			Expect(newProvider(NetworkEndpointGroupBackend, 0).Update(instances)).To(Succeed())
+			Expect(fake.requests).To(Equal(map[string]interface{}{
+				"networkEndpointGroups/etcd/attachNetworkEndpoints": []*compute.NetworkEndpoint{
+					{Instance: "etcd-1", IpAddress: "192.168.0.1"},
+					{Instance: "etcd-2", IpAddress: "192.168.0.2"},
+				},
+			}))
+		})
+
+		It("matches endpoints listed with the group's default port", func() {
+			fake.endpoints = []*compute.NetworkEndpointWithHealthStatus{
+				{NetworkEndpoint: &compute.NetworkEndpoint{Instance: "etcd-1", IpAddress: "192.168.0.1", Port: 2379}},
+				{NetworkEndpoint: &compute.NetworkEndpoint{Instance: "etcd-2", IpAddress: "192.168.0.2"}},
+			}
+			Expect(newProvider(NetworkEndpointGroupBackend, 0).Update(instances)).To(Succeed())
+			Expect(fake.requests).To(BeEmpty())
+
+			Expect(newProvider(NetworkEndpointGroupBackend, 2379).Update(instances)).To(Succeed())
+			Expect(fake.requests).To(BeEmpty())
+		})
+
+		It("keeps the existing endpoints when none of the instances are found in the group's zone", func() {
+			fake.endpoints = []*compute.NetworkEndpointWithHealthStatus{
+				{NetworkEndpoint: &compute.NetworkEndpoint{Instance: "etcd-1", IpAddress: "192.168.0.1"}},
+			}
+			Expect(newProvider(NetworkEndpointGroupBackend, 0).Update(instances[2:])).To(Succeed())
+			Expect(fake.requests).To(BeEmpty())
+		})
+
+		It("fails when the group can't be listed", func() {
+			provider := newProvider(NetworkEndpointGroupBackend, 0)
+			provider.groups[0].Name = "missing"
+			Expect(provider.Update(instances)).ToNot(Succeed())
+		})
+	})
+})
+
+func computeInstance(name, ip, selfLink string) *compute.Instance {
+	return &compute.Instance{
+		Name:              name,
+		SelfLink:          selfLink,
+		NetworkInterfaces: []*compute.NetworkInterface{{NetworkIP: ip}},
+	}
+}
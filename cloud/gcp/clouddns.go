@@ -0,0 +1,227 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/registration/dnsrecords"
+	"google.golang.org/api/dns/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// defaultChangeAttempts is the number of attempts to make a change, if it conflicts with another change.
+const defaultChangeAttempts = 5
+
+// conflictRetryInterval is how long to wait before retrying a change which conflicted with another change.
+var conflictRetryInterval = time.Second
+
+// CloudDNSRegistrationProviderConfig contains configuration when creating a CloudDNSRegistrationProvider.
+type CloudDNSRegistrationProviderConfig struct {
+	// ProjectID of the project containing the managed zone.
+	ProjectID string
+	// ManagedZone is the name of the Cloud DNS managed zone to update.
+	ManagedZone string
+	// Hostname is the name of the record, relative to the zone. If it ends with a '.' it's treated as fully qualified,
+	// and must be inside the zone.
+	Hostname string
+	// NodeRecords publishes an A, AAAA and TXT record for each node under the hostname, along with an SRV record
+	// listing them. This is the layout expected by the SRV instance lookup method.
+	NodeRecords bool
+	// SRVService is the service of the SRV record when NodeRecords is set.
+	SRVService string
+	// SRVPort is the port of the SRV record targets when NodeRecords is set, which should be the etcd client port.
+	// Defaults to 2379.
+	SRVPort int
+	// Endpoint overrides the Cloud DNS API endpoint, e.g. http://localhost:8080/dns/v1/projects/.
+	Endpoint string
+	// WithoutAuthentication disables authentication, e.g. for a local stand-in of the Cloud DNS API.
+	WithoutAuthentication bool
+}
+
+// CloudDNSRegistrationProvider keeps the records of the etcd instances in a Cloud DNS managed zone in sync.
+type CloudDNSRegistrationProvider struct {
+	projectID   string
+	managedZone string
+	hostname    string
+	records     dnsrecords.Layout
+	attempts    int
+	dns         *dns.Service
+}
+
+// NewCloudDNSRegistrationProvider returns a CloudDNSRegistrationProvider with a new Cloud DNS API client.
+func NewCloudDNSRegistrationProvider(cfg *CloudDNSRegistrationProviderConfig) (*CloudDNSRegistrationProvider, error) {
+	opts := []option.ClientOption{option.WithScopes(dns.NdevClouddnsReadwriteScope)}
+	if cfg.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(cfg.Endpoint))
+	}
+	if cfg.WithoutAuthentication {
+		opts = append(opts, option.WithoutAuthentication(), option.WithHTTPClient(http.DefaultClient))
+	}
+	dnsService, err := dns.NewService(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Cloud DNS API client: %v", err)
+	}
+
+	return &CloudDNSRegistrationProvider{
+		projectID:   cfg.ProjectID,
+		managedZone: cfg.ManagedZone,
+		hostname:    cfg.Hostname,
+		records: dnsrecords.Layout{
+			NodeRecords: cfg.NodeRecords,
+			SRVService:  cfg.SRVService,
+			SRVPort:     cfg.SRVPort,
+		},
+		attempts: defaultChangeAttempts,
+		dns:      dnsService,
+	}, nil
+}
+
+// Update sets the records of the hostname in the managed zone to the instances, in a single atomic change. If the
+// change conflicts with a concurrent change, it's retried against the latest records.
+func (c *CloudDNSRegistrationProvider) Update(instances []cloud.Instance) error {
+	if len(instances) == 0 {
+		log.Warnf("No etcd instances to register with Cloud DNS, keeping the existing records")
+		return nil
+	}
+
+	zone, err := c.dns.ManagedZones.Get(c.projectID, c.managedZone).Do()
+	if err != nil {
+		return fmt.Errorf("unable to retrieve managed zone %q: %v", c.managedZone, err)
+	}
+	fqdn, err := c.fqdn(zone.DnsName)
+	if err != nil {
+		return err
+	}
+	desired, err := c.records.RecordSets(fqdn, instances)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := c.applyChange(fqdn, desired)
+		if !isConflict(err) || attempt >= c.attempts {
+			return err
+		}
+		log.Infof("Cloud DNS change for %q conflicted with another change, retrying: %v", fqdn, err)
+		time.Sleep(conflictRetryInterval)
+	}
+}
+
+// applyChange makes a single change to turn the existing records into the desired records.
+func (c *CloudDNSRegistrationProvider) applyChange(fqdn string, desired []dnsrecords.RecordSet) error {
+	existing, err := c.listRecordSets(fqdn)
+	if err != nil {
+		return err
+	}
+
+	change := &dns.Change{}
+	for _, desiredRecordSet := range desired {
+		recordSet := recordSet(desiredRecordSet.Name, desiredRecordSet.Type, desiredRecordSet.Values...)
+		current, ok := existing[recordSetKey(recordSet)]
+		if ok && current.Ttl == recordSet.Ttl && reflect.DeepEqual(sorted(current.Rrdatas), sorted(recordSet.Rrdatas)) {
+			continue
+		}
+		if ok {
+			change.Deletions = append(change.Deletions, current)
+		}
+		change.Additions = append(change.Additions, recordSet)
+	}
+	// Delete the records of removed nodes, and the records of an address family without addresses.
+	keys := sortedKeys(existing)
+	var existingRecordSets []dnsrecords.RecordSet
+	for _, key := range keys {
+		existingRecordSets = append(existingRecordSets, dnsrecords.RecordSet{
+			Name:   existing[key].Name,
+			Type:   existing[key].Type,
+			Values: existing[key].Rrdatas,
+		})
+	}
+	for _, i := range c.records.Stale(fqdn, existingRecordSets, desired) {
+		change.Deletions = append(change.Deletions, existing[keys[i]])
+	}
+
+	if len(change.Additions) == 0 && len(change.Deletions) == 0 {
+		log.Infof("Cloud DNS records for %q are already up to date", fqdn)
+		return nil
+	}
+
+	if _, err := c.dns.Changes.Create(c.projectID, c.managedZone, change).Do(); err != nil {
+		return fmt.Errorf("unable to change Cloud DNS records: %w", err)
+	}
+	log.Infof("Successfully updated the Cloud DNS records of %q", fqdn)
+	return nil
+}
+
+// fqdn returns the fully qualified name of the hostname in the zone.
+func (c *CloudDNSRegistrationProvider) fqdn(zoneName string) (string, error) {
+	if !strings.HasSuffix(c.hostname, ".") {
+		return c.hostname + "." + zoneName, nil
+	}
+	if !strings.HasSuffix(strings.ToLower(c.hostname), "."+strings.ToLower(zoneName)) {
+		return "", fmt.Errorf("hostname %q is not inside the managed zone %q", c.hostname, zoneName)
+	}
+	return c.hostname, nil
+}
+
+// listRecordSets returns the record sets at or under fqdn, by name and type.
+func (c *CloudDNSRegistrationProvider) listRecordSets(fqdn string) (map[string]*dns.ResourceRecordSet, error) {
+	recordSets := make(map[string]*dns.ResourceRecordSet)
+	err := c.dns.ResourceRecordSets.List(c.projectID, c.managedZone).Pages(context.Background(),
+		func(page *dns.ResourceRecordSetsListResponse) error {
+			for _, recordSet := range page.Rrsets {
+				if recordSet.Name == fqdn || strings.HasSuffix(recordSet.Name, "."+fqdn) {
+					recordSets[recordSetKey(recordSet)] = recordSet
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list Cloud DNS records: %w", err)
+	}
+	return recordSets, nil
+}
+
+func isConflict(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Code == http.StatusConflict || apiErr.Code == http.StatusPreconditionFailed
+}
+
+func recordSet(name, recordType string, rrdatas ...string) *dns.ResourceRecordSet {
+	return &dns.ResourceRecordSet{
+		Name:    name,
+		Type:    recordType,
+		Ttl:     dnsrecords.TTL,
+		Rrdatas: rrdatas,
+	}
+}
+
+func recordSetKey(recordSet *dns.ResourceRecordSet) string {
+	return recordSet.Name + "/" + recordSet.Type
+}
+
+func sortedKeys(recordSets map[string]*dns.ResourceRecordSet) []string {
+	var keys []string
+	for key := range recordSets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sorted(values []string) []string {
+	sortedValues := append([]string(nil), values...)
+	sort.Strings(sortedValues)
+	return sortedValues
+}
@@ -0,0 +1,209 @@
+package gcp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"google.golang.org/api/dns/v1"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// TestGCP to register the test suite
+func TestGCP(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "GCP")
+}
+
+const (
+	testProjectID   = "test-project"
+	testManagedZone = "test-zone"
+	testFQDN        = "etcd.example.com."
+)
+
+// fakeCloudDNS is a minimal stand-in for the Cloud DNS API.
+type fakeCloudDNS struct {
+	rrsets    []*dns.ResourceRecordSet
+	changes   []*dns.Change
+	conflicts int
+}
+
+func (f *fakeCloudDNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	base := "/projects/" + testProjectID + "/managedZones/" + testManagedZone
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == base:
+		json.NewEncoder(w).Encode(&dns.ManagedZone{Name: testManagedZone, DnsName: "example.com."})
+	case r.Method == http.MethodGet && r.URL.Path == base+"/rrsets":
+		json.NewEncoder(w).Encode(&dns.ResourceRecordSetsListResponse{Rrsets: f.rrsets})
+	case r.Method == http.MethodPost && r.URL.Path == base+"/changes":
+		if f.conflicts > 0 {
+			f.conflicts--
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": map[string]interface{}{"code": http.StatusConflict, "message": "alreadyExists"},
+			})
+			return
+		}
+		var change dns.Change
+		Expect(json.NewDecoder(r.Body).Decode(&change)).To(Succeed())
+		f.changes = append(f.changes, &change)
+		json.NewEncoder(w).Encode(&change)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+var _ = Describe("Cloud DNS Registration Provider", func() {
+	var (
+		fake      *fakeCloudDNS
+		server    *httptest.Server
+		provider  *CloudDNSRegistrationProvider
+		instances []cloud.Instance
+	)
+
+	BeforeEach(func() {
+		conflictRetryInterval = 0
+		fake = &fakeCloudDNS{}
+		server = httptest.NewServer(fake)
+
+		var err error
+		provider, err = NewCloudDNSRegistrationProvider(&CloudDNSRegistrationProviderConfig{
+			ProjectID:             testProjectID,
+			ManagedZone:           testManagedZone,
+			Hostname:              "etcd",
+			SRVService:            "etcd-bootstrap",
+			Endpoint:              server.URL + "/projects/",
+			WithoutAuthentication: true,
+		})
+		Expect(err).To(BeNil())
+
+		instances = []cloud.Instance{
+			{Name: "etcd-1", Endpoint: "192.168.0.1"},
+			{Name: "etcd-2", Endpoint: "192.168.0.2"},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("adds the A record", func() {
+		Expect(provider.Update(instances)).To(Succeed())
+		Expect(fake.changes).To(Equal([]*dns.Change{{
+			Additions: []*dns.ResourceRecordSet{recordSet(testFQDN, "A", "192.168.0.1", "192.168.0.2")},
+		}}))
+	})
+
+	It("replaces the existing A record", func() {
+		fake.rrsets = []*dns.ResourceRecordSet{recordSet(testFQDN, "A", "192.168.0.9")}
+		Expect(provider.Update(instances)).To(Succeed())
+		Expect(fake.changes).To(Equal([]*dns.Change{{
+			Additions: []*dns.ResourceRecordSet{recordSet(testFQDN, "A", "192.168.0.1", "192.168.0.2")},
+			Deletions: []*dns.ResourceRecordSet{recordSet(testFQDN, "A", "192.168.0.9")},
+		}}))
+	})
+
+	It("publishes IPv6 addresses as an AAAA record and deletes it once there are none", func() {
+		instances[1].AdditionalEndpoints = []string{"fd00::2"}
+		Expect(provider.Update(instances)).To(Succeed())
+		Expect(fake.changes).To(Equal([]*dns.Change{{
+			Additions: []*dns.ResourceRecordSet{
+				recordSet(testFQDN, "A", "192.168.0.1", "192.168.0.2"),
+				recordSet(testFQDN, "AAAA", "fd00::2"),
+			},
+		}}))
+
+		fake.changes = nil
+		fake.rrsets = []*dns.ResourceRecordSet{
+			recordSet(testFQDN, "A", "192.168.0.1", "192.168.0.2"),
+			recordSet(testFQDN, "AAAA", "fd00::2"),
+		}
+		instances[1].AdditionalEndpoints = nil
+		Expect(provider.Update(instances)).To(Succeed())
+		Expect(fake.changes).To(Equal([]*dns.Change{{
+			Deletions: []*dns.ResourceRecordSet{recordSet(testFQDN, "AAAA", "fd00::2")},
+		}}))
+	})
+
+	It("fails when an endpoint isn't an IP address", func() {
+		instances[1].Endpoint = "etcd-2.example.com"
+		Expect(provider.Update(instances)).ToNot(Succeed())
+		Expect(fake.changes).To(BeEmpty())
+	})
+
+	It("makes no change when the records are up to date", func() {
+		fake.rrsets = []*dns.ResourceRecordSet{recordSet(testFQDN, "A", "192.168.0.2", "192.168.0.1")}
+		Expect(provider.Update(instances)).To(Succeed())
+		Expect(fake.changes).To(BeEmpty())
+	})
+
+	It("keeps the existing records when there are no instances", func() {
+		Expect(provider.Update(nil)).To(Succeed())
+		Expect(fake.changes).To(BeEmpty())
+	})
+
+	It("retries changes which conflict", func() {
+		fake.conflicts = 2
+		Expect(provider.Update(instances)).To(Succeed())
+		Expect(fake.changes).To(HaveLen(1))
+	})
+
+	It("fails when changes keep conflicting", func() {
+		fake.conflicts = defaultChangeAttempts
+		Expect(provider.Update(instances)).ToNot(Succeed())
+		Expect(fake.changes).To(BeEmpty())
+	})
+
+	It("publishes node records and deletes the records of removed nodes", func() {
+		provider.records.NodeRecords = true
+		fake.rrsets = []*dns.ResourceRecordSet{
+			recordSet(testFQDN, "A", "192.168.0.1", "192.168.0.2"),
+			recordSet("etcd-1."+testFQDN, "A", "192.168.0.1"),
+			recordSet("etcd-1."+testFQDN, "TXT", `"name=etcd-1"`),
+			recordSet("removed."+testFQDN, "A", "192.168.0.9"),
+			recordSet("removed."+testFQDN, "TXT", `"name=removed"`),
+			recordSet("unrelated."+testFQDN, "TXT", `"hello"`),
+		}
+		Expect(provider.Update(instances)).To(Succeed())
+		Expect(fake.changes).To(Equal([]*dns.Change{{
+			Additions: []*dns.ResourceRecordSet{
+				recordSet("etcd-2."+testFQDN, "A", "192.168.0.2"),
+				recordSet("etcd-2."+testFQDN, "TXT", `"name=etcd-2"`),
+				recordSet("_etcd-bootstrap._tcp."+testFQDN, "SRV",
+					"0 0 2379 etcd-1."+testFQDN, "0 0 2379 etcd-2."+testFQDN),
+			},
+			Deletions: []*dns.ResourceRecordSet{
+				recordSet("removed."+testFQDN, "A", "192.168.0.9"),
+				recordSet("removed."+testFQDN, "TXT", `"name=removed"`),
+			},
+		}}))
+	})
+
+	It("publishes the SRV record with the configured port", func() {
+		provider.records.NodeRecords = true
+		provider.records.SRVPort = 4001
+		fake.rrsets = []*dns.ResourceRecordSet{
+			recordSet(testFQDN, "A", "192.168.0.1", "192.168.0.2"),
+			recordSet("etcd-1."+testFQDN, "A", "192.168.0.1"),
+			recordSet("etcd-1."+testFQDN, "TXT", `"name=etcd-1"`),
+			recordSet("etcd-2."+testFQDN, "A", "192.168.0.2"),
+			recordSet("etcd-2."+testFQDN, "TXT", `"name=etcd-2"`),
+		}
+		Expect(provider.Update(instances)).To(Succeed())
+		Expect(fake.changes).To(Equal([]*dns.Change{{
+			Additions: []*dns.ResourceRecordSet{
+				recordSet("_etcd-bootstrap._tcp."+testFQDN, "SRV",
+					"0 0 4001 etcd-1."+testFQDN, "0 0 4001 etcd-2."+testFQDN),
+			},
+		}}))
+	})
+
+	It("fails when a fully qualified hostname is outside the zone", func() {
+		provider.hostname = "etcd.example.org."
+		Expect(provider.Update(instances)).ToNot(Succeed())
+	})
+})
@@ -3,7 +3,11 @@ package gcp
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/compute/metadata"
 	"github.com/sky-uk/etcd-bootstrap/cloud"
@@ -11,83 +15,219 @@ import (
 	"google.golang.org/api/compute/v1"
 )
 
+const (
+	// LabelsLookupMethod finds the instances in the project with the environment and role labels.
+	LabelsLookupMethod = "labels"
+	// MIGLookupMethod finds the instances in the managed instance group which created the local instance.
+	MIGLookupMethod = "mig"
+)
+
 // Config is the configuration required to talk to GCP APIs to fetch a list of nodes
 type Config struct {
 	// ProjectID is the name of the project to query
 	ProjectID string
+	// LookupMethod is how the instances are found, either LabelsLookupMethod or MIGLookupMethod. Defaults to
+	// LabelsLookupMethod.
+	LookupMethod string
 	// Environment tag to filter by
 	Environment string
 	// Role tag to filter by
 	Role string
+	// EndpointSelector selects the endpoints of instances with several network interfaces, by network or subnetwork
+	// name. Defaults to the first network interface.
+	EndpointSelector cloud.EndpointSelector
+	// CacheTTL is how long the discovered instances are reused for before discovering them again. If zero, they're
+	// discovered every time they're requested.
+	CacheTTL time.Duration
 }
 
-// Members of a GCP group.
+// Members of a GCP group. The instances are discovered when they're requested, and cached for the cache TTL.
 type Members struct {
+	cfg    Config
+	client *compute.Service
+
+	mu        sync.Mutex
 	instances []cloud.Instance
-	instance  cloud.Instance
+	fetched   time.Time
+	instance  *cloud.Instance
 }
 
 // GetInstances will return the gcp etcd instances
 func (m *Members) GetInstances() ([]cloud.Instance, error) {
-	return m.instances, nil
+	return m.GetInstancesContext(context.Background())
+}
+
+// GetInstancesContext returns the gcp etcd instances, discovering them again if the cached instances are older than
+// the cache TTL. The cache isn't locked while they're discovered, so concurrent calls may each discover them.
+func (m *Members) GetInstancesContext(ctx context.Context) ([]cloud.Instance, error) {
+	m.mu.Lock()
+	if !m.fetched.IsZero() && time.Since(m.fetched) < m.cfg.CacheTTL {
+		defer m.mu.Unlock()
+		return m.instances, nil
+	}
+	m.mu.Unlock()
+
+	var instances []cloud.Instance
+	var err error
+	switch m.cfg.LookupMethod {
+	case "", LabelsLookupMethod:
+		instances, err = findAllInstances(ctx, m.client, &m.cfg)
+	case MIGLookupMethod:
+		var createdBy string
+		createdBy, err = metadataValue(ctx, func() (string, error) {
+			return metadata.InstanceAttributeValue("created-by")
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve the managed instance group from the created-by metadata: %v", err)
+		}
+		instances, err = findMIGInstances(ctx, m.client, m.cfg.ProjectID, createdBy, m.cfg.EndpointSelector)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.instances = instances
+	m.fetched = time.Now()
+	return instances, nil
 }
 
 // GetLocalInstance will get the gcp instance etcd bootstrap is running on
 func (m *Members) GetLocalInstance() (cloud.Instance, error) {
-	return m.instance, nil
+	return m.GetLocalInstanceContext(context.Background())
+}
+
+// GetLocalInstanceContext returns the gcp instance etcd bootstrap is running on. It's retrieved from the metadata
+// server the first time it's requested.
+func (m *Members) GetLocalInstanceContext(ctx context.Context) (cloud.Instance, error) {
+	m.mu.Lock()
+	if m.instance != nil {
+		defer m.mu.Unlock()
+		return *m.instance, nil
+	}
+	m.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return cloud.Instance{}, err
+	}
+	instance, err := m.findThisInstance(ctx)
+	if err != nil {
+		return cloud.Instance{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.instance = instance
+	return *instance, nil
 }
 
 // GetLocalIP returns the same value as the GetLocalInstance() endpoint.
 func (m *Members) GetLocalIP() (string, error) {
-	localInstance, _ := m.GetLocalInstance()
+	localInstance, err := m.GetLocalInstance()
+	if err != nil {
+		return "", err
+	}
 	return localInstance.Endpoint, nil
 }
 
-// NewGCP returns the Members matching the cfg.
+// NewGCP returns the Members matching the cfg. The instances aren't discovered until they're requested.
 func NewGCP(cfg *Config) (*Members, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-
-	defer cancel()
+	if cfg.ProjectID == "" {
+		return nil, fmt.Errorf("project ID must be provided")
+	}
+	switch cfg.LookupMethod {
+	case "", LabelsLookupMethod:
+		if cfg.Environment == "" || cfg.Role == "" {
+			return nil, fmt.Errorf("environment and role must be provided to look up instances by labels")
+		}
+	case MIGLookupMethod:
+	default:
+		return nil, fmt.Errorf("unsupported instance lookup method %q", cfg.LookupMethod)
+	}
 
-	c, err := newClient(ctx, cfg)
+	c, err := newClient(context.Background(), cfg)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create GCP compute API client: %v", err)
 	}
 
-	instances, err := findAllInstances(c, cfg)
+	return &Members{
+		cfg:    *cfg,
+		client: c,
+	}, nil
+}
+
+// findThisInstance returns the local instance from the metadata server. If an endpoint selector is set, its endpoints
+// are selected from its network interfaces with the compute API.
+func (m *Members) findThisInstance(ctx context.Context) (*cloud.Instance, error) {
+	if m.cfg.EndpointSelector.IsZero() {
+		return findThisInstance(ctx)
+	}
+	zone, err := metadataValue(ctx, metadata.Zone)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("unable to retrieve local Zone metadata: %v", err)
 	}
-
-	instance, err := findThisInstance()
+	name, err := metadataValue(ctx, metadata.InstanceName)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("unable to retrieve local Name metadata: %v", err)
 	}
-
-	members := &Members{
-		instances: instances,
-		instance:  *instance,
+	instance, err := m.client.Instances.Get(m.cfg.ProjectID, zone, name).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get local instance %q in zone %s: %v", name, zone, err)
 	}
-
-	return members, nil
+	local, err := toCloudInstance(instance, m.cfg.EndpointSelector)
+	if err != nil {
+		return nil, err
+	}
+	return &local, nil
 }
 
-func findThisInstance() (*cloud.Instance, error) {
-	ip, err := metadata.InternalIP()
+func findThisInstance(ctx context.Context) (*cloud.Instance, error) {
+	ip, err := metadataValue(ctx, metadata.InternalIP)
 	if err != nil {
 		return nil, fmt.Errorf("unable to retrieve local IP metadata: %v", err)
 	}
-	name, err := metadata.InstanceName()
+	name, err := metadataValue(ctx, metadata.InstanceName)
 	if err != nil {
 		return nil, fmt.Errorf("unable to retrieve local Name metadata: %v", err)
 	}
+	zone, err := metadataValue(ctx, metadata.Zone)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve local Zone metadata: %v", err)
+	}
+	id, err := metadataValue(ctx, metadata.InstanceID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve local ID metadata: %v", err)
+	}
 	local := &cloud.Instance{
-		Name:     name,
-		Endpoint: ip,
+		Name:       name,
+		Endpoint:   ip,
+		Zone:       zone,
+		ProviderID: id,
 	}
 	return local, nil
 }
 
+// metadataValue returns the result of get, a metadata server lookup, unless ctx is done first. The metadata client
+// doesn't take a context, so the lookup is left to finish in the background.
+func metadataValue(ctx context.Context, get func() (string, error)) (string, error) {
+	type result struct {
+		value string
+		err   error
+	}
+	results := make(chan result, 1)
+	go func() {
+		value, err := get()
+		results <- result{value, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case r := <-results:
+		return r.value, r.err
+	}
+}
+
 func newClient(ctx context.Context, cfg *Config) (*compute.Service, error) {
 	client, err := google.DefaultClient(ctx, compute.ComputeScope)
 	if err != nil {
@@ -100,39 +240,219 @@ func newClient(ctx context.Context, cfg *Config) (*compute.Service, error) {
 	return computeService, err
 }
 
-func findAllInstances(client *compute.Service, cfg *Config) ([]cloud.Instance, error) {
-	zones, err := client.Zones.List(cfg.ProjectID).Do()
+// findAllInstances returns the instances in any zone of the project with the environment and role labels.
+func findAllInstances(ctx context.Context, client *compute.Service, cfg *Config) ([]cloud.Instance, error) {
+	// https://cloud.google.com/sdk/gcloud/reference/topic/filters
+	filters := []string{
+		fmt.Sprintf("labels.environment=%s", cfg.Environment),
+		fmt.Sprintf("labels.role=%s", cfg.Role),
+		"status != TERMINATED",
+	}
+	byEnvironmentAndRole := strings.Join(filters, " AND ")
+
+	var computeInstances []*compute.Instance
+	err := client.Instances.AggregatedList(cfg.ProjectID).Filter(byEnvironmentAndRole).Pages(ctx,
+		func(page *compute.InstanceAggregatedList) error {
+			for _, scope := range sortedScopes(page.Items) {
+				computeInstances = append(computeInstances, page.Items[scope].Instances...)
+			}
+			return nil
+		})
 	if err != nil {
-		return nil, fmt.Errorf("unable to list zones for project %q: %v", cfg.ProjectID, err)
+		return nil, fmt.Errorf("unable to list instances for project %q: %v", cfg.ProjectID, err)
 	}
 
 	var instances []cloud.Instance
-	for _, zone := range zones.Items {
-		// https://cloud.google.com/sdk/gcloud/reference/topic/filters
-		filters := []string{
-			fmt.Sprintf("labels.environment=%s", cfg.Environment),
-			fmt.Sprintf("labels.role=%s", cfg.Role),
-			"status != TERMINATED",
+	for _, instance := range computeInstances {
+		cloudInstance, err := toCloudInstance(instance, cfg.EndpointSelector)
+		if err != nil {
+			return nil, err
 		}
-		byEnvironmentAndRole := fmt.Sprintf(strings.Join(filters, " AND "))
-		result, err := client.Instances.List(cfg.ProjectID, zone.Name).Filter(byEnvironmentAndRole).Do()
+		instances = append(instances, cloudInstance)
+	}
+	return instances, nil
+}
+
+// findMIGInstances returns the instances of the zonal or regional managed instance group given by createdBy, the
+// created-by metadata of an instance in the group.
+func findMIGInstances(ctx context.Context, client *compute.Service, projectID, createdBy string,
+	selector cloud.EndpointSelector) ([]cloud.Instance, error) {
+	scope, location, name, err := parseCreatedBy(createdBy)
+	if err != nil {
+		return nil, err
+	}
+
+	// The managed instances are returned in a single response, as this version of the API doesn't page them.
+	var managedInstances []*compute.ManagedInstance
+	if scope == "regions" {
+		result, err := client.RegionInstanceGroupManagers.ListManagedInstances(projectID, location, name).Context(ctx).Do()
 		if err != nil {
-			return nil, fmt.Errorf("unable to list instances for project %q, zone %v: %v", cfg.ProjectID, zone, err)
+			return nil, fmt.Errorf("unable to list managed instances of %q in region %s: %v", name, location, err)
 		}
+		managedInstances = result.ManagedInstances
+	} else {
+		result, err := client.InstanceGroupManagers.ListManagedInstances(projectID, location, name).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to list managed instances of %q in zone %s: %v", name, location, err)
+		}
+		managedInstances = result.ManagedInstances
+	}
 
-		for _, instance := range result.Items {
-			// Taking the first available network interface in case there are multiple.
-			// The networkInterface.NetworkIP will only contain private IPs:
-			// https://cloud.google.com/compute/docs/reference/rest/v1/instances/list
-			if len(instance.NetworkInterfaces) > 0 {
-				instances = append(instances, cloud.Instance{
-					Name:     instance.Name,
-					Endpoint: instance.NetworkInterfaces[0].NetworkIP,
-				})
-			} else {
-				return nil, fmt.Errorf("unable to find network interfaces for instance %q", instance.Name)
-			}
+	// Instances are listed once per zone of the group, rather than fetched one at a time.
+	var zones []string
+	namesByZone := make(map[string][]string)
+	var keys []string
+	for _, managedInstance := range managedInstances {
+		// Instances which are still being created don't have a URL yet.
+		if managedInstance.Instance == "" || managedInstance.InstanceStatus == "TERMINATED" {
+			continue
+		}
+		zone, instanceName, err := parseInstanceURL(managedInstance.Instance)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := namesByZone[zone]; !ok {
+			zones = append(zones, zone)
 		}
+		namesByZone[zone] = append(namesByZone[zone], instanceName)
+		keys = append(keys, zone+"/"+instanceName)
+	}
+
+	computeInstances := make(map[string]*compute.Instance)
+	for _, zone := range zones {
+		err := client.Instances.List(projectID, zone).Filter(nameFilter(namesByZone[zone])).Pages(ctx,
+			func(page *compute.InstanceList) error {
+				for _, instance := range page.Items {
+					computeInstances[zone+"/"+instance.Name] = instance
+				}
+				return nil
+			})
+		if err != nil {
+			return nil, fmt.Errorf("unable to list managed instances of %q in zone %s: %v", name, zone, err)
+		}
+	}
+
+	var instances []cloud.Instance
+	for _, key := range keys {
+		instance, ok := computeInstances[key]
+		if !ok {
+			// The instance was deleted after the group was listed.
+			continue
+		}
+		cloudInstance, err := toCloudInstance(instance, selector)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, cloudInstance)
 	}
 	return instances, nil
 }
+
+// nameFilter returns a filter matching the instances with any of the names. Instance names only contain lowercase
+// letters, digits and hyphens, so don't need escaping in the regular expression.
+func nameFilter(names []string) string {
+	return fmt.Sprintf(`name eq "(%s)"`, strings.Join(names, "|"))
+}
+
+func toCloudInstance(instance *compute.Instance, selector cloud.EndpointSelector) (cloud.Instance, error) {
+	// Taking the first available network interface in case there are multiple, unless a selector is set.
+	// The networkInterface.NetworkIP will only contain private IPs:
+	// https://cloud.google.com/compute/docs/reference/rest/v1/instances/list
+	if len(instance.NetworkInterfaces) == 0 {
+		return cloud.Instance{}, fmt.Errorf("unable to find network interfaces for instance %q", instance.Name)
+	}
+	cloudInstance := cloud.Instance{
+		Name:           instance.Name,
+		PrivateDNSName: privateDNSName(instance),
+		Tags:           instance.Labels,
+		Zone:           resourceName(instance.Zone),
+		State:          instanceState(instance.Status),
+	}
+	if instance.Id != 0 {
+		cloudInstance.ProviderID = strconv.FormatUint(instance.Id, 10)
+	}
+	if created, err := time.Parse(time.RFC3339, instance.CreationTimestamp); err == nil {
+		cloudInstance.LaunchTime = created
+	}
+	if err := selector.Select(&cloudInstance, instance.NetworkInterfaces[0].NetworkIP, networkInterfaces(instance)); err != nil {
+		return cloud.Instance{}, fmt.Errorf("unable to select the endpoint of instance %q: %v", instance.Name, err)
+	}
+	return cloudInstance, nil
+}
+
+// instanceState returns the lifecycle state of an instance with the given status.
+func instanceState(status string) string {
+	switch status {
+	case "PROVISIONING", "STAGING":
+		return cloud.StatePending
+	case "RUNNING":
+		return cloud.StateRunning
+	case "STOPPING", "STOPPED", "SUSPENDING", "SUSPENDED":
+		return cloud.StateStopped
+	default:
+		return cloud.StateUnknown
+	}
+}
+
+// privateDNSName returns the custom hostname of the instance if it has one, or its zonal internal DNS name, e.g.
+// etcd-1.europe-west1-b.c.my-project.internal, from its self link.
+func privateDNSName(instance *compute.Instance) string {
+	if instance.Hostname != "" {
+		return instance.Hostname
+	}
+	parts := strings.Split(instance.SelfLink, "/")
+	for i := 0; i+5 < len(parts); i++ {
+		if parts[i] == "projects" && parts[i+2] == "zones" && parts[i+4] == "instances" {
+			return fmt.Sprintf("%s.%s.c.%s.internal", parts[i+5], parts[i+3], parts[i+1])
+		}
+	}
+	return ""
+}
+
+// networkInterfaces returns the network interfaces of the instance, named by their network and subnetwork.
+func networkInterfaces(instance *compute.Instance) []cloud.NetworkInterface {
+	var interfaces []cloud.NetworkInterface
+	for i, networkInterface := range instance.NetworkInterfaces {
+		interfaces = append(interfaces, cloud.NetworkInterface{
+			Index:     i,
+			Network:   resourceName(networkInterface.Network),
+			Subnet:    resourceName(networkInterface.Subnetwork),
+			Addresses: []string{networkInterface.NetworkIP},
+		})
+	}
+	return interfaces
+}
+
+// resourceName returns the name of a resource from its URL.
+func resourceName(url string) string {
+	return url[strings.LastIndex(url, "/")+1:]
+}
+
+// parseCreatedBy returns the scope ("zones" or "regions"), location and name of a managed instance group from the
+// created-by metadata, e.g. projects/123456/regions/europe-west1/instanceGroupManagers/etcd.
+func parseCreatedBy(createdBy string) (string, string, string, error) {
+	parts := strings.Split(createdBy, "/")
+	if len(parts) != 6 || parts[0] != "projects" || (parts[2] != "zones" && parts[2] != "regions") ||
+		parts[4] != "instanceGroupManagers" {
+		return "", "", "", fmt.Errorf("instance wasn't created by a managed instance group, created-by is %q", createdBy)
+	}
+	return parts[2], parts[3], parts[5], nil
+}
+
+// parseInstanceURL returns the zone and name of an instance from its URL.
+func parseInstanceURL(url string) (string, string, error) {
+	parts := strings.Split(url, "/")
+	if len(parts) < 4 || parts[len(parts)-4] != "zones" || parts[len(parts)-2] != "instances" {
+		return "", "", fmt.Errorf("unexpected instance URL %q", url)
+	}
+	return parts[len(parts)-3], parts[len(parts)-1], nil
+}
+
+func sortedScopes(items map[string]compute.InstancesScopedList) []string {
+	var scopes []string
+	for scope := range items {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
@@ -0,0 +1,335 @@
+package gcp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GCP instance lookup", func() {
+	var (
+		mux    *http.ServeMux
+		server *httptest.Server
+		client *compute.Service
+	)
+
+	BeforeEach(func() {
+		mux = http.NewServeMux()
+		server = httptest.NewServer(mux)
+
+		var err error
+		client, err = compute.NewService(context.Background(), option.WithEndpoint(server.URL+"/projects/"),
+			option.WithoutAuthentication(), option.WithHTTPClient(http.DefaultClient))
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	serveInstances := func(zone, filter string, instances ...*compute.Instance) {
+		mux.HandleFunc("/projects/"+testProjectID+"/zones/"+zone+"/instances",
+			func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.URL.Query().Get("filter")).To(Equal(filter))
+				page := &compute.InstanceList{Items: instances[:1], NextPageToken: "page-2"}
+				if r.URL.Query().Get("pageToken") == "page-2" {
+					page = &compute.InstanceList{Items: instances[1:]}
+				}
+				json.NewEncoder(w).Encode(page)
+			})
+	}
+
+	Context("by labels", func() {
+		It("lists the labelled instances in every zone with a single paginated call", func() {
+			mux.HandleFunc("/projects/"+testProjectID+"/aggregated/instances", func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.URL.Query().Get("filter")).To(Equal(
+					"labels.environment=prod AND labels.role=etcd AND status != TERMINATED"))
+				page := &compute.InstanceAggregatedList{
+					Items: map[string]compute.InstancesScopedList{
+						"zones/europe-west1-c": {Instances: []*compute.Instance{
+							computeInstance("etcd-2", "192.168.0.2", ""),
+						}},
+						"zones/europe-west1-b": {Instances: []*compute.Instance{
+							computeInstance("etcd-1", "192.168.0.1", ""),
+						}},
+						"zones/europe-west1-d": {},
+					},
+					NextPageToken: "page-2",
+				}
+				if r.URL.Query().Get("pageToken") == "page-2" {
+					page = &compute.InstanceAggregatedList{
+						Items: map[string]compute.InstancesScopedList{
+							"zones/europe-west1-d": {Instances: []*compute.Instance{
+								computeInstance("etcd-3", "192.168.0.3", ""),
+							}},
+						},
+					}
+				}
+				json.NewEncoder(w).Encode(page)
+			})
+
+			instances, err := findAllInstances(context.Background(), client,
+				&Config{ProjectID: testProjectID, Environment: "prod", Role: "etcd"})
+			Expect(err).To(BeNil())
+			Expect(instances).To(Equal([]cloud.Instance{
+				{Name: "etcd-1", Endpoint: "192.168.0.1"},
+				{Name: "etcd-2", Endpoint: "192.168.0.2"},
+				{Name: "etcd-3", Endpoint: "192.168.0.3"},
+			}))
+		})
+
+		It("selects the endpoint of instances with several network interfaces", func() {
+			mux.HandleFunc("/projects/"+testProjectID+"/aggregated/instances", func(w http.ResponseWriter, r *http.Request) {
+				instance := computeInstance("etcd-1", "10.0.0.1", "")
+				instance.NetworkInterfaces[0].Network = "https://www.googleapis.com/compute/v1/projects/test-project/global/networks/service"
+				instance.NetworkInterfaces = append(instance.NetworkInterfaces, &compute.NetworkInterface{
+					Network:    "https://www.googleapis.com/compute/v1/projects/test-project/global/networks/backend",
+					Subnetwork: "https://www.googleapis.com/compute/v1/projects/test-project/regions/europe-west1/subnetworks/backend-a",
+					NetworkIP:  "192.168.0.1",
+				})
+				json.NewEncoder(w).Encode(&compute.InstanceAggregatedList{
+					Items: map[string]compute.InstancesScopedList{
+						"zones/europe-west1-b": {Instances: []*compute.Instance{instance}},
+					},
+				})
+			})
+
+			instances, err := findAllInstances(context.Background(), client, &Config{ProjectID: testProjectID,
+				Environment: "prod", Role: "etcd", EndpointSelector: cloud.EndpointSelector{Network: cloud.NetworkSelector{Network: "backend-a"}}})
+			Expect(err).To(BeNil())
+			Expect(instances).To(Equal([]cloud.Instance{{Name: "etcd-1", Endpoint: "192.168.0.1"}}))
+
+			_, err = findAllInstances(context.Background(), client, &Config{ProjectID: testProjectID,
+				Environment: "prod", Role: "etcd", EndpointSelector: cloud.EndpointSelector{Network: cloud.NetworkSelector{Network: "missing"}}})
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("returns the labels and private DNS name of each instance", func() {
+			mux.HandleFunc("/projects/"+testProjectID+"/aggregated/instances", func(w http.ResponseWriter, r *http.Request) {
+				labelled := computeInstance("etcd-1", "192.168.0.1", testSelfLink1)
+				labelled.Labels = map[string]string{"environment": "prod", "role": "etcd"}
+				named := computeInstance("etcd-2", "192.168.0.2", "")
+				named.Hostname = "etcd-2.example.com"
+				json.NewEncoder(w).Encode(&compute.InstanceAggregatedList{
+					Items: map[string]compute.InstancesScopedList{
+						"zones/europe-west1-b": {Instances: []*compute.Instance{labelled, named}},
+					},
+				})
+			})
+
+			instances, err := findAllInstances(context.Background(), client,
+				&Config{ProjectID: testProjectID, Environment: "prod", Role: "etcd"})
+			Expect(err).To(BeNil())
+			Expect(instances).To(Equal([]cloud.Instance{
+				{Name: "etcd-1", Endpoint: "192.168.0.1", Tags: map[string]string{"environment": "prod", "role": "etcd"},
+					PrivateDNSName: "etcd-1.europe-west1-b.c." + testProjectID + ".internal"},
+				{Name: "etcd-2", Endpoint: "192.168.0.2", PrivateDNSName: "etcd-2.example.com"},
+			}))
+		})
+
+		It("returns the zone, ID, state and creation time of each instance", func() {
+			mux.HandleFunc("/projects/"+testProjectID+"/aggregated/instances", func(w http.ResponseWriter, r *http.Request) {
+				instance := computeInstance("etcd-1", "192.168.0.1", "")
+				instance.Zone = "https://www.googleapis.com/compute/v1/projects/" + testProjectID + "/zones/europe-west1-b"
+				instance.Id = 1234567890
+				instance.Status = "STOPPED"
+				instance.CreationTimestamp = "2020-01-02T03:04:05.000-08:00"
+				json.NewEncoder(w).Encode(&compute.InstanceAggregatedList{
+					Items: map[string]compute.InstancesScopedList{
+						"zones/europe-west1-b": {Instances: []*compute.Instance{instance}},
+					},
+				})
+			})
+
+			instances, err := findAllInstances(context.Background(), client,
+				&Config{ProjectID: testProjectID, Environment: "prod", Role: "etcd"})
+			Expect(err).To(BeNil())
+			Expect(instances).To(HaveLen(1))
+			Expect(instances[0].Zone).To(Equal("europe-west1-b"))
+			Expect(instances[0].ProviderID).To(Equal("1234567890"))
+			Expect(instances[0].State).To(Equal(cloud.StateStopped))
+			Expect(instances[0].LaunchTime.Equal(time.Date(2020, 1, 2, 11, 4, 5, 0, time.UTC))).To(BeTrue())
+		})
+	})
+
+	Context("by managed instance group", func() {
+		It("lists the instances of a zonal group with a single paginated call", func() {
+			mux.HandleFunc("/projects/"+testProjectID+"/zones/europe-west1-b/instanceGroupManagers/etcd/listManagedInstances",
+				func(w http.ResponseWriter, r *http.Request) {
+					json.NewEncoder(w).Encode(&compute.InstanceGroupManagersListManagedInstancesResponse{
+						ManagedInstances: []*compute.ManagedInstance{
+							{Instance: testSelfLink1, InstanceStatus: "RUNNING"},
+							{Instance: testSelfLink2, InstanceStatus: "RUNNING"},
+							{Instance: testSelfLink9, InstanceStatus: "RUNNING"},
+							{Instance: "", CurrentAction: "CREATING"},
+						},
+					})
+				})
+			// The removed instance was deleted after the group was listed, so isn't returned.
+			serveInstances(testZone, `name eq "(etcd-1|etcd-2|removed)"`,
+				computeInstance("etcd-1", "192.168.0.1", testSelfLink1),
+				computeInstance("etcd-2", "192.168.0.2", testSelfLink2))
+
+			instances, err := findMIGInstances(context.Background(), client, testProjectID,
+				"projects/123456/zones/europe-west1-b/instanceGroupManagers/etcd", cloud.EndpointSelector{})
+			Expect(err).To(BeNil())
+			Expect(instances).To(Equal([]cloud.Instance{
+				{Name: "etcd-1", Endpoint: "192.168.0.1",
+					PrivateDNSName: "etcd-1.europe-west1-b.c." + testProjectID + ".internal"},
+				{Name: "etcd-2", Endpoint: "192.168.0.2",
+					PrivateDNSName: "etcd-2.europe-west1-b.c." + testProjectID + ".internal"},
+			}))
+		})
+
+		It("lists the instances of a regional group across zones", func() {
+			otherSelfLink := "https://www.googleapis.com/compute/v1/projects/" + testProjectID +
+				"/zones/europe-west1-c/instances/etcd-2"
+			mux.HandleFunc("/projects/"+testProjectID+"/regions/europe-west1/instanceGroupManagers/etcd/listManagedInstances",
+				func(w http.ResponseWriter, r *http.Request) {
+					json.NewEncoder(w).Encode(&compute.RegionInstanceGroupManagersListInstancesResponse{
+						ManagedInstances: []*compute.ManagedInstance{
+							{Instance: testSelfLink1, InstanceStatus: "RUNNING"},
+							{Instance: otherSelfLink, InstanceStatus: "RUNNING"},
+							{Instance: testSelfLink9, InstanceStatus: "TERMINATED"},
+						},
+					})
+				})
+			serveInstances(testZone, `name eq "(etcd-1)"`, computeInstance("etcd-1", "192.168.0.1", testSelfLink1))
+			serveInstances("europe-west1-c", `name eq "(etcd-2)"`, computeInstance("etcd-2", "192.168.0.2", otherSelfLink))
+
+			instances, err := findMIGInstances(context.Background(), client, testProjectID,
+				"projects/123456/regions/europe-west1/instanceGroupManagers/etcd", cloud.EndpointSelector{})
+			Expect(err).To(BeNil())
+			Expect(instances).To(Equal([]cloud.Instance{
+				{Name: "etcd-1", Endpoint: "192.168.0.1",
+					PrivateDNSName: "etcd-1.europe-west1-b.c." + testProjectID + ".internal"},
+				{Name: "etcd-2", Endpoint: "192.168.0.2",
+					PrivateDNSName: "etcd-2.europe-west1-c.c." + testProjectID + ".internal"},
+			}))
+		})
+
+		It("fails when the instance wasn't created by a managed instance group", func() {
+			_, err := findMIGInstances(context.Background(), client, testProjectID, "", cloud.EndpointSelector{})
+			Expect(err).ToNot(BeNil())
+			_, err = findMIGInstances(context.Background(), client, testProjectID,
+				"projects/123456/zones/europe-west1-b/instances/etcd-1", cloud.EndpointSelector{})
+			Expect(err).ToNot(BeNil())
+		})
+	})
+	Context("members", func() {
+		var (
+			requests    int
+			discovering chan struct{}
+			unblock     chan struct{}
+		)
+
+		BeforeEach(func() {
+			requests = 0
+			discovering = nil
+			unblock = nil
+			mux.HandleFunc("/projects/"+testProjectID+"/aggregated/instances", func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if unblock != nil {
+					close(discovering)
+					<-unblock
+				}
+				json.NewEncoder(w).Encode(&compute.InstanceAggregatedList{
+					Items: map[string]compute.InstancesScopedList{
+						"zones/europe-west1-b": {Instances: []*compute.Instance{
+							computeInstance("etcd-1", "192.168.0.1", ""),
+						}},
+					},
+				})
+			})
+		})
+
+		newMembers := func(cacheTTL time.Duration) *Members {
+			return &Members{
+				cfg:    Config{ProjectID: testProjectID, Environment: "prod", Role: "etcd", CacheTTL: cacheTTL},
+				client: client,
+			}
+		}
+
+		It("validates the configuration without discovering the instances", func() {
+			_, err := NewGCP(&Config{ProjectID: testProjectID, LookupMethod: "unknown"})
+			Expect(err).ToNot(BeNil())
+			_, err = NewGCP(&Config{ProjectID: testProjectID})
+			Expect(err).ToNot(BeNil())
+			_, err = NewGCP(&Config{LookupMethod: MIGLookupMethod})
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("discovers the instances when they're requested", func() {
+			members := newMembers(0)
+			Expect(requests).To(Equal(0))
+			instances, err := members.GetInstances()
+			Expect(err).To(BeNil())
+			Expect(instances).To(Equal([]cloud.Instance{{Name: "etcd-1", Endpoint: "192.168.0.1"}}))
+			Expect(requests).To(Equal(1))
+		})
+
+		It("discovers the instances every time without a cache TTL", func() {
+			members := newMembers(0)
+			_, err := members.GetInstances()
+			Expect(err).To(BeNil())
+			_, err = members.GetInstances()
+			Expect(err).To(BeNil())
+			Expect(requests).To(Equal(2))
+		})
+
+		It("reuses the instances within the cache TTL", func() {
+			members := newMembers(time.Hour)
+			_, err := members.GetInstances()
+			Expect(err).To(BeNil())
+			_, err = members.GetInstances()
+			Expect(err).To(BeNil())
+			Expect(requests).To(Equal(1))
+		})
+
+		It("honours the context", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := newMembers(0).GetInstancesContext(ctx)
+			Expect(err).ToNot(BeNil())
+			Expect(requests).To(Equal(0))
+		})
+
+		It("doesn't lock the cache while discovering the instances", func() {
+			discovering = make(chan struct{})
+			unblock = make(chan struct{})
+			members := newMembers(0)
+			members.instance = &cloud.Instance{Name: "etcd-1", Endpoint: "192.168.0.1"}
+			done := make(chan error)
+			go func() {
+				_, err := members.GetInstances()
+				done <- err
+			}()
+
+			<-discovering
+			Expect(members.GetLocalInstanceContext(context.Background())).To(Equal(*members.instance))
+			close(unblock)
+			Expect(<-done).To(BeNil())
+		})
+
+		It("stops waiting for the metadata server when the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			unblock := make(chan struct{})
+			defer close(unblock)
+			cancel()
+			_, err := metadataValue(ctx, func() (string, error) {
+				<-unblock
+				return "europe-west1-b", nil
+			})
+			Expect(err).To(Equal(context.Canceled))
+		})
+	})
+})
@@ -0,0 +1,179 @@
+package cloud
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// IPv4 selects IPv4 addresses.
+	IPv4 = "ipv4"
+	// IPv6 selects IPv6 addresses.
+	IPv6 = "ipv6"
+	// DualStack selects an IPv4 address, and also an IPv6 address as an additional endpoint.
+	DualStack = "dual"
+)
+
+// NetworkInterface is a network interface of an instance, which a NetworkSelector can select an endpoint from.
+type NetworkInterface struct {
+	// Index of the interface on the instance, e.g. its device index.
+	Index int
+	// Network and Subnet are the names of the network and subnet the interface is attached to. Either is empty if
+	// the provider doesn't have the concept.
+	Network string
+	Subnet  string
+	// Addresses of the interface, with the primary address first.
+	Addresses []string
+}
+
+// NetworkSelector selects the endpoint of an instance with several network interfaces. An address is only selected if
+// it matches every criteria which is set. The zero value has no criteria, in which case providers use their default
+// endpoint.
+type NetworkSelector struct {
+	// Network is the name of the network or subnet of the interface.
+	Network string
+	// CIDR the address must be within.
+	CIDR *net.IPNet
+	// Index of the interface.
+	Index *int
+	// Family of the address, either IPv4, IPv6 or DualStack.
+	Family string
+}
+
+// IsZero returns true if the selector has no criteria.
+func (s NetworkSelector) IsZero() bool {
+	return s.Network == "" && s.CIDR == nil && s.Index == nil && s.Family == ""
+}
+
+// Select returns the first address of the interfaces which matches the selector. A DualStack selector returns the
+// IPv4 address.
+func (s NetworkSelector) Select(interfaces []NetworkInterface) (string, error) {
+	switch s.Family {
+	case "", IPv4, IPv6:
+		return s.selectAddress(interfaces)
+	case DualStack:
+		return s.withFamily(IPv4).selectAddress(interfaces)
+	default:
+		return "", fmt.Errorf("unsupported address family %q", s.Family)
+	}
+}
+
+// SelectDualStack returns the first IPv4 and the first IPv6 address of the interfaces which match the selector,
+// regardless of its family.
+func (s NetworkSelector) SelectDualStack(interfaces []NetworkInterface) (string, string, error) {
+	ipv4, err := s.withFamily(IPv4).selectAddress(interfaces)
+	if err != nil {
+		return "", "", err
+	}
+	ipv6, err := s.withFamily(IPv6).selectAddress(interfaces)
+	if err != nil {
+		return "", "", err
+	}
+	return ipv4, ipv6, nil
+}
+
+func (s NetworkSelector) withFamily(family string) NetworkSelector {
+	s.Family = family
+	return s
+}
+
+func (s NetworkSelector) selectAddress(interfaces []NetworkInterface) (string, error) {
+	for _, networkInterface := range interfaces {
+		if s.Index != nil && *s.Index != networkInterface.Index {
+			continue
+		}
+		if s.Network != "" && s.Network != networkInterface.Network && s.Network != networkInterface.Subnet {
+			continue
+		}
+		for _, address := range networkInterface.Addresses {
+			if s.matchesAddress(address) {
+				return address, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no network interface address matches %s", s)
+}
+
+func (s NetworkSelector) matchesAddress(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	if s.Family == IPv4 && ip.To4() == nil || s.Family == IPv6 && ip.To4() != nil {
+		return false
+	}
+	return s.CIDR == nil || s.CIDR.Contains(ip)
+}
+
+func (s NetworkSelector) String() string {
+	var criteria []string
+	if s.Network != "" {
+		criteria = append(criteria, "network="+s.Network)
+	}
+	if s.CIDR != nil {
+		criteria = append(criteria, "cidr="+s.CIDR.String())
+	}
+	if s.Index != nil {
+		criteria = append(criteria, fmt.Sprintf("index=%d", *s.Index))
+	}
+	if s.Family != "" {
+		criteria = append(criteria, "family="+s.Family)
+	}
+	return "{" + strings.Join(criteria, ", ") + "}"
+}
+
+// EndpointSelector selects the endpoints of an instance with several network interfaces.
+type EndpointSelector struct {
+	// Network selects the endpoint. If zero, the provider's default endpoint is used.
+	Network NetworkSelector
+	// PeerNetwork selects a separate peer endpoint. If zero, peers use the endpoint.
+	PeerNetwork NetworkSelector
+}
+
+// IsZero returns true if neither endpoint is selected.
+func (s EndpointSelector) IsZero() bool {
+	return s.Network.IsZero() && s.PeerNetwork.IsZero()
+}
+
+// Select sets the endpoints of the instance from the interfaces. The endpoint is defaultEndpoint if its selector is
+// zero, and the peer endpoint is empty if its selector is zero. A DualStack selector sets the IPv4 address as the
+// endpoint and the IPv6 address as an additional endpoint, and likewise for the peer endpoints.
+func (s EndpointSelector) Select(instance *Instance, defaultEndpoint string, interfaces []NetworkInterface) error {
+	instance.Endpoint = defaultEndpoint
+	instance.AdditionalEndpoints = nil
+	switch {
+	case s.Network.Family == DualStack:
+		ipv4, ipv6, err := s.Network.SelectDualStack(interfaces)
+		if err != nil {
+			return err
+		}
+		instance.Endpoint = ipv4
+		instance.AdditionalEndpoints = []string{ipv6}
+	case !s.Network.IsZero():
+		endpoint, err := s.Network.Select(interfaces)
+		if err != nil {
+			return err
+		}
+		instance.Endpoint = endpoint
+	}
+
+	instance.PeerEndpoint = ""
+	instance.AdditionalPeerEndpoints = nil
+	switch {
+	case s.PeerNetwork.Family == DualStack:
+		ipv4, ipv6, err := s.PeerNetwork.SelectDualStack(interfaces)
+		if err != nil {
+			return fmt.Errorf("peer network: %v", err)
+		}
+		instance.PeerEndpoint = ipv4
+		instance.AdditionalPeerEndpoints = []string{ipv6}
+	case !s.PeerNetwork.IsZero():
+		peerEndpoint, err := s.PeerNetwork.Select(interfaces)
+		if err != nil {
+			return fmt.Errorf("peer network: %v", err)
+		}
+		instance.PeerEndpoint = peerEndpoint
+	}
+	return nil
+}
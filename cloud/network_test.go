@@ -0,0 +1,130 @@
+package cloud
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// TestCloud to register the test suite
+func TestCloud(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cloud")
+}
+
+var _ = Describe("Network Selector", func() {
+	var interfaces []NetworkInterface
+
+	BeforeEach(func() {
+		interfaces = []NetworkInterface{
+			{Index: 0, Network: "service", Subnet: "service-a", Addresses: []string{"10.0.0.1", "10.0.0.2"}},
+			{Index: 1, Network: "backend", Subnet: "backend-a", Addresses: []string{"192.168.0.1", "fd00::1"}},
+		}
+	})
+
+	index := func(i int) *int {
+		return &i
+	}
+
+	cidr := func(value string) *net.IPNet {
+		_, ipNet, err := net.ParseCIDR(value)
+		Expect(err).To(BeNil())
+		return ipNet
+	}
+
+	It("is zero without any criteria", func() {
+		Expect(NetworkSelector{}.IsZero()).To(BeTrue())
+		Expect(NetworkSelector{Index: index(0)}.IsZero()).To(BeFalse())
+	})
+
+	It("selects the first address without criteria", func() {
+		Expect(NetworkSelector{}.Select(interfaces)).To(Equal("10.0.0.1"))
+	})
+
+	It("selects the first address by network", func() {
+		Expect(NetworkSelector{Network: "backend"}.Select(interfaces)).To(Equal("192.168.0.1"))
+	})
+
+	It("selects the first address by subnet", func() {
+		Expect(NetworkSelector{Network: "backend-a"}.Select(interfaces)).To(Equal("192.168.0.1"))
+	})
+
+	It("selects the first address by CIDR", func() {
+		Expect(NetworkSelector{CIDR: cidr("10.0.0.2/32")}.Select(interfaces)).To(Equal("10.0.0.2"))
+	})
+
+	It("selects the first address by index", func() {
+		Expect(NetworkSelector{Index: index(1)}.Select(interfaces)).To(Equal("192.168.0.1"))
+	})
+
+	It("selects the first address by family", func() {
+		Expect(NetworkSelector{Family: IPv6}.Select(interfaces)).To(Equal("fd00::1"))
+	})
+
+	It("selects the first address by several criteria", func() {
+		Expect(NetworkSelector{Network: "backend", Family: IPv4}.Select(interfaces)).To(Equal("192.168.0.1"))
+	})
+
+	It("fails when no address matches", func() {
+		_, err := NetworkSelector{Network: "service", Family: IPv6}.Select(interfaces)
+		Expect(err).To(MatchError("no network interface address matches {network=service, family=ipv6}"))
+	})
+
+	It("fails for an unsupported family", func() {
+		_, err := NetworkSelector{Family: "ipx"}.Select(interfaces)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("selects separate client and peer endpoints", func() {
+		selector := EndpointSelector{
+			Network:     NetworkSelector{Network: "service"},
+			PeerNetwork: NetworkSelector{Network: "backend"},
+		}
+		var instance Instance
+		Expect(selector.Select(&instance, "default", interfaces)).To(BeNil())
+		Expect(instance.Endpoint).To(Equal("10.0.0.1"))
+		Expect(instance.PeerEndpoint).To(Equal("192.168.0.1"))
+		Expect(instance.AdditionalEndpoints).To(BeEmpty())
+	})
+
+	It("uses the default endpoint and no peer endpoint without selectors", func() {
+		var instance Instance
+		Expect(EndpointSelector{}.Select(&instance, "default", interfaces)).To(BeNil())
+		Expect(instance.Endpoint).To(Equal("default"))
+		Expect(instance.PeerEndpoint).To(BeEmpty())
+	})
+
+	It("selects the IPv4 address for a dual-stack selector", func() {
+		Expect(NetworkSelector{Family: DualStack}.Select(interfaces)).To(Equal("10.0.0.1"))
+	})
+
+	It("selects both addresses as dual-stack client and peer endpoints", func() {
+		selector := EndpointSelector{
+			Network:     NetworkSelector{Network: "backend", Family: DualStack},
+			PeerNetwork: NetworkSelector{Network: "backend", Family: DualStack},
+		}
+		var instance Instance
+		Expect(selector.Select(&instance, "default", interfaces)).To(BeNil())
+		Expect(instance.Endpoint).To(Equal("192.168.0.1"))
+		Expect(instance.AdditionalEndpoints).To(Equal([]string{"fd00::1"}))
+		Expect(instance.PeerEndpoint).To(Equal("192.168.0.1"))
+		Expect(instance.AdditionalPeerEndpoints).To(Equal([]string{"fd00::1"}))
+		Expect(instance.ClientAddresses()).To(Equal([]string{"192.168.0.1", "fd00::1"}))
+		Expect(instance.PeerAddresses()).To(Equal([]string{"192.168.0.1", "fd00::1"}))
+	})
+
+	It("uses the client addresses as the peer addresses without a peer endpoint", func() {
+		instance := Instance{Endpoint: "10.0.0.1", AdditionalEndpoints: []string{"fd00::1"}}
+		Expect(instance.PeerAddresses()).To(Equal([]string{"10.0.0.1", "fd00::1"}))
+		instance.PeerEndpoint = "192.168.0.1"
+		Expect(instance.PeerAddresses()).To(Equal([]string{"192.168.0.1"}))
+	})
+
+	It("fails a dual-stack selector without an IPv6 address", func() {
+		selector := EndpointSelector{Network: NetworkSelector{Network: "service", Family: DualStack}}
+		err := selector.Select(&Instance{}, "default", interfaces)
+		Expect(err).To(MatchError("no network interface address matches {network=service, family=ipv6}"))
+	})
+})
@@ -13,6 +13,10 @@ import (
 const (
 	proto   = "tcp"
 	timeout = 5 * time.Second
+	// nameAttribute is the RFC1464 attribute holding the member name.
+	nameAttribute = "name"
+	// zoneAttribute is the optional RFC1464 attribute holding the availability zone.
+	zoneAttribute = "zone"
 )
 
 // SRV returns the instance information for an etcd cluster using an SRV record.
@@ -60,43 +64,56 @@ func (s *SRV) GetInstances() ([]cloud.Instance, error) {
 		}
 		var instances []cloud.Instance
 		for _, addr := range addrs {
-			name, err := s.lookupTXTName(addr.Target)
+			attributes, err := s.lookupTXTAttributes(addr.Target)
 			if err != nil {
 				return nil, fmt.Errorf("unable to lookup instance name for SRV target %s: %w", addr.Target, err)
 			}
-			instances = append(instances, cloud.Instance{
-				Endpoint: addr.Target,
-				Name:     name,
-			})
+			instance := cloud.Instance{
+				Endpoint:       addr.Target,
+				Name:           attributes[nameAttribute],
+				PrivateDNSName: strings.TrimSuffix(addr.Target, "."),
+				Zone:           attributes[zoneAttribute],
+			}
+			delete(attributes, nameAttribute)
+			if len(attributes) > 0 {
+				instance.Tags = attributes
+			}
+			instances = append(instances, instance)
 		}
 		s.instances = instances
 	}
 	return s.instances, nil
 }
 
-// lookupTXTName looks for the name associated with the target, using RFC1464 conventions.
-func (s *SRV) lookupTXTName(target string) (string, error) {
+// lookupTXTAttributes looks for the attributes associated with the target, using RFC1464 conventions. The `name=`
+// attribute is required.
+func (s *SRV) lookupTXTAttributes(target string) (map[string]string, error) {
 	ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
 	defer cancelFn()
 	records, err := s.resolver.LookupTXT(ctx, target)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	attributes := make(map[string]string)
 	for _, record := range records {
 		split := strings.SplitN(record, "=", 2)
 		if len(split) != 2 {
 			// No '=' so skip.
 			continue
 		}
-		if split[0] == "name" {
-			return split[1], nil
+		if _, ok := attributes[split[0]]; !ok {
+			attributes[split[0]] = split[1]
 		}
 	}
-	return "", fmt.Errorf("no TXT record with `name=` attribute found for %s", target)
+	if _, ok := attributes[nameAttribute]; !ok {
+		return nil, fmt.Errorf("no TXT record with `name=` attribute found for %s", target)
+	}
+	return attributes, nil
 }
 
-func (s *SRV) lookupInstanceAddresses(instances []cloud.Instance) (map[cloud.Instance][]string, error) {
-	instanceAddrs := make(map[cloud.Instance][]string)
+// lookupInstanceAddresses returns the addresses each instance's endpoint resolves to, by instance name.
+func (s *SRV) lookupInstanceAddresses(instances []cloud.Instance) (map[string][]string, error) {
+	instanceAddrs := make(map[string][]string)
 	for _, instance := range instances {
 		ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
 		defer cancelFn()
@@ -104,7 +121,7 @@ func (s *SRV) lookupInstanceAddresses(instances []cloud.Instance) (map[cloud.Ins
 		if err != nil {
 			return nil, fmt.Errorf("unable to resolve target %s: %w", instance, err)
 		}
-		instanceAddrs[instance] = addrs
+		instanceAddrs[instance.Name] = addrs
 	}
 	return instanceAddrs, nil
 }
@@ -123,8 +140,8 @@ func (s *SRV) findLocalInstance() (cloud.Instance, error) {
 		return cloud.Instance{}, fmt.Errorf("unable to lookup SRV targets: %w", err)
 	}
 
-	for instance, addrs := range instanceAddrs {
-		for _, addr := range addrs {
+	for _, instance := range instances {
+		for _, addr := range instanceAddrs[instance.Name] {
 			if localIP == addr {
 				return instance, nil
 			}
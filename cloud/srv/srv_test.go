@@ -41,7 +41,7 @@ var _ = Describe("SRV Instances", func() {
 		}
 		sentTXTs = make(map[string][]string)
 		sentTXTs["etcd-1"] = []string{"bogus", "boz=woz", "name=i-abc1", "gbg=rrr"}
-		sentTXTs["etcd-2"] = []string{"name=i-abc2"}
+		sentTXTs["etcd-2"] = []string{"name=i-abc2", "zone=eu-west-1b"}
 		sentTXTs["etcd-3"] = []string{"name=i-abc3"}
 		sentHostAddrs = make(map[string][]string)
 		sentHostAddrs["etcd-1"] = []string{"10.10.10.1"}
@@ -88,6 +88,16 @@ var _ = Describe("SRV Instances", func() {
 		Expect(instances[2].Name).To(Equal("i-abc3"))
 	})
 
+	It("should return the zone and other attributes of the TXT records", func() {
+		instances, err := srv.GetInstances()
+		Expect(err).To(Succeed())
+		Expect(instances).To(HaveLen(3))
+		Expect(instances[0].Tags).To(Equal(map[string]string{"boz": "woz", "gbg": "rrr"}))
+		Expect(instances[1].Zone).To(Equal("eu-west-1b"))
+		Expect(instances[1].Tags).To(Equal(map[string]string{"zone": "eu-west-1b"}))
+		Expect(instances[2].Tags).To(BeNil())
+	})
+
 	It("should discover its local instance information via the SRV record", func() {
 		local, err := srv.GetLocalInstance()
 		Expect(err).To(Succeed())
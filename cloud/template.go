@@ -0,0 +1,118 @@
+package cloud
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+// InstanceTemplates derive the name and endpoint of instances from their metadata, e.g. `{{.Tags.Name}}` or
+// `{{.PrivateDNSName}}`. The templates are executed with the Instance as their data. The zero value leaves instances
+// unchanged.
+type InstanceTemplates struct {
+	// Name is the template of the instance name, if set.
+	Name *template.Template
+	// Endpoint is the template of the instance endpoint, if set.
+	Endpoint *template.Template
+}
+
+// ParseInstanceTemplates parses the name and endpoint templates. Either may be empty, in which case it isn't applied.
+// A template referring to a missing tag fails, rather than producing an empty value.
+func ParseInstanceTemplates(name, endpoint string) (InstanceTemplates, error) {
+	var templates InstanceTemplates
+	var err error
+	if templates.Name, err = parseInstanceTemplate("name", name); err != nil {
+		return InstanceTemplates{}, err
+	}
+	if templates.Endpoint, err = parseInstanceTemplate("endpoint", endpoint); err != nil {
+		return InstanceTemplates{}, err
+	}
+	return templates, nil
+}
+
+func parseInstanceTemplate(name, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %w", name, err)
+	}
+	return tmpl, nil
+}
+
+// IsZero returns true if neither template is set.
+func (t InstanceTemplates) IsZero() bool {
+	return t.Name == nil && t.Endpoint == nil
+}
+
+// Apply returns the instance with its name and endpoints replaced by the result of their templates. The templates are
+// executed against the original instance. The endpoint template is applied to each of the endpoints, the additional
+// and peer ones too, with that endpoint as the instance's Endpoint. Endpoints which template to the same value, e.g.
+// a DNS name of a dual-stack instance, are only kept once.
+func (t InstanceTemplates) Apply(instance Instance) (Instance, error) {
+	result := instance
+	if t.Name != nil {
+		name, err := execute(t.Name, instance)
+		if err != nil {
+			return Instance{}, err
+		}
+		result.Name = name
+	}
+	if t.Endpoint != nil {
+		var err error
+		result.Endpoint, result.AdditionalEndpoints, err = t.applyEndpoint(instance, instance.ClientAddresses())
+		if err != nil {
+			return Instance{}, err
+		}
+		if instance.PeerEndpoint != "" {
+			peerAddresses := instance.PeerAddresses()
+			result.PeerEndpoint, result.AdditionalPeerEndpoints, err = t.applyEndpoint(instance, peerAddresses)
+			if err != nil {
+				return Instance{}, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// applyEndpoint returns the result of the endpoint template for the first of the endpoints, and for the rest of them
+// without duplicates.
+func (t InstanceTemplates) applyEndpoint(instance Instance, endpoints []string) (string, []string, error) {
+	var first string
+	var additional []string
+	for i, endpoint := range endpoints {
+		data := instance
+		data.Endpoint = endpoint
+		result, err := execute(t.Endpoint, data)
+		if err != nil {
+			return "", nil, err
+		}
+		if i == 0 {
+			first = result
+		} else if result != first && !contains(additional, result) {
+			additional = append(additional, result)
+		}
+	}
+	return first, additional, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func execute(tmpl *template.Template, instance Instance) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, instance); err != nil {
+		return "", fmt.Errorf("unable to execute the %s template for %s: %w", tmpl.Name(), instance.Name, err)
+	}
+	if buf.Len() == 0 {
+		return "", fmt.Errorf("the %s template is empty for %s", tmpl.Name(), instance.Name)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,94 @@
+package cloud
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Instance Templates", func() {
+	instance := Instance{
+		Name:           "i-0123456789",
+		Endpoint:       "10.0.0.1",
+		PrivateDNSName: "ip-10-0-0-1.eu-west-1.compute.internal",
+		Tags:           map[string]string{"Name": "etcd-1"},
+	}
+
+	It("is zero without any templates", func() {
+		templates, err := ParseInstanceTemplates("", "")
+		Expect(err).To(BeNil())
+		Expect(templates.IsZero()).To(BeTrue())
+
+		applied, err := templates.Apply(instance)
+		Expect(err).To(BeNil())
+		Expect(applied).To(Equal(instance))
+	})
+
+	It("replaces the name and endpoint from the instance metadata", func() {
+		templates, err := ParseInstanceTemplates("{{.Tags.Name}}", "{{.PrivateDNSName}}")
+		Expect(err).To(BeNil())
+		Expect(templates.IsZero()).To(BeFalse())
+
+		applied, err := templates.Apply(instance)
+		Expect(err).To(BeNil())
+		Expect(applied.Name).To(Equal("etcd-1"))
+		Expect(applied.Endpoint).To(Equal("ip-10-0-0-1.eu-west-1.compute.internal"))
+		Expect(applied.PrivateDNSName).To(Equal(instance.PrivateDNSName))
+	})
+
+	It("executes both templates against the original instance", func() {
+		templates, err := ParseInstanceTemplates("{{.Tags.Name}}", "{{.Name}}.etcd.internal")
+		Expect(err).To(BeNil())
+
+		applied, err := templates.Apply(instance)
+		Expect(err).To(BeNil())
+		Expect(applied.Name).To(Equal("etcd-1"))
+		Expect(applied.Endpoint).To(Equal("i-0123456789.etcd.internal"))
+	})
+
+	It("replaces every endpoint, keeping each templated endpoint once", func() {
+		dualStack := instance
+		dualStack.AdditionalEndpoints = []string{"fd00::1"}
+		dualStack.PeerEndpoint = "192.168.0.1"
+		dualStack.AdditionalPeerEndpoints = []string{"fd01::1"}
+
+		templates, err := ParseInstanceTemplates("", "{{.PrivateDNSName}}")
+		Expect(err).To(BeNil())
+		applied, err := templates.Apply(dualStack)
+		Expect(err).To(BeNil())
+		Expect(applied.ClientAddresses()).To(Equal([]string{"ip-10-0-0-1.eu-west-1.compute.internal"}))
+		Expect(applied.PeerAddresses()).To(Equal([]string{"ip-10-0-0-1.eu-west-1.compute.internal"}))
+
+		templates, err = ParseInstanceTemplates("", "{{.Endpoint}}.etcd.internal")
+		Expect(err).To(BeNil())
+		applied, err = templates.Apply(dualStack)
+		Expect(err).To(BeNil())
+		Expect(applied.ClientAddresses()).To(Equal([]string{"10.0.0.1.etcd.internal", "fd00::1.etcd.internal"}))
+		Expect(applied.PeerAddresses()).To(Equal([]string{"192.168.0.1.etcd.internal", "fd01::1.etcd.internal"}))
+	})
+
+	It("fails on an invalid template", func() {
+		_, err := ParseInstanceTemplates("{{.Tags.Name", "")
+		Expect(err).ToNot(BeNil())
+		_, err = ParseInstanceTemplates("", "{{end}}")
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("fails when a tag is missing or the result is empty", func() {
+		templates, err := ParseInstanceTemplates("{{.Tags.Role}}", "")
+		Expect(err).To(BeNil())
+		_, err = templates.Apply(instance)
+		Expect(err).ToNot(BeNil())
+
+		templates, err = ParseInstanceTemplates("", "{{.PrivateDNSName}}")
+		Expect(err).To(BeNil())
+		_, err = templates.Apply(Instance{Name: "etcd-1", Endpoint: "10.0.0.1"})
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("fails on an unknown field", func() {
+		templates, err := ParseInstanceTemplates("", "{{.Unknown}}")
+		Expect(err).To(BeNil())
+		_, err = templates.Apply(instance)
+		Expect(err).ToNot(BeNil())
+	})
+})
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/sky-uk/etcd-bootstrap/cloud"
 	"github.com/vmware/govmomi"
@@ -36,61 +38,104 @@ type Config struct {
 	Environment string
 	// Role tag to filter by
 	Role string
+	// EndpointSelector selects the endpoints of VMs with several network interfaces, by the name of the network the
+	// interface is connected to. Defaults to the guest's IP address.
+	EndpointSelector cloud.EndpointSelector
+	// CacheTTL is how long the discovered instances are reused for before discovering them again. If zero, they're
+	// discovered every time they're requested.
+	CacheTTL time.Duration
 }
 
-// Members of a VMware group.
+// Members of a VMware group. The instances are discovered when they're requested, and cached for the cache TTL.
 type Members struct {
+	cfg Config
+
+	mu        sync.Mutex
 	instances []cloud.Instance
-	instance  cloud.Instance
+	fetched   time.Time
 }
 
 // GetInstances will return the vmware etcd instances
 func (m *Members) GetInstances() ([]cloud.Instance, error) {
-	return m.instances, nil
-}
-
-// GetLocalInstance will get the vmware instance etcd bootstrap is running on
-func (m *Members) GetLocalInstance() (cloud.Instance, error) {
-	return m.instance, nil
-}
-
-// GetLocalIP returns the same value as the GetLocalInstance() endpoint.
-func (m *Members) GetLocalIP() (string, error) {
-	localInstance, _ := m.GetLocalInstance()
-	return localInstance.Endpoint, nil
+	return m.GetInstancesContext(context.Background())
 }
 
-// NewVMware returns the Members this local instance belongs to.
-func NewVMware(cfg *Config) (*Members, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-
-	defer cancel()
+// GetInstancesContext returns the vmware etcd instances, discovering them again if the cached instances are older
+// than the cache TTL. The cache isn't locked while they're discovered, so concurrent calls may each discover them.
+func (m *Members) GetInstancesContext(ctx context.Context) ([]cloud.Instance, error) {
+	m.mu.Lock()
+	if !m.fetched.IsZero() && time.Since(m.fetched) < m.cfg.CacheTTL {
+		defer m.mu.Unlock()
+		return m.instances, nil
+	}
+	m.mu.Unlock()
 
-	c, err := newClient(ctx, cfg)
+	c, err := newClient(ctx, &m.cfg)
 	if err != nil {
 		return nil, err
 	}
 	defer c.Logout(ctx)
 
-	instances, err := findAllInstances(ctx, c, cfg.Environment, cfg.Role)
+	instances, err := findAllInstances(ctx, c, m.cfg.Environment, m.cfg.Role, m.cfg.EndpointSelector)
 	if err != nil {
 		return nil, err
 	}
 
-	instance, err := findThisInstance(cfg, instances)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.instances = instances
+	m.fetched = time.Now()
+	return instances, nil
+}
+
+// GetLocalInstance will get the vmware instance etcd bootstrap is running on
+func (m *Members) GetLocalInstance() (cloud.Instance, error) {
+	return m.GetLocalInstanceContext(context.Background())
+}
+
+// GetLocalInstanceContext returns the vmware instance etcd bootstrap is running on, from the discovered instances.
+func (m *Members) GetLocalInstanceContext(ctx context.Context) (cloud.Instance, error) {
+	instances, err := m.GetInstancesContext(ctx)
 	if err != nil {
-		return nil, err
+		return cloud.Instance{}, err
+	}
+	instance, err := findThisInstance(&m.cfg, instances)
+	if err != nil {
+		return cloud.Instance{}, err
 	}
+	return *instance, nil
+}
+
+// GetLocalIP returns the same value as the GetLocalInstance() endpoint.
+func (m *Members) GetLocalIP() (string, error) {
+	localInstance, err := m.GetLocalInstance()
+	if err != nil {
+		return "", err
+	}
+	return localInstance.Endpoint, nil
+}
 
-	members := Members{
-		instances: instances,
-		instance:  *instance,
+// NewVMware returns the Members this local instance belongs to. The instances aren't discovered until they're
+// requested.
+func NewVMware(cfg *Config) (*Members, error) {
+	if cfg.VCenterHost == "" {
+		return nil, errors.New("vCenter host must be provided")
+	}
+	if cfg.VMName == "" {
+		return nil, errors.New("VM name must be provided")
+	}
+	if cfg.Environment == "" || cfg.Role == "" {
+		return nil, errors.New("environment and role must be provided")
+	}
+	if _, err := vCenterURL(cfg); err != nil {
+		return nil, err
 	}
 
-	return &members, nil
+	return &Members{cfg: *cfg}, nil
 }
 
-func findAllInstances(ctx context.Context, c *govmomi.Client, env, role string) ([]cloud.Instance, error) {
+func findAllInstances(ctx context.Context, c *govmomi.Client, env, role string,
+	selector cloud.EndpointSelector) ([]cloud.Instance, error) {
 	m := view.NewManager(c.Client)
 
 	v, err := m.CreateContainerView(ctx, c.ServiceContent.RootFolder, []string{"VirtualMachine"}, true)
@@ -104,7 +149,11 @@ func findAllInstances(ctx context.Context, c *govmomi.Client, env, role string)
 	var vms []mo.VirtualMachine
 
 	// Does restricting the scope for the fields we're after make it faster?
-	err = v.Retrieve(ctx, []string{"VirtualMachine"}, []string{"config.name", "config.extraConfig", "summary.runtime", "summary.guest"}, &vms)
+	properties := []string{"config.name", "config.uuid", "config.extraConfig", "summary.runtime", "summary.guest"}
+	if !selector.IsZero() {
+		properties = append(properties, "guest.net")
+	}
+	err = v.Retrieve(ctx, []string{"VirtualMachine"}, properties, &vms)
 	if err != nil {
 		return nil, err
 	}
@@ -120,16 +169,59 @@ func findAllInstances(ctx context.Context, c *govmomi.Client, env, role string)
 
 	for _, vm := range matched {
 		if vm.Summary.Runtime.PowerState == vmware_types.VirtualMachinePowerStatePoweredOn {
-			instances = append(instances, cloud.Instance{
-				Name:     vm.Config.Name,
-				Endpoint: vm.Summary.Guest.IpAddress,
-			})
+			tags := extraConfigTags(vm)
+			instance := cloud.Instance{
+				Name:           vm.Config.Name,
+				PrivateDNSName: vm.Summary.Guest.HostName,
+				Tags:           tags,
+				Zone:           tags["zone"],
+				ProviderID:     vm.Config.Uuid,
+				State:          cloud.StateRunning,
+			}
+			if vm.Summary.Runtime.BootTime != nil {
+				instance.LaunchTime = *vm.Summary.Runtime.BootTime
+			}
+			if err := selector.Select(&instance, vm.Summary.Guest.IpAddress, guestNetworkInterfaces(vm)); err != nil {
+				return nil, fmt.Errorf("unable to select the endpoint of VM %q: %v", vm.Config.Name, err)
+			}
+			instances = append(instances, instance)
 		}
 	}
 
 	return instances, nil
 }
 
+// guestNetworkInterfaces returns the network interfaces reported by the guest, named by the network they're connected
+// to, and indexed in the order they're reported.
+func guestNetworkInterfaces(vm mo.VirtualMachine) []cloud.NetworkInterface {
+	var interfaces []cloud.NetworkInterface
+	if vm.Guest == nil {
+		return interfaces
+	}
+	for i, nic := range vm.Guest.Net {
+		interfaces = append(interfaces, cloud.NetworkInterface{
+			Index:     i,
+			Network:   nic.Network,
+			Addresses: nic.IpAddress,
+		})
+	}
+	return interfaces
+}
+
+// extraConfigTags returns the extra config of the VM with the tags_ prefix, without the prefix.
+func extraConfigTags(vm mo.VirtualMachine) map[string]string {
+	tags := make(map[string]string)
+	if vm.Config != nil {
+		for _, config := range vm.Config.ExtraConfig {
+			option := config.GetOptionValue()
+			if strings.HasPrefix(option.Key, "tags_") {
+				tags[strings.TrimPrefix(option.Key, "tags_")] = fmt.Sprintf("%v", option.Value)
+			}
+		}
+	}
+	return tags
+}
+
 func matchesTag(vm mo.VirtualMachine, tag string, match string) bool {
 	if vm.Config != nil {
 		for _, config := range vm.Config.ExtraConfig {
@@ -144,10 +236,8 @@ func matchesTag(vm mo.VirtualMachine, tag string, match string) bool {
 func findThisInstance(cfg *Config, instances []cloud.Instance) (*cloud.Instance, error) {
 	for _, instance := range instances {
 		if strings.Contains(cfg.VMName, instance.Name) {
-			return &cloud.Instance{
-				Name:     instance.Name,
-				Endpoint: instance.Endpoint,
-			}, nil
+			instance := instance
+			return &instance, nil
 		}
 	}
 
@@ -157,13 +247,11 @@ func findThisInstance(cfg *Config, instances []cloud.Instance) (*cloud.Instance,
 func newClient(ctx context.Context, cfg *Config) (*govmomi.Client, error) {
 	flag.Parse()
 
-	u, err := url.Parse(fmt.Sprintf("https://%s:%v/sdk", cfg.VCenterHost, cfg.VCenterPort))
+	u, err := vCenterURL(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	u.User = url.UserPassword(cfg.User, cfg.Password)
-
 	c, err := govmomi.NewClient(ctx, u, cfg.InsecureFlag)
 	if err != nil {
 		return nil, err
@@ -173,3 +261,14 @@ func newClient(ctx context.Context, cfg *Config) (*govmomi.Client, error) {
 
 	return c, nil
 }
+
+func vCenterURL(cfg *Config) (*url.URL, error) {
+	u, err := url.Parse(fmt.Sprintf("https://%s:%v/sdk", cfg.VCenterHost, cfg.VCenterPort))
+	if err != nil {
+		return nil, fmt.Errorf("invalid vCenter host %q: %v", cfg.VCenterHost, err)
+	}
+
+	u.User = url.UserPassword(cfg.User, cfg.Password)
+
+	return u, nil
+}
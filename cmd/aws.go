@@ -1,16 +1,16 @@
 package cmd
 
 import (
-	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/sky-uk/etcd-bootstrap/bootstrap"
-	"github.com/sky-uk/etcd-bootstrap/cloud"
-	"github.com/sky-uk/etcd-bootstrap/etcd"
+	"github.com/sky-uk/etcd-bootstrap/registration"
 
 	log "github.com/sirupsen/logrus"
 	aws_cloud "github.com/sky-uk/etcd-bootstrap/cloud/aws"
-	"github.com/sky-uk/etcd-bootstrap/cloud/noop"
 	"github.com/sky-uk/etcd-bootstrap/cloud/srv"
 	"github.com/spf13/cobra"
 )
@@ -23,37 +23,144 @@ var awsCmd = &cobra.Command{
 }
 
 var (
-	awsRegistrationProvider string
-	route53ZoneID           string
-	dnsHostname             string
-	lbTargetGroupName       string
-	instanceLookupMethod    string
-	srvDomainName           string
-	srvService              string
-	enableTLS               bool
-	serverCA                string
-	serverCert              string
-	serverKey               string
-	peerCA                  string
-	peerCert                string
-	peerKey                 string
+	awsRegistrationProviders []string
+	route53ZoneID            string
+	route53ZoneName          string
+	route53PrivateZone       bool
+	route53VPCID             string
+	dnsHostname              string
+	r53NodeRecords           bool
+	r53WaitTimeout           time.Duration
+	r53Verify                bool
+	lbTargetGroupName        string
+	lbDrainTimeout           time.Duration
+	lbTargetGroups           []string
+	lbTargetPort             int64
+	lbTargetAZ               string
+	instanceLookupMethod     string
+	srvDomainName            string
+	srvService               string
+	instanceTags             map[string]string
+	asgNames                 []string
+	asgTags                  map[string]string
+	eniPoolTags              map[string]string
+	eniNameTag               string
+	eniDeviceIndex           int64
+	eniTimeout               time.Duration
+	eniWaitForAddress        bool
+	volumeTags               map[string]string
+	volumeNameTag            string
+	volumeDevice             string
+	volumeTimeout            time.Duration
+	imdsTimeout              time.Duration
+	imdsV1Fallback           bool
+	awsRegion                string
+	awsInstanceID            string
+	awsProfile               string
+	awsPrivateIP             string
+	awsAvailabilityZone      string
+	awsEndpoints             aws_cloud.Endpoints
+	discoveryRole            aws_cloud.AssumeRoleConfig
+	registrationRole         aws_cloud.AssumeRoleConfig
+	enableTLS                bool
+	serverCA                 string
+	serverCert               string
+	serverKey                string
+	peerCA                   string
+	peerCert                 string
+	peerKey                  string
 )
 
 func init() {
 	RootCmd.AddCommand(awsCmd)
 	f := awsCmd.Flags()
-	f.StringVarP(&awsRegistrationProvider, "registration-provider", "r", "noop", fmt.Sprintf(
-		"automatic registration provider to use, options are: noop, lb, route53"))
+	f.StringSliceVarP(&awsRegistrationProviders, "registration-provider", "r", []string{"noop"},
+		"automatic registration providers to use, options are: noop, lb, route53, e.g. route53,lb")
 	f.StringVar(&route53ZoneID, "r53-zone-id", "",
 		"zone id for automatic registration for registration-provider=route53")
+	f.StringVar(&route53ZoneName, "r53-zone-name", "",
+		"zone name to look up the zone by instead of --r53-zone-id, for registration-provider=route53")
+	f.BoolVar(&route53PrivateZone, "r53-private-zone", false,
+		"look up a private rather than public zone with --r53-zone-name")
+	f.StringVar(&route53VPCID, "r53-vpc-id", "",
+		"look up the private zone associated with this VPC with --r53-zone-name")
 	f.StringVar(&dnsHostname, "dns-hostname", "",
 		"hostname to set to the etcd cluster when registration-provider=route53")
+	f.BoolVar(&r53NodeRecords, "r53-node-records", false,
+		"also publish a record per node and the SRV and TXT records used by instance-lookup-method=srv, "+
+			"when registration-provider=route53")
+	f.DurationVar(&r53WaitTimeout, "r53-wait-timeout", 0,
+		"time to wait for the route53 change to be in sync on all name servers, by default it isn't waited for")
+	f.BoolVar(&r53Verify, "r53-verify", false,
+		"verify the zone's name servers resolve the expected endpoints, requires --r53-wait-timeout")
 	f.StringVar(&lbTargetGroupName, "lb-target-group-name", "",
 		"loadbalancer target group name to use when --registration-provider=lb")
+	f.Int64Var(&lbTargetPort, "lb-target-port", 0,
+		"port to register targets on with --lb-target-group-name, defaults to the target group's port")
+	f.StringSliceVar(&lbTargetGroups, "lb-target-groups", nil,
+		"loadbalancer target groups to use when --registration-provider=lb, as name[:port], e.g. etcd-client,etcd-metrics:2381")
+	f.StringVar(&lbTargetAZ, "lb-target-availability-zone", "",
+		"availability zone to register targets with, e.g. all for IP targets outside of the VPC")
+	f.DurationVar(&lbDrainTimeout, "lb-drain-timeout", 0,
+		"time to wait for stale targets to finish draining from the target group, by default it isn't waited for")
 	f.StringVar(&instanceLookupMethod, "instance-lookup-method", "asg",
-		"method for looking up instances in the cluster, options are: asg, srv")
+		"method for looking up instances in the cluster, options are: asg, srv, tags")
 	f.StringVar(&srvDomainName, "srv-domain-name", "", "domain name to use for instance-lookup-method=srv")
 	f.StringVar(&srvService, "srv-service", "etcd-bootstrap", "service to use for instance-lookup-method=srv")
+	f.StringToStringVar(&instanceTags, "instance-tags", nil,
+		"EC2 tags that cluster instances must have for instance-lookup-method=tags, e.g. etcd-cluster=prod-a")
+	f.StringSliceVar(&asgNames, "asg-names", nil,
+		"auto scaling groups to look up instances from for instance-lookup-method=asg, defaults to the local ASG")
+	f.StringToStringVar(&asgTags, "asg-tags", nil,
+		"tags of the auto scaling groups to look up instances from for instance-lookup-method=asg")
+	f.StringToStringVar(&eniPoolTags, "eni-pool-tags", nil,
+		"tags of a pool of network interfaces to claim one from, to give each node a stable IP and name")
+	f.StringVar(&eniNameTag, "eni-name-tag", "Name",
+		"tag of the pooled network interface containing the node's name, when --eni-pool-tags is set")
+	f.Int64Var(&eniDeviceIndex, "eni-device-index", 1,
+		"device index to attach the pooled network interface at, when --eni-pool-tags is set")
+	f.DurationVar(&eniTimeout, "eni-timeout", 5*time.Minute,
+		"time to wait for pooled network interfaces to be attached, when --eni-pool-tags is set")
+	f.BoolVar(&eniWaitForAddress, "eni-wait-for-address", false,
+		"wait for the pooled network interface's IP to be assigned locally, when --eni-pool-tags is set")
+	f.StringToStringVar(&volumeTags, "data-volume-tags", nil,
+		"tags of the EBS data volumes for this cluster, to reattach an existing member's data volume")
+	f.StringVar(&volumeNameTag, "data-volume-name-tag", "etcd-bootstrap/member-name",
+		"tag of the data volume containing its member name, when --data-volume-tags is set")
+	f.StringVar(&volumeDevice, "data-volume-device", "/dev/xvdf",
+		"device to attach the data volume as, when --data-volume-tags is set")
+	f.DurationVar(&volumeTimeout, "data-volume-timeout", 5*time.Minute,
+		"time to wait for the data volume to be attached, when --data-volume-tags is set")
+	f.DurationVar(&imdsTimeout, "imds-timeout", 5*time.Second,
+		"timeout for each request to the EC2 instance metadata service")
+	f.BoolVar(&imdsV1Fallback, "imds-v1-fallback", true,
+		"fall back to IMDSv1 if an IMDSv2 session token can't be obtained, e.g. due to the metadata hop limit")
+	f.StringVar(&awsRegion, "aws-region", "",
+		"region for the AWS clients and of the local instance, defaults to the region of the local instance")
+	f.StringVar(&awsInstanceID, "aws-instance-id", "",
+		"ID of the local instance, if set along with --aws-region the instance metadata service isn't used")
+	f.StringVar(&awsPrivateIP, "aws-private-ip", "",
+		"private IP of the local instance, if set along with --aws-instance-id the instance isn't looked up")
+	f.StringVar(&awsAvailabilityZone, "aws-availability-zone", "",
+		"availability zone of the local instance, when --aws-private-ip is set")
+	f.StringVar(&awsProfile, "aws-profile", "", "shared config profile to use for AWS credentials and configuration")
+	f.StringVar(&awsEndpoints.EC2, "aws-ec2-endpoint", "", "custom endpoint URL for EC2")
+	f.StringVar(&awsEndpoints.AutoScaling, "aws-autoscaling-endpoint", "", "custom endpoint URL for Auto Scaling")
+	f.StringVar(&awsEndpoints.Route53, "aws-route53-endpoint", "", "custom endpoint URL for Route53")
+	f.StringVar(&awsEndpoints.ELBv2, "aws-elbv2-endpoint", "", "custom endpoint URL for ELBv2")
+	f.StringVar(&awsEndpoints.STS, "aws-sts-endpoint", "", "custom endpoint URL for STS")
+	f.StringVar(&discoveryRole.ARN, "discovery-role-arn", "",
+		"IAM role to assume for looking up cluster instances with EC2 and Auto Scaling")
+	f.StringVar(&discoveryRole.ExternalID, "discovery-role-external-id", "",
+		"external ID to use when assuming --discovery-role-arn")
+	f.StringVar(&discoveryRole.SessionName, "discovery-role-session-name", "etcd-bootstrap",
+		"session name to use when assuming --discovery-role-arn")
+	f.StringVar(&registrationRole.ARN, "registration-role-arn", "",
+		"IAM role to assume for registering the cluster with Route53 or a load balancer target group")
+	f.StringVar(&registrationRole.ExternalID, "registration-role-external-id", "",
+		"external ID to use when assuming --registration-role-arn")
+	f.StringVar(&registrationRole.SessionName, "registration-role-session-name", "etcd-bootstrap",
+		"session name to use when assuming --registration-role-arn")
 	f.BoolVar(&enableTLS, "enable-tls", false, "enable TLS")
 	f.StringVar(&serverCA, "tls-ca", "", "path to client/server CA")
 	f.StringVar(&serverCert, "tls-cert", "", "path to server certificate")
@@ -64,28 +171,40 @@ func init() {
 }
 
 func aws(cmd *cobra.Command, args []string) {
-	aws, err := aws_cloud.NewAWS()
+	awsSession, err := aws_cloud.NewSession(&aws_cloud.SessionConfig{
+		Metadata: aws_cloud.MetadataConfig{
+			Timeout:        imdsTimeout,
+			IMDSv1Fallback: imdsV1Fallback,
+		},
+		Region:           awsRegion,
+		Profile:          awsProfile,
+		Endpoints:        awsEndpoints,
+		InstanceID:       awsInstanceID,
+		PrivateIP:        awsPrivateIP,
+		AvailabilityZone: awsAvailabilityZone,
+		DiscoveryRole:    discoveryRole,
+		RegistrationRole: registrationRole,
+	})
 	if err != nil {
-		log.Fatalf("Failed to create AWS provider: %v", err)
+		log.Fatalf("Failed to create AWS session: %v", err)
 	}
 
-	cloudAPI := createCloudAPI(aws)
-	etcdClusterAPI := createEtcdClusterAPI(cloudAPI)
-
-	var opts []bootstrap.Option
-	if enableTLS {
-		opts = []bootstrap.Option{bootstrap.WithTLS(serverCA, serverCert, serverKey, peerCA, peerCert, peerKey)}
-	}
-	bootstrapper, err := bootstrap.New(cloudAPI, etcdClusterAPI, opts...)
+	aws, err := aws_cloud.NewAWS(awsSession, createAWSConfig())
 	if err != nil {
-		log.Fatalf("Failed to create etcd bootstrapper: %v", err)
+		log.Fatalf("Failed to create AWS provider: %v", err)
 	}
 
-	if err := bootstrapper.GenerateEtcdFlagsFile(outputFilename); err != nil {
-		log.Fatalf("Failed to generate etcd flags file: %v", err)
-	}
+	templates := parseInstanceTemplates()
+	cloudAPI := createCloudAPI(aws)
+	etcdClusterAPI := bootstrapClusters(withInstanceTemplates(cloudAPI, templates), awsTLSConfig(),
+		awsRegistrationProviders)
 
-	registerInstances(cloudAPI)
+	registrator := createRegistrationProvider(awsRegistrationProviders,
+		withTemplatedHealthChecks(etcdClusterAPI, templates), templates,
+		func(name string) registration.Provider {
+			return initialiseAWSRegistrationProvider(awsSession, name)
+		})
+	registerInstances(cloudAPI, registrator)
 }
 
 type localIPResolver struct {
@@ -105,11 +224,49 @@ func (l *localIPResolver) LookupLocalIP() (net.IP, error) {
 	return ip, nil
 }
 
+func createAWSConfig() *aws_cloud.Config {
+	config := &aws_cloud.Config{EndpointSelector: createEndpointSelector()}
+	switch instanceLookupMethod {
+	case "asg":
+		if len(asgNames) > 0 && len(asgTags) > 0 {
+			log.Fatalf("only one of asg-names or asg-tags can be provided")
+		}
+		config.ASGNames = asgNames
+		config.ASGTags = asgTags
+	case "tags":
+		if len(instanceTags) == 0 {
+			log.Fatalf("instance-tags must be provided")
+		}
+		config.InstanceTags = instanceTags
+	}
+	if len(eniPoolTags) > 0 {
+		config.ENIPool = &aws_cloud.ENIPoolConfig{
+			Tags:                eniPoolTags,
+			NameTag:             eniNameTag,
+			DeviceIndex:         eniDeviceIndex,
+			Timeout:             eniTimeout,
+			WaitForLocalAddress: eniWaitForAddress,
+		}
+	}
+	if len(volumeTags) > 0 {
+		config.DataVolume = &aws_cloud.DataVolumeConfig{
+			Tags:    volumeTags,
+			NameTag: volumeNameTag,
+			Device:  volumeDevice,
+			Timeout: volumeTimeout,
+		}
+	}
+	return config
+}
+
 func createCloudAPI(aws *aws_cloud.AWS) bootstrap.CloudAPI {
 	switch instanceLookupMethod {
 	case "asg":
 		log.Info("Using ASG for looking up cluster instances")
 		return aws
+	case "tags":
+		log.Infof("Using EC2 tags %v for looking up cluster instances", instanceTags)
+		return aws
 	case "srv":
 		log.Info("Using SRV record for looking up cluster instances")
 		if srvDomainName == "" {
@@ -125,45 +282,42 @@ func createCloudAPI(aws *aws_cloud.AWS) bootstrap.CloudAPI {
 	}
 }
 
-func registerInstances(cloudInstances bootstrap.CloudAPI) {
-	instances, err := cloudInstances.GetInstances()
-	if err != nil {
-		log.Fatalf("Failed to retrieve instances: %v", err)
-	}
-	registrator := initialiseAWSRegistrationProvider()
-	if err := registrator.Update(instances); err != nil {
-		log.Fatalf("Failed to register etcd cluster data with cloud registration provider: %v", err)
+// awsTLSConfig returns the TLS material from the --tls-* flags if --enable-tls is set.
+func awsTLSConfig() tlsConfig {
+	if !enableTLS {
+		return tlsConfig{}
 	}
-}
-
-type registrationProvider interface {
-	Update([]cloud.Instance) error
-}
-
-func createEtcdClusterAPI(instances etcd.CloudAPI) *etcd.ClusterAPI {
-	var etcdOpts []etcd.Option
-	if enableTLS {
-		etcdOpts = []etcd.Option{etcd.WithTLS(peerCA, peerCert, peerKey)}
-	}
-	etcdCluster, err := etcd.New(instances, etcdOpts...)
-	if err != nil {
-		log.Fatalf("Failed to create etcd cluster API: %v", err)
+	return tlsConfig{
+		serverCA:   serverCA,
+		serverCert: serverCert,
+		serverKey:  serverKey,
+		peerCA:     peerCA,
+		peerCert:   peerCert,
+		peerKey:    peerKey,
 	}
-	return etcdCluster
 }
 
-func initialiseAWSRegistrationProvider() registrationProvider {
-	switch awsRegistrationProvider {
+func initialiseAWSRegistrationProvider(awsSession *aws_cloud.Session, name string) registration.Provider {
+	switch name {
 	case "noop":
-		log.Info("Using noop cloud registration provider")
-		return noop.RegistrationProvider{}
+		return newNoopRegistrationProvider(name)
 	case "route53":
-		checkRequiredFlag(route53ZoneID, "--r53-zone-id")
+		if route53ZoneID == "" && route53ZoneName == "" {
+			log.Fatalf("one of --r53-zone-id or --r53-zone-name must be provided")
+		}
 		checkRequiredFlag(dnsHostname, "--dns-hostname")
 
-		registrator, err := aws_cloud.NewRoute53RegistrationProvider(&aws_cloud.Route53RegistrationProviderConfig{
-			ZoneID:   route53ZoneID,
-			Hostname: dnsHostname,
+		registrator, err := aws_cloud.NewRoute53RegistrationProvider(awsSession, &aws_cloud.Route53RegistrationProviderConfig{
+			ZoneID:      route53ZoneID,
+			ZoneName:    route53ZoneName,
+			PrivateZone: route53PrivateZone,
+			VPCID:       route53VPCID,
+			Hostname:    dnsHostname,
+			NodeRecords: r53NodeRecords,
+			SRVService:  srvService,
+			SRVPort:     clientPort,
+			WaitTimeout: r53WaitTimeout,
+			Verify:      r53Verify,
 		})
 		if err != nil {
 			log.Fatalf("Failed to create route53 registration client: %v", err)
@@ -171,10 +325,14 @@ func initialiseAWSRegistrationProvider() registrationProvider {
 		log.Info("Using route53 cloud registration provider")
 		return registrator
 	case "lb":
-		checkRequiredFlag(lbTargetGroupName, "--lb-target-group-name")
+		targetGroups := parseTargetGroups()
+		if len(targetGroups) == 0 {
+			log.Fatalf("one of --lb-target-group-name or --lb-target-groups must be provided")
+		}
 
-		registrator, err := aws_cloud.NewLBTargetGroupRegistrationProvider(&aws_cloud.LBTargetGroupRegistrationProviderConfig{
-			TargetGroupName: lbTargetGroupName,
+		registrator, err := aws_cloud.NewLBTargetGroupRegistrationProvider(awsSession, &aws_cloud.LBTargetGroupRegistrationProviderConfig{
+			TargetGroups: targetGroups,
+			DrainTimeout: lbDrainTimeout,
 		})
 		if err != nil {
 			log.Fatalf("Failed to create loadbalancer registration client: %v", err)
@@ -183,7 +341,35 @@ func initialiseAWSRegistrationProvider() registrationProvider {
 		log.Info("Using loadbalancer target group cloud registration provider")
 		return registrator
 	default:
-		log.Fatalf("Unsupported registration type: %v", awsRegistrationProvider)
+		log.Fatalf("Unsupported registration type: %v", name)
 		return nil
 	}
 }
+
+// parseTargetGroups returns the target groups from --lb-target-group-name and --lb-target-groups.
+func parseTargetGroups() []aws_cloud.TargetGroupConfig {
+	var targetGroups []aws_cloud.TargetGroupConfig
+	if lbTargetGroupName != "" {
+		targetGroups = append(targetGroups, aws_cloud.TargetGroupConfig{
+			Name:             lbTargetGroupName,
+			Port:             lbTargetPort,
+			AvailabilityZone: lbTargetAZ,
+		})
+	}
+	for _, entry := range lbTargetGroups {
+		targetGroup := aws_cloud.TargetGroupConfig{
+			Name:             entry,
+			AvailabilityZone: lbTargetAZ,
+		}
+		if i := strings.LastIndex(entry, ":"); i != -1 {
+			port, err := strconv.ParseInt(entry[i+1:], 10, 64)
+			if err != nil {
+				log.Fatalf("Invalid port in --lb-target-groups entry %q: %v", entry, err)
+			}
+			targetGroup.Name = entry[:i]
+			targetGroup.Port = port
+		}
+		targetGroups = append(targetGroups, targetGroup)
+	}
+	return targetGroups
+}
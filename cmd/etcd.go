@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/bootstrap"
+	"github.com/sky-uk/etcd-bootstrap/etcd"
+)
+
+// clusterConfig is an etcd cluster to bootstrap on the local host.
+type clusterConfig struct {
+	// name of the cluster, which is empty unless it's one of several given with --cluster.
+	name       string
+	peerPort   int
+	clientPort int
+	token      string
+	outputFile string
+	tls        tlsConfig
+}
+
+// tlsConfig is the TLS material of a cluster. TLS is enabled if any of it is set.
+type tlsConfig struct {
+	serverCA, serverCert, serverKey string
+	peerCA, peerCert, peerKey       string
+}
+
+func (t tlsConfig) enabled() bool {
+	return t != tlsConfig{}
+}
+
+// bootstrapClusters writes the etcd flags of each cluster to its output file, and returns the etcd cluster API of the
+// first cluster, which is the only cluster if the instances are registered. The clusters share a single discovery of
+// the instances from cloudAPI.
+func bootstrapClusters(cloudAPI bootstrap.CloudAPI, defaultTLS tlsConfig,
+	registrationProviders []string) *etcd.ClusterAPI {
+	configs := clusterConfigs(defaultTLS)
+	checkClusterRegistration(configs, registrationProviders)
+	if len(configs) > 1 {
+		cloudAPI = bootstrap.NewSharedCloudAPI(cloudAPI)
+	}
+
+	var first *etcd.ClusterAPI
+	for _, cfg := range configs {
+		if cfg.name != "" {
+			log.Infof("Bootstrapping etcd cluster %s", cfg.name)
+		}
+		etcdCluster, err := etcd.New(cloudAPI, cfg.etcdOptions()...)
+		if err != nil {
+			log.Fatalf("Failed to create etcd cluster API%s: %v", cfg.logSuffix(), err)
+		}
+		bootstrapper, err := bootstrap.New(cloudAPI, etcdCluster, cfg.bootstrapOptions()...)
+		if err != nil {
+			log.Fatalf("Failed to create etcd bootstrapper%s: %v", cfg.logSuffix(), err)
+		}
+		if err := bootstrapper.GenerateEtcdFlagsFile(cfg.outputFile); err != nil {
+			log.Fatalf("Failed to generate etcd flags file%s: %v", cfg.logSuffix(), err)
+		}
+		if first == nil {
+			first = etcdCluster
+		}
+	}
+	return first
+}
+
+// checkClusterRegistration fails if the instances are registered along with several clusters, or a cluster whose
+// client port isn't --client-port. Registration providers publish --client-port, and are health checked against a
+// single cluster, so would register the wrong cluster.
+func checkClusterRegistration(configs []clusterConfig, registrationProviders []string) {
+	var registered []string
+	for _, name := range registrationProviders {
+		if name != "noop" {
+			registered = append(registered, name)
+		}
+	}
+	if len(registered) == 0 {
+		return
+	}
+	if len(configs) > 1 {
+		log.Fatalf("Registration providers %v can't be used with several clusters", registered)
+	}
+	if configs[0].clientPort != clientPort {
+		log.Fatalf("Registration providers %v can't be used with cluster %s, as its client port %d isn't --client-port",
+			registered, configs[0].name, configs[0].clientPort)
+	}
+}
+
+func (c clusterConfig) logSuffix() string {
+	if c.name == "" {
+		return ""
+	}
+	return " for cluster " + c.name
+}
+
+func (c clusterConfig) bootstrapOptions() []bootstrap.Option {
+	opts := []bootstrap.Option{bootstrap.WithPorts(c.peerPort, c.clientPort)}
+	if advertiseDomain != "" {
+		opts = append(opts, bootstrap.WithAdvertiseDomain(advertiseDomain))
+	}
+	if c.token != "" {
+		opts = append(opts, bootstrap.WithClusterToken(c.token))
+	}
+	if c.tls.enabled() {
+		opts = append(opts, bootstrap.WithTLS(c.tls.serverCA, c.tls.serverCert, c.tls.serverKey,
+			c.tls.peerCA, c.tls.peerCert, c.tls.peerKey))
+	}
+	return opts
+}
+
+func (c clusterConfig) etcdOptions() []etcd.Option {
+	opts := []etcd.Option{etcd.WithClientPort(c.clientPort)}
+	if c.tls.enabled() {
+		opts = append(opts, etcd.WithTLS(c.tls.peerCA, c.tls.peerCert, c.tls.peerKey))
+	}
+	return opts
+}
+
+// clusterConfigs returns the clusters given with --cluster, or a single cluster from the other flags if there are none.
+func clusterConfigs(defaultTLS tlsConfig) []clusterConfig {
+	defaults := clusterConfig{
+		peerPort:   peerPort,
+		clientPort: clientPort,
+		token:      clusterToken,
+		outputFile: outputFilename,
+		tls:        defaultTLS,
+	}
+	if len(clusterSpecs) == 0 {
+		return []clusterConfig{defaults}
+	}
+
+	var configs []clusterConfig
+	names := make(map[string]bool)
+	ports := make(map[int]string)
+	outputFiles := make(map[string]string)
+	for _, spec := range clusterSpecs {
+		cfg, err := parseClusterSpec(spec, defaults)
+		if err != nil {
+			log.Fatalf("Invalid --cluster %q: %v", spec, err)
+		}
+		if names[cfg.name] {
+			log.Fatalf("Cluster %s is given more than once", cfg.name)
+		}
+		names[cfg.name] = true
+		for _, port := range []int{cfg.peerPort, cfg.clientPort} {
+			if other, ok := ports[port]; ok {
+				log.Fatalf("Clusters %s and %s both use port %d", other, cfg.name, port)
+			}
+			ports[port] = cfg.name
+		}
+		if other, ok := outputFiles[cfg.outputFile]; ok {
+			log.Fatalf("Clusters %s and %s both use output file %s", other, cfg.name, cfg.outputFile)
+		}
+		outputFiles[cfg.outputFile] = cfg.name
+		configs = append(configs, cfg)
+	}
+	return configs
+}
+
+// parseClusterSpec parses a cluster given as name:key=value,key=value. The cluster token defaults to the name, and the
+// output file to the --output-file with the name appended, while the other settings default to the other flags.
+func parseClusterSpec(spec string, defaults clusterConfig) (clusterConfig, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	cfg := defaults
+	cfg.name = parts[0]
+	if cfg.name == "" || strings.ContainsAny(cfg.name, "=,/") {
+		return clusterConfig{}, fmt.Errorf("the cluster must start with a name, as name:key=value,...")
+	}
+	cfg.token = cfg.name
+	ext := filepath.Ext(defaults.outputFile)
+	cfg.outputFile = strings.TrimSuffix(defaults.outputFile, ext) + "-" + cfg.name + ext
+	if len(parts) == 1 || parts[1] == "" {
+		return cfg, nil
+	}
+
+	for _, option := range strings.Split(parts[1], ",") {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return clusterConfig{}, fmt.Errorf("expected key=value, but was %q", option)
+		}
+		key, value := kv[0], kv[1]
+		switch key {
+		case "peer-port", "client-port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return clusterConfig{}, fmt.Errorf("invalid %s: %v", key, err)
+			}
+			if key == "peer-port" {
+				cfg.peerPort = port
+			} else {
+				cfg.clientPort = port
+			}
+		case "token":
+			cfg.token = value
+		case "output-file":
+			cfg.outputFile = value
+		case "tls-ca":
+			cfg.tls.serverCA = value
+		case "tls-cert":
+			cfg.tls.serverCert = value
+		case "tls-key":
+			cfg.tls.serverKey = value
+		case "tls-peer-ca":
+			cfg.tls.peerCA = value
+		case "tls-peer-cert":
+			cfg.tls.peerCert = value
+		case "tls-peer-key":
+			cfg.tls.peerKey = value
+		default:
+			return clusterConfig{}, fmt.Errorf("unknown key %q", key)
+		}
+	}
+	return cfg, nil
+}
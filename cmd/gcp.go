@@ -1,10 +1,13 @@
 package cmd
 
 import (
+	"strconv"
+	"strings"
+	"time"
+
 	log "github.com/sirupsen/logrus"
-	"github.com/sky-uk/etcd-bootstrap/bootstrap"
 	gcp_provider "github.com/sky-uk/etcd-bootstrap/cloud/gcp"
-	"github.com/sky-uk/etcd-bootstrap/etcd"
+	"github.com/sky-uk/etcd-bootstrap/registration"
 	"github.com/spf13/cobra"
 )
 
@@ -17,9 +20,24 @@ var gcpCmd = &cobra.Command{
 }
 
 var (
-	gcpProjectID   string
-	gcpEnvironment string
-	gcpRole        string
+	gcpProjectID    string
+	gcpLookupMethod string
+	gcpEnvironment  string
+	gcpRole         string
+	gcpCacheTTL     time.Duration
+
+	gcpRegistrationProviders []string
+	cloudDNSProjectID        string
+	cloudDNSZone             string
+	cloudDNSHostname         string
+	cloudDNSNodeRecords      bool
+	cloudDNSSRVService       string
+	cloudDNSEndpoint         string
+	cloudDNSWithoutAuth      bool
+	gcpInstanceGroups        []string
+	gcpNEGs                  []string
+	computeEndpoint          string
+	computeWithoutAuth       bool
 )
 
 func init() {
@@ -27,38 +45,150 @@ func init() {
 
 	gcpCmd.Flags().StringVar(&gcpProjectID, "project-id", "",
 		"value of the GCP 'project id' to query")
+	gcpCmd.Flags().StringVar(&gcpLookupMethod, "instance-lookup-method", gcp_provider.LabelsLookupMethod,
+		"method to find the etcd instances, options are: labels, mig")
 	gcpCmd.Flags().StringVar(&gcpEnvironment, "environment", "",
-		"value of the 'environment' label in GCP nodes to filter them by")
+		"value of the 'environment' label in GCP nodes to filter them by, for instance-lookup-method=labels")
 	gcpCmd.Flags().StringVar(&gcpRole, "role", "",
-		"value of the 'role' label in GCP nodes to filter them by")
+		"value of the 'role' label in GCP nodes to filter them by, for instance-lookup-method=labels")
+	gcpCmd.Flags().DurationVar(&gcpCacheTTL, "instance-cache-ttl", time.Minute,
+		"how long discovered instances are reused for before querying the GCP API again")
+	gcpCmd.Flags().StringSliceVarP(&gcpRegistrationProviders, "registration-provider", "r", []string{"noop"},
+		"automatic registration providers to use, options are: noop, clouddns, instancegroup, neg")
+	gcpCmd.Flags().StringVar(&cloudDNSProjectID, "clouddns-project-id", "",
+		"project of the Cloud DNS managed zone for registration-provider=clouddns, defaults to --project-id")
+	gcpCmd.Flags().StringVar(&cloudDNSZone, "clouddns-zone", "",
+		"name of the Cloud DNS managed zone for registration-provider=clouddns")
+	gcpCmd.Flags().StringVar(&cloudDNSHostname, "dns-hostname", "",
+		"hostname to set to the etcd cluster when registration-provider=clouddns")
+	gcpCmd.Flags().BoolVar(&cloudDNSNodeRecords, "clouddns-node-records", false,
+		"also publish a record per node and the SRV and TXT records used by SRV lookup, "+
+			"when registration-provider=clouddns")
+	gcpCmd.Flags().StringVar(&cloudDNSSRVService, "clouddns-srv-service", "etcd-bootstrap",
+		"service of the SRV record published with --clouddns-node-records")
+	gcpCmd.Flags().StringVar(&cloudDNSEndpoint, "clouddns-endpoint", "",
+		"override the Cloud DNS API endpoint, e.g. http://localhost:8080/dns/v1/projects/")
+	gcpCmd.Flags().BoolVar(&cloudDNSWithoutAuth, "clouddns-without-auth", false,
+		"don't authenticate with the Cloud DNS API, e.g. for a local stand-in")
+	gcpCmd.Flags().StringSliceVar(&gcpInstanceGroups, "instance-groups", nil,
+		"unmanaged instance groups to use when --registration-provider=instancegroup, as zone/name, "+
+			"e.g. europe-west1-b/etcd-b,europe-west1-c/etcd-c")
+	gcpCmd.Flags().StringSliceVar(&gcpNEGs, "negs", nil,
+		"zonal network endpoint groups to use when --registration-provider=neg, as zone/name[:port], "+
+			"e.g. europe-west1-b/etcd-b:2379")
+	gcpCmd.Flags().StringVar(&computeEndpoint, "compute-endpoint", "",
+		"override the Compute Engine API endpoint used by the instancegroup and neg registration providers")
+	gcpCmd.Flags().BoolVar(&computeWithoutAuth, "compute-without-auth", false,
+		"don't authenticate with the Compute Engine API used by the instancegroup and neg registration providers")
 }
 
 func gcp(cmd *cobra.Command, args []string) {
 	gcpProvider, err := gcp_provider.NewGCP(&gcp_provider.Config{
-		ProjectID:   gcpProjectID,
-		Environment: gcpEnvironment,
-		Role:        gcpRole,
+		ProjectID:        gcpProjectID,
+		LookupMethod:     gcpLookupMethod,
+		Environment:      gcpEnvironment,
+		Role:             gcpRole,
+		CacheTTL:         gcpCacheTTL,
+		EndpointSelector: createEndpointSelector(),
 	})
 	if err != nil {
 		log.Fatalf("Failed to create GCP provider: %v", err)
 	}
 
-	etcdCluster, err := etcd.New(gcpProvider)
-	if err != nil {
-		log.Fatalf("Failed to create etcd cluster API: %v", err)
+	templates := parseInstanceTemplates()
+	etcdCluster := bootstrapClusters(withInstanceTemplates(gcpProvider, templates), tlsConfig{},
+		gcpRegistrationProviders)
+
+	registrator := createRegistrationProvider(gcpRegistrationProviders, withTemplatedHealthChecks(etcdCluster, templates),
+		templates, initialiseGCPRegistrationProvider)
+	registerInstances(gcpProvider, registrator)
+}
+
+func initialiseGCPRegistrationProvider(name string) registration.Provider {
+	switch name {
+	case "noop":
+		return newNoopRegistrationProvider(name)
+	case "clouddns":
+		checkRequiredFlag(cloudDNSZone, "--clouddns-zone")
+		checkRequiredFlag(cloudDNSHostname, "--dns-hostname")
+
+		projectID := cloudDNSProjectID
+		if projectID == "" {
+			projectID = gcpProjectID
+		}
+		registrator, err := gcp_provider.NewCloudDNSRegistrationProvider(&gcp_provider.CloudDNSRegistrationProviderConfig{
+			ProjectID:             projectID,
+			ManagedZone:           cloudDNSZone,
+			Hostname:              cloudDNSHostname,
+			NodeRecords:           cloudDNSNodeRecords,
+			SRVService:            cloudDNSSRVService,
+			SRVPort:               clientPort,
+			Endpoint:              cloudDNSEndpoint,
+			WithoutAuthentication: cloudDNSWithoutAuth,
+		})
+		if err != nil {
+			log.Fatalf("Failed to create Cloud DNS registration client: %v", err)
+		}
+		log.Info("Using Cloud DNS cloud registration provider")
+		return registrator
+	case "instancegroup":
+		return newBackendRegistrationProvider(gcp_provider.InstanceGroupBackend, gcpInstanceGroups, "--instance-groups")
+	case "neg":
+		return newBackendRegistrationProvider(gcp_provider.NetworkEndpointGroupBackend, gcpNEGs, "--negs")
+	default:
+		log.Fatalf("Unsupported registration type: %v", name)
+		return nil
 	}
-	bootstrapper, err := bootstrap.New(gcpProvider, etcdCluster)
+}
+
+func newBackendRegistrationProvider(backendType gcp_provider.BackendType, entries []string, flag string) registration.Provider {
+	if len(entries) == 0 {
+		log.Fatalf("%s must be provided when using the %s registration provider", flag, backendType)
+	}
+	registrator, err := gcp_provider.NewBackendRegistrationProvider(&gcp_provider.BackendRegistrationProviderConfig{
+		ProjectID:             gcpProjectID,
+		Type:                  backendType,
+		Groups:                parseBackendGroups(entries, flag),
+		Endpoint:              computeEndpoint,
+		WithoutAuthentication: computeWithoutAuth,
+	})
 	if err != nil {
-		log.Fatalf("Failed to create etcd bootstrapper: %v", err)
+		log.Fatalf("Failed to create %s registration client: %v", backendType, err)
 	}
+	log.Infof("Using %s cloud registration provider", backendType)
+	return registrator
+}
 
-	if err := bootstrapper.GenerateEtcdFlagsFile(outputFilename); err != nil {
-		log.Fatalf("Failed to generate etcd flags file: %v", err)
+// parseBackendGroups returns the groups from a list of zone/name[:port] entries.
+func parseBackendGroups(entries []string, flag string) []gcp_provider.BackendGroupConfig {
+	var groups []gcp_provider.BackendGroupConfig
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Fatalf("Invalid %s entry %q, expected zone/name", flag, entry)
+		}
+		group := gcp_provider.BackendGroupConfig{Zone: parts[0], Name: parts[1]}
+		if i := strings.LastIndex(group.Name, ":"); i != -1 {
+			port, err := strconv.ParseInt(group.Name[i+1:], 10, 64)
+			if err != nil {
+				log.Fatalf("Invalid port in %s entry %q: %v", flag, entry, err)
+			}
+			group.Name = group.Name[:i]
+			group.Port = port
+		}
+		groups = append(groups, group)
 	}
+	return groups
 }
 
 func checkGCPParams(cmd *cobra.Command, args []string) {
 	checkRequiredFlag(gcpProjectID, "--project-id")
-	checkRequiredFlag(gcpEnvironment, "--environment")
-	checkRequiredFlag(gcpRole, "--role")
+	switch gcpLookupMethod {
+	case gcp_provider.LabelsLookupMethod:
+		checkRequiredFlag(gcpEnvironment, "--environment")
+		checkRequiredFlag(gcpRole, "--role")
+	case gcp_provider.MIGLookupMethod:
+	default:
+		log.Fatalf("Unsupported cluster lookup method %q", gcpLookupMethod)
+	}
 }
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/bootstrap"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/registration"
+)
+
+// createEndpointSelector returns the selector for the endpoints of instances with several network interfaces, from
+// --network, --network-cidr, --network-interface-index and --ip-family, and their --peer-* equivalents.
+func createEndpointSelector() cloud.EndpointSelector {
+	selector := cloud.EndpointSelector{
+		Network:     networkSelector("--", networkName, networkCIDR, networkInterfaceIndex),
+		PeerNetwork: networkSelector("--peer-", peerNetworkName, peerNetworkCIDR, peerNetworkInterfaceIndex),
+	}
+	if !selector.Network.IsZero() {
+		log.Infof("Selecting instance endpoints matching %s", selector.Network)
+	}
+	if !selector.PeerNetwork.IsZero() {
+		log.Infof("Selecting instance peer endpoints matching %s", selector.PeerNetwork)
+	}
+	return selector
+}
+
+// networkSelector returns a selector from the flags with the given prefix. The family only applies if one of the
+// other flags is set, so that --ip-family alone doesn't enable a separate peer endpoint.
+func networkSelector(flagPrefix, name, cidr string, interfaceIndex int) cloud.NetworkSelector {
+	selector := cloud.NetworkSelector{Network: name}
+	if cidr != "" {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatalf("Invalid %snetwork-cidr: %v", flagPrefix, err)
+		}
+		selector.CIDR = ipNet
+	}
+	if interfaceIndex >= 0 {
+		index := interfaceIndex
+		selector.Index = &index
+	}
+	switch ipFamily {
+	case "", cloud.IPv4, cloud.IPv6, cloud.DualStack:
+	default:
+		log.Fatalf("Unsupported --ip-family: %v", ipFamily)
+	}
+	if flagPrefix == "--" || !selector.IsZero() {
+		selector.Family = ipFamily
+	}
+	return selector
+}
+
+// parseInstanceTemplates returns the --member-name-template and --endpoint-template.
+func parseInstanceTemplates() cloud.InstanceTemplates {
+	templates, err := cloud.ParseInstanceTemplates(memberNameTemplate, endpointTemplate)
+	if err != nil {
+		log.Fatalf("Invalid instance template: %v", err)
+	}
+	if !templates.IsZero() {
+		log.Infof("Templating instance names with %q and endpoints with %q", memberNameTemplate, endpointTemplate)
+	}
+	return templates
+}
+
+// withInstanceTemplates returns the cloudAPI with the templates applied to its instances, for bootstrapping. The
+// registration providers use the untemplated instances, as they need the provider's instance names and IPs, apart from
+// the DNS providers taking the templated member names.
+func withInstanceTemplates(cloudAPI bootstrap.CloudAPI, templates cloud.InstanceTemplates) bootstrap.CloudAPI {
+	if templates.IsZero() {
+		return cloudAPI
+	}
+	return bootstrap.NewTemplatedCloudAPI(cloudAPI, templates)
+}
+
+// withTemplatedHealthChecks returns the checker, checking the health of the untemplated instances by their templated
+// member names if any templates are set.
+func withTemplatedHealthChecks(checker registration.HealthChecker,
+	templates cloud.InstanceTemplates) registration.HealthChecker {
+	if templates.IsZero() {
+		return checker
+	}
+	return registration.NewTemplatedHealthChecker(checker, templates)
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/cloud/noop"
+	"github.com/sky-uk/etcd-bootstrap/registration"
+)
+
+type cloudInstances interface {
+	GetInstances() ([]cloud.Instance, error)
+}
+
+// dnsRegistrationProviders are the registration providers which publish the instances' names in DNS records.
+var dnsRegistrationProviders = map[string]bool{"route53": true, "clouddns": true}
+
+// createRegistrationProvider returns a provider which updates each of the named registration providers, created with
+// newProvider. Out of service instances aren't registered, and only healthy instances are registered if
+// --registration-health-check is set. The DNS providers register the instances by their templated member names.
+func createRegistrationProvider(names []string, checker registration.HealthChecker, templates cloud.InstanceTemplates,
+	newProvider func(name string) registration.Provider) registration.Provider {
+	multi := registration.NewMulti()
+	for _, name := range names {
+		provider := newProvider(name)
+		// DNS records name the members as they're bootstrapped, so they match etcd and the advertise domain.
+		if dnsRegistrationProviders[name] && templates.Name != nil {
+			provider = registration.NewMemberNames(provider, templates)
+		}
+		multi.Add(name, provider)
+	}
+	if registrationHealthCheck {
+		log.Info("Registering only healthy etcd instances")
+		return registration.NewInServiceFilter(registration.NewHealthFilter(multi, checker))
+	}
+	return registration.NewInServiceFilter(multi)
+}
+
+// registerInstances registers the cluster instances with the registration provider.
+func registerInstances(instances cloudInstances, registrator registration.Provider) {
+	clusterInstances, err := instances.GetInstances()
+	if err != nil {
+		log.Fatalf("Failed to retrieve instances: %v", err)
+	}
+	if err := registrator.Update(clusterInstances); err != nil {
+		log.Fatalf("Failed to register etcd cluster data with cloud registration provider: %v", err)
+	}
+}
+
+// newNoopRegistrationProvider is the registration provider factory for clouds which only support noop.
+func newNoopRegistrationProvider(name string) registration.Provider {
+	if name != "noop" {
+		log.Fatalf("Unsupported registration type: %v", name)
+	}
+	log.Info("Using noop cloud registration provider")
+	return noop.RegistrationProvider{}
+}
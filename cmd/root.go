@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/bootstrap"
 	"github.com/spf13/cobra"
 )
 
@@ -34,8 +35,27 @@ var (
 	// injected by "go tool link -X"
 	buildTime string
 
-	debugLogging   bool
-	outputFilename string
+	debugLogging            bool
+	outputFilename          string
+	registrationHealthCheck bool
+
+	networkName           string
+	networkCIDR           string
+	networkInterfaceIndex int
+	ipFamily              string
+
+	peerNetworkName           string
+	peerNetworkCIDR           string
+	peerNetworkInterfaceIndex int
+
+	peerPort        int
+	clientPort      int
+	advertiseDomain string
+	clusterToken    string
+	clusterSpecs    []string
+
+	memberNameTemplate string
+	endpointTemplate   string
 )
 
 func init() {
@@ -45,6 +65,42 @@ func init() {
 		"enable debug logging")
 	RootCmd.PersistentFlags().StringVarP(&outputFilename, "output-file", "o", defaultOutputFilename,
 		"location to write environment variables for etcd to use")
+	RootCmd.PersistentFlags().BoolVar(&registrationHealthCheck, "registration-health-check", false,
+		"only register the etcd instances which are healthy, started members of the cluster")
+	RootCmd.PersistentFlags().StringVar(&networkName, "network", "",
+		"name of the network or subnet of the network interface to use as each instance's endpoint")
+	RootCmd.PersistentFlags().StringVar(&networkCIDR, "network-cidr", "",
+		"CIDR the endpoint of each instance must be within, e.g. 10.1.0.0/16")
+	RootCmd.PersistentFlags().IntVar(&networkInterfaceIndex, "network-interface-index", -1,
+		"index of the network interface to use as each instance's endpoint")
+	RootCmd.PersistentFlags().StringVar(&ipFamily, "ip-family", "",
+		"address family of each instance's endpoint, options are: ipv4, ipv6, dual (an ipv4 endpoint and an "+
+			"additional ipv6 client endpoint)")
+	RootCmd.PersistentFlags().StringVar(&peerNetworkName, "peer-network", "",
+		"name of the network or subnet of the network interface to use as each instance's peer endpoint, "+
+			"defaults to the endpoint")
+	RootCmd.PersistentFlags().StringVar(&peerNetworkCIDR, "peer-network-cidr", "",
+		"CIDR the peer endpoint of each instance must be within")
+	RootCmd.PersistentFlags().IntVar(&peerNetworkInterfaceIndex, "peer-network-interface-index", -1,
+		"index of the network interface to use as each instance's peer endpoint")
+	RootCmd.PersistentFlags().IntVar(&peerPort, "peer-port", bootstrap.DefaultPeerPort,
+		"port etcd listens for peers on")
+	RootCmd.PersistentFlags().IntVar(&clientPort, "client-port", bootstrap.DefaultClientPort,
+		"port etcd listens for clients on")
+	RootCmd.PersistentFlags().StringVar(&advertiseDomain, "advertise-domain", "",
+		"also advertise peer and client URLs with the DNS name <instance name>.<domain> of each instance, "+
+			"which must resolve to its endpoint")
+	RootCmd.PersistentFlags().StringVar(&clusterToken, "cluster-token", "",
+		"initial cluster token, which must be unique to each cluster on the same hosts")
+	RootCmd.PersistentFlags().StringArrayVar(&clusterSpecs, "cluster", nil,
+		"bootstrap several clusters on the same hosts, each given as name:key=value,... with the keys peer-port, "+
+			"client-port, token, output-file, tls-ca, tls-cert, tls-key, tls-peer-ca, tls-peer-cert and tls-peer-key, "+
+			"e.g. events:peer-port=2382,client-port=2381. Can be repeated")
+	RootCmd.PersistentFlags().StringVar(&memberNameTemplate, "member-name-template", "",
+		"Go template of each instance's member name, evaluated against its metadata, e.g. {{.Tags.Name}}")
+	RootCmd.PersistentFlags().StringVar(&endpointTemplate, "endpoint-template", "",
+		"Go template of each instance's endpoint, evaluated against its metadata, e.g. {{.PrivateDNSName}} or "+
+			"{{.Name}}.etcd.internal")
 }
 
 func initLogs() {
@@ -2,11 +2,10 @@ package cmd
 
 import (
 	"os"
+	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/sky-uk/etcd-bootstrap/bootstrap"
 	vmware_provider "github.com/sky-uk/etcd-bootstrap/cloud/vmware"
-	"github.com/sky-uk/etcd-bootstrap/etcd"
 	"github.com/spf13/cobra"
 )
 
@@ -36,6 +35,9 @@ var (
 	vmwareVMName             string
 	vmwareEnvironment        string
 	vmwareRole               string
+	vmwareCacheTTL           time.Duration
+
+	vmwareRegistrationProviders []string
 )
 
 func init() {
@@ -58,6 +60,10 @@ func init() {
 		"value of the 'tags_environment' extra configuration option in vSphere to filter nodes by")
 	vmwareCmd.Flags().StringVar(&vmwareRole, "role", "",
 		"value of the 'tags_role' extra configuration option in vSphere to filter nodes by")
+	vmwareCmd.Flags().DurationVar(&vmwareCacheTTL, "instance-cache-ttl", time.Minute,
+		"how long discovered instances are reused for before querying the vSphere API again")
+	vmwareCmd.Flags().StringSliceVarP(&vmwareRegistrationProviders, "registration-provider", "r", []string{"noop"},
+		"automatic registration providers to use, options are: noop")
 
 	// vmware environment variables
 	vmwarePassword = os.Getenv(vmwarePasswordEnvironmentVariable)
@@ -74,23 +80,20 @@ func vmware(cmd *cobra.Command, args []string) {
 		VMName:            vmwareVMName,
 		Environment:       vmwareEnvironment,
 		Role:              vmwareRole,
+		CacheTTL:          vmwareCacheTTL,
+		EndpointSelector:  createEndpointSelector(),
 	})
 	if err != nil {
 		log.Fatalf("Failed to create VMware provider: %v", err)
 	}
 
-	etcdCluster, err := etcd.New(vmwareProvider)
-	if err != nil {
-		log.Fatalf("Failed to create etcd cluster API: %v", err)
-	}
-	bootstrapper, err := bootstrap.New(vmwareProvider, etcdCluster)
-	if err != nil {
-		log.Fatalf("Failed to create etcd bootstrapper: %v", err)
-	}
+	templates := parseInstanceTemplates()
+	etcdCluster := bootstrapClusters(withInstanceTemplates(vmwareProvider, templates), tlsConfig{},
+		vmwareRegistrationProviders)
 
-	if err := bootstrapper.GenerateEtcdFlagsFile(outputFilename); err != nil {
-		log.Fatalf("Failed to generate etcd flags file: %v", err)
-	}
+	registrator := createRegistrationProvider(vmwareRegistrationProviders,
+		withTemplatedHealthChecks(etcdCluster, templates), templates, newNoopRegistrationProvider)
+	registerInstances(vmwareProvider, registrator)
 }
 
 func checkVMwareParams(cmd *cobra.Command, args []string) {
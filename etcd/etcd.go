@@ -3,12 +3,14 @@ package etcd
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/coreos/etcd/client"
@@ -17,19 +19,25 @@ import (
 	"golang.org/x/net/context"
 )
 
-const timeout = 5 * time.Second
+const (
+	timeout = 5 * time.Second
+	// DefaultClientPort is the default port etcd listens for clients on.
+	DefaultClientPort = 2379
+)
 
 type etcdMembersAPI interface {
 	List(ctx context.Context) ([]client.Member, error)
 	Add(ctx context.Context, peerURL string) (*client.Member, error)
 	Remove(ctx context.Context, mID string) error
+	Update(ctx context.Context, mID string, peerURLs []string) error
 }
 
 // ClusterAPI represents an etcd cluster API.
 type ClusterAPI struct {
-	cloudAPI  CloudAPI
-	protocol  string
-	transport client.CancelableTransport
+	cloudAPI   CloudAPI
+	protocol   string
+	clientPort int
+	transport  client.CancelableTransport
 	// membersAPIClient is the cached API client. Don't use it directly, use list/add/remove instead.
 	membersAPIClient etcdMembersAPI
 }
@@ -42,8 +50,9 @@ type CloudAPI interface {
 
 // Member represents a node in the etcd cluster.
 type Member struct {
-	Name    string
-	PeerURL string
+	Name string
+	// PeerURLs the member is reached on by other members, e.g. both its DNS name and its IP.
+	PeerURLs []string
 }
 
 // Option for New.
@@ -116,12 +125,24 @@ func WithTLS(peerCA, peerCert, peerKey string) Option {
 	}
 }
 
+// WithClientPort sets the port the etcd cluster listens for clients on, rather than DefaultClientPort.
+func WithClientPort(port int) Option {
+	return func(c *ClusterAPI) error {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid client port %d", port)
+		}
+		c.clientPort = port
+		return nil
+	}
+}
+
 // New returns a cluster object for interacting with the etcd cluster API.
 func New(cloudAPI CloudAPI, opts ...Option) (*ClusterAPI, error) {
 	c := &ClusterAPI{
-		cloudAPI:  cloudAPI,
-		protocol:  "http",
-		transport: client.DefaultTransport,
+		cloudAPI:   cloudAPI,
+		protocol:   "http",
+		clientPort: DefaultClientPort,
+		transport:  client.DefaultTransport,
 	}
 	for _, opt := range opts {
 		if err := opt(c); err != nil {
@@ -139,7 +160,8 @@ func (c *ClusterAPI) createEtcdClientConfig() (client.Config, error) {
 
 	var endpoints []string
 	for _, instance := range instances {
-		endpoints = append(endpoints, fmt.Sprintf("%s://%s:2379", c.protocol, instance.Endpoint))
+		endpoints = append(endpoints, fmt.Sprintf("%s://%s", c.protocol,
+			net.JoinHostPort(instance.Endpoint, strconv.Itoa(c.clientPort))))
 	}
 
 	return client.Config{
@@ -187,6 +209,39 @@ func (c *ClusterAPI) remove(ctx context.Context, mID string) error {
 	return api.Remove(ctx, mID)
 }
 
+func (c *ClusterAPI) update(ctx context.Context, mID string, peerURLs []string) error {
+	api, err := c.membersAPI()
+	if err != nil {
+		return err
+	}
+	return api.Update(ctx, mID, peerURLs)
+}
+
+// containsAny returns true if any of the values is in urls.
+func containsAny(urls []string, values []string) bool {
+	for _, value := range values {
+		for _, url := range urls {
+			if url == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameURLs returns true if a and b hold the same URLs, in any order.
+func sameURLs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, url := range a {
+		if !containsAny(b, []string{url}) {
+			return false
+		}
+	}
+	return true
+}
+
 func isTLSError(err error) bool {
 	if cerr, ok := err.(*client.ClusterError); ok {
 		for _, clusterErr := range cerr.Errors {
@@ -219,26 +274,50 @@ func (c *ClusterAPI) Members() ([]Member, error) {
 
 	var members []Member
 	for _, etcdMember := range etcdMembers {
-		if err := assertSinglePeerURL(etcdMember); err != nil {
-			return nil, err
+		if len(etcdMember.PeerURLs) == 0 {
+			return nil, fmt.Errorf("expected at least one peer URL for %s", etcdMember.ID)
 		}
 
 		members = append(members, Member{
-			Name:    etcdMember.Name,
-			PeerURL: etcdMember.PeerURLs[0],
+			Name:     etcdMember.Name,
+			PeerURLs: etcdMember.PeerURLs,
 		})
 	}
 
 	return members, nil
 }
 
-// AddMemberByPeerURL adds a new member to the cluster by its peer URL.
-// etcd bootstraps by requiring the peer URL to be first added. Then the new node informs etcd of its name.
-func (c *ClusterAPI) AddMemberByPeerURL(peerURL string) error {
+// AddMemberByPeerURLs adds a new member to the cluster by its peer URLs.
+// etcd bootstraps by requiring the peer URLs to be first added. Then the new node informs etcd of its name.
+// The members API only adds a member with a single peer URL, so a member with several is updated once added. If a
+// member already has some of the peer URLs, such as when a previous add failed to update it, it's updated instead.
+func (c *ClusterAPI) AddMemberByPeerURLs(peerURLs []string) error {
+	if len(peerURLs) == 0 {
+		return fmt.Errorf("at least one peer URL must be provided")
+	}
 	ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
 	defer cancelFn()
-	_, err := c.add(ctx, peerURL)
-	return err
+	members, err := c.list(ctx)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if !containsAny(member.PeerURLs, peerURLs) {
+			continue
+		}
+		if sameURLs(member.PeerURLs, peerURLs) {
+			log.Infof("%v have already been added", peerURLs)
+			return nil
+		}
+		log.Infof("Updating peer URLs of member %s from %v to %v", member.ID, member.PeerURLs, peerURLs)
+		return c.update(ctx, member.ID, peerURLs)
+	}
+
+	member, err := c.add(ctx, peerURLs[0])
+	if err != nil || len(peerURLs) == 1 {
+		return err
+	}
+	return c.update(ctx, member.ID, peerURLs)
 }
 
 // RemoveMemberByName removes a member of the cluster by its name.
@@ -260,9 +339,78 @@ func (c *ClusterAPI) RemoveMemberByName(name string) error {
 	return nil
 }
 
-func assertSinglePeerURL(member client.Member) error {
-	if len(member.PeerURLs) != 1 {
-		return fmt.Errorf("expected a single peer URL, but found %v for %s", member.PeerURLs, member.ID)
+// UpdateMemberPeerURLs replaces the peer URLs of the member with the given name.
+func (c *ClusterAPI) UpdateMemberPeerURLs(name string, peerURLs []string) error {
+	ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
+	defer cancelFn()
+	members, err := c.list(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		if member.Name == name {
+			return c.update(ctx, member.ID, peerURLs)
+		}
+	}
+
+	return fmt.Errorf("unable to update %s, it is not a member of the cluster", name)
+}
+
+// HealthyInstances returns the instances which are started members of the cluster, and report themselves as healthy
+// on their client URL.
+func (c *ClusterAPI) HealthyInstances(instances []cloud.Instance) ([]cloud.Instance, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
+	defer cancelFn()
+	members, err := c.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Members only have a name once they've started.
+	clientURLs := make(map[string][]string)
+	for _, member := range members {
+		if member.Name != "" {
+			clientURLs[member.Name] = member.ClientURLs
+		}
+	}
+
+	var healthy []cloud.Instance
+	for _, instance := range instances {
+		urls, ok := clientURLs[instance.Name]
+		if !ok {
+			log.Infof("%s is not a started member of the cluster", instance.Name)
+			continue
+		}
+		if err := c.checkHealth(urls); err != nil {
+			log.Infof("%s is unhealthy: %v", instance.Name, err)
+			continue
+		}
+		healthy = append(healthy, instance)
+	}
+	return healthy, nil
+}
+
+// checkHealth checks the member reports itself as healthy on its first client URL.
+func (c *ClusterAPI) checkHealth(clientURLs []string) error {
+	if len(clientURLs) == 0 {
+		return fmt.Errorf("no client URLs")
+	}
+	httpClient := &http.Client{Transport: c.transport, Timeout: timeout}
+	resp, err := httpClient.Get(clientURLs[0] + "/health")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var health struct {
+		Health string `json:"health"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return fmt.Errorf("unable to parse health response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || health.Health != "true" {
+		return fmt.Errorf("%s returned %s with health %q", clientURLs[0], resp.Status, health.Health)
 	}
 	return nil
 }
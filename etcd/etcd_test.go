@@ -4,6 +4,7 @@ import (
 	"crypto/x509"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/coreos/etcd/client"
@@ -44,6 +45,7 @@ var _ = Describe("Etcd client", func() {
 			},
 			MockAdd:    Add{},
 			MockRemove: Remove{},
+			MockUpdate: Update{},
 		}
 	})
 
@@ -55,12 +57,12 @@ var _ = Describe("Etcd client", func() {
 			Expect(err).To(BeNil())
 			Expect(memberList).To(Equal([]Member{
 				{
-					Name:    "test-good-response-name-1",
-					PeerURL: "http://192.168.0.1:2380",
+					Name:     "test-good-response-name-1",
+					PeerURLs: []string{"http://192.168.0.1:2380"},
 				},
 				{
-					Name:    "test-good-response-name-2",
-					PeerURL: "http://192.168.0.2:2380",
+					Name:     "test-good-response-name-2",
+					PeerURLs: []string{"http://192.168.0.2:2380"},
 				},
 			}))
 		})
@@ -88,7 +90,7 @@ var _ = Describe("Etcd client", func() {
 			}
 		})
 
-		It("fails when the etcd members api response contains a member with more than one peer url", func() {
+		It("lists every peer url of a member with more than one", func() {
 			membersAPIClient.MockList.ListOutput = []client.Member{
 				{
 					ID:   "test-complex-response-id-1",
@@ -105,19 +107,80 @@ var _ = Describe("Etcd client", func() {
 			}
 
 			By("Returning an etcd client that returns complex members")
+			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
+			memberList, err := etcdCluster.Members()
+			Expect(err).To(BeNil())
+			Expect(memberList).To(Equal([]Member{
+				{
+					Name:     "test-complex-response-id-1",
+					PeerURLs: []string{"http://192.168.0.1:2380", "http://172.16.0.1:2380"},
+				},
+			}))
+		})
+
+		It("fails when the etcd members api response contains a member without a peer url", func() {
+			membersAPIClient.MockList.ListOutput = []client.Member{{ID: "test-no-peer-url-id-1"}}
+
 			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
 			_, err := etcdCluster.Members()
 			Expect(err).ToNot(BeNil())
 		})
 	})
 
-	Context("AddMemberByPeerURL()", func() {
+	Context("AddMemberByPeerURLs()", func() {
 		It("can add a member when the client doesn't error", func() {
 			membersAPIClient.MockAdd.ExpectedPeerURL = "http://192.168.0.100"
 
 			By("Returning all expected responses")
 			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
-			Expect(etcdCluster.AddMemberByPeerURL("http://192.168.0.100")).To(BeNil())
+			Expect(etcdCluster.AddMemberByPeerURLs([]string{"http://192.168.0.100"})).To(BeNil())
+		})
+
+		It("adds a member by its first peer url and then updates it with all of them", func() {
+			membersAPIClient.MockAdd.ExpectedPeerURL = "http://192.168.0.100:2380"
+			membersAPIClient.MockAdd.AddOutput = &client.Member{ID: "test-added-id"}
+			membersAPIClient.MockUpdate.ExpectedMID = "test-added-id"
+			membersAPIClient.MockUpdate.ExpectedPeerURLs = []string{"http://192.168.0.100:2380", "http://etcd-100:2380"}
+
+			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
+			Expect(etcdCluster.AddMemberByPeerURLs(
+				[]string{"http://192.168.0.100:2380", "http://etcd-100:2380"})).To(BeNil())
+		})
+
+		It("fails without a peer url", func() {
+			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
+			Expect(etcdCluster.AddMemberByPeerURLs(nil)).ToNot(BeNil())
+		})
+
+		It("updates a member which was added with only some of the peer urls", func() {
+			membersAPIClient.MockList.ListOutput = []client.Member{
+				{ID: "test-partial-id", PeerURLs: []string{"http://192.168.0.100:2380"}},
+			}
+			membersAPIClient.MockUpdate.ExpectedMID = "test-partial-id"
+			membersAPIClient.MockUpdate.ExpectedPeerURLs = []string{"http://192.168.0.100:2380", "http://etcd-100:2380"}
+
+			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
+			Expect(etcdCluster.AddMemberByPeerURLs(
+				[]string{"http://192.168.0.100:2380", "http://etcd-100:2380"})).To(BeNil())
+		})
+
+		It("does nothing when a member already has all of the peer urls", func() {
+			membersAPIClient.MockList.ListOutput = []client.Member{
+				{ID: "test-added-id", PeerURLs: []string{"http://etcd-100:2380", "http://192.168.0.100:2380"}},
+			}
+			membersAPIClient.MockAdd.Err = fmt.Errorf("unexpected call to add")
+			membersAPIClient.MockUpdate.Err = fmt.Errorf("unexpected call to update")
+
+			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
+			Expect(etcdCluster.AddMemberByPeerURLs(
+				[]string{"http://192.168.0.100:2380", "http://etcd-100:2380"})).To(BeNil())
+		})
+
+		It("fails when the members can't be listed", func() {
+			membersAPIClient.MockList.Err = fmt.Errorf("failed to list members")
+
+			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
+			Expect(etcdCluster.AddMemberByPeerURLs([]string{"http://192.168.0.100:2380"})).ToNot(BeNil())
 		})
 	})
 
@@ -163,6 +226,71 @@ var _ = Describe("Etcd client", func() {
 		})
 	})
 
+	Context("UpdateMemberPeerURLs()", func() {
+		It("can use the etcd members api client to update a member", func() {
+			membersAPIClient.MockUpdate.ExpectedMID = "test-good-response-id-2"
+			membersAPIClient.MockUpdate.ExpectedPeerURLs = []string{"http://192.168.0.100:2380"}
+
+			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
+			Expect(etcdCluster.UpdateMemberPeerURLs("test-good-response-name-2",
+				[]string{"http://192.168.0.100:2380"})).To(BeNil())
+		})
+
+		It("fails if the member doesn't exist", func() {
+			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
+			Expect(etcdCluster.UpdateMemberPeerURLs("test-missing-name",
+				[]string{"http://192.168.0.100:2380"})).ToNot(BeNil())
+		})
+	})
+
+	Context("HealthyInstances()", func() {
+		var (
+			healthyServer   *httptest.Server
+			unhealthyServer *httptest.Server
+			instances       []cloud.Instance
+		)
+
+		BeforeEach(func() {
+			healthyServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.URL.Path).To(Equal("/health"))
+				fmt.Fprint(w, `{"health": "true"}`)
+			}))
+			unhealthyServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprint(w, `{"health": "false"}`)
+			}))
+			membersAPIClient.MockList.ListOutput = []client.Member{
+				{ID: "id-1", Name: "healthy", ClientURLs: []string{healthyServer.URL}},
+				{ID: "id-2", Name: "unhealthy", ClientURLs: []string{unhealthyServer.URL}},
+				{ID: "id-3", PeerURLs: []string{"http://192.168.0.3:2380"}},
+			}
+			instances = []cloud.Instance{
+				{Name: "healthy", Endpoint: "192.168.0.1"},
+				{Name: "unhealthy", Endpoint: "192.168.0.2"},
+				{Name: "unstarted", Endpoint: "192.168.0.3"},
+			}
+		})
+
+		AfterEach(func() {
+			healthyServer.Close()
+			unhealthyServer.Close()
+		})
+
+		It("returns only the started members which report themselves as healthy", func() {
+			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
+			Expect(etcdCluster.HealthyInstances(instances)).To(Equal([]cloud.Instance{
+				{Name: "healthy", Endpoint: "192.168.0.1"},
+			}))
+		})
+
+		It("fails if it is unable to list members", func() {
+			membersAPIClient.MockList.Err = fmt.Errorf("failed to list members")
+			etcdCluster := &ClusterAPI{membersAPIClient: membersAPIClient}
+			_, err := etcdCluster.HealthyInstances(instances)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
 	Describe("WithTLS()", func() {
 		var (
 			// Created with:
@@ -197,12 +325,26 @@ var _ = Describe("Etcd client", func() {
 		})
 
 		It("adds the correct endponts", func() {
-			cluster := &ClusterAPI{cloudAPI: cloudAPI, protocol: "pigeon"}
+			cluster := &ClusterAPI{cloudAPI: cloudAPI, protocol: "pigeon", clientPort: DefaultClientPort}
 			conf, err := cluster.createEtcdClientConfig()
 			Expect(err).To(BeNil())
 			Expect(conf.Endpoints).To(ContainElement("pigeon://etcd-1:2379"))
 		})
 
+		It("uses the configured client port and brackets IPv6 endpoints", func() {
+			cloudAPI = &mockCloudAPI{instances: []cloud.Instance{{Name: "i-123", Endpoint: "fd00::1"}}}
+			cluster, err := New(cloudAPI, WithClientPort(4001))
+			Expect(err).To(BeNil())
+			conf, err := cluster.createEtcdClientConfig()
+			Expect(err).To(BeNil())
+			Expect(conf.Endpoints).To(Equal([]string{"http://[fd00::1]:4001"}))
+		})
+
+		It("fails with an invalid client port", func() {
+			_, err := New(cloudAPI, WithClientPort(0))
+			Expect(err).ToNot(BeNil())
+		})
+
 		It("sets the configured transport", func() {
 			transport := client.DefaultTransport
 			cluster := &ClusterAPI{cloudAPI: cloudAPI, transport: transport}
@@ -218,6 +360,7 @@ type MockMembersAPI struct {
 	MockList   List
 	MockAdd    Add
 	MockRemove Remove
+	MockUpdate Update
 }
 
 // List sets the expected input and output for List() on EtcdMembersAPI
@@ -264,6 +407,21 @@ func (t MockMembersAPI) Remove(ctx context.Context, mID string) error {
 	return t.MockRemove.Err
 }
 
+// Update sets the expected input and output for Update() on EtcdMembersAPI
+type Update struct {
+	ExpectedMID      string
+	ExpectedPeerURLs []string
+	Err              error
+}
+
+// Update mocks the coreos etcd client
+func (t MockMembersAPI) Update(ctx context.Context, mID string, peerURLs []string) error {
+	expectContextToHaveDeadline(ctx)
+	Expect(mID).To(Equal(t.MockUpdate.ExpectedMID))
+	Expect(peerURLs).To(Equal(t.MockUpdate.ExpectedPeerURLs))
+	return t.MockUpdate.Err
+}
+
 type mockCloudAPI struct {
 	instances []cloud.Instance
 }
@@ -13,6 +13,7 @@ import (
 type AWSASGClient struct {
 	MockDescribeAutoScalingInstances DescribeAutoScalingInstances
 	MockDescribeAutoScalingGroups    DescribeAutoScalingGroups
+	MockDescribeASGTags              DescribeASGTags
 }
 
 // DescribeAutoScalingInstances sets the expected input and output for DescribeAutoScalingInstances() on AWSASGClient
@@ -41,9 +42,27 @@ func (t AWSASGClient) DescribeAutoScalingGroups(a *autoscaling.DescribeAutoScali
 	return t.MockDescribeAutoScalingGroups.DescribeAutoScalingGroupsOutput, t.MockDescribeAutoScalingGroups.Err
 }
 
+// DescribeASGTags sets the expected input and output for DescribeTags() on AWSASGClient
+type DescribeASGTags struct {
+	ExpectedInput      *autoscaling.DescribeTagsInput
+	DescribeTagsOutput *autoscaling.DescribeTagsOutput
+	Err                error
+}
+
+// DescribeTags mocks the aws autoscaling group client
+func (t AWSASGClient) DescribeTags(a *autoscaling.DescribeTagsInput) (*autoscaling.DescribeTagsOutput, error) {
+	gomega.Expect(a).To(gomega.Equal(t.MockDescribeASGTags.ExpectedInput))
+	return t.MockDescribeASGTags.DescribeTagsOutput, t.MockDescribeASGTags.Err
+}
+
 // AWSEC2Client for mocking calls to the aws ec2 client
 type AWSEC2Client struct {
-	MockDescribeInstances DescribeInstances
+	MockDescribeInstances         DescribeInstances
+	MockDescribeNetworkInterfaces DescribeNetworkInterfaces
+	MockAttachNetworkInterface    AttachNetworkInterface
+	MockCreateTags                CreateTags
+	MockDescribeVolumes           DescribeVolumes
+	MockAttachVolume              AttachVolume
 }
 
 // DescribeInstances sets the expected input and output for DescribeInstances() on AWSEC2Client
@@ -59,10 +78,77 @@ func (t AWSEC2Client) DescribeInstances(e *ec2.DescribeInstancesInput) (*ec2.Des
 	return t.MockDescribeInstances.DescribeInstancesOutput, t.MockDescribeInstances.Err
 }
 
+// DescribeNetworkInterfaces sets the expected input and output for DescribeNetworkInterfaces() on AWSEC2Client
+type DescribeNetworkInterfaces struct {
+	ExpectedInput                   *ec2.DescribeNetworkInterfacesInput
+	DescribeNetworkInterfacesOutput *ec2.DescribeNetworkInterfacesOutput
+	Err                             error
+}
+
+// DescribeNetworkInterfaces mocks the aws ec2 client
+func (t AWSEC2Client) DescribeNetworkInterfaces(e *ec2.DescribeNetworkInterfacesInput) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	gomega.Expect(e).To(gomega.Equal(t.MockDescribeNetworkInterfaces.ExpectedInput))
+	return t.MockDescribeNetworkInterfaces.DescribeNetworkInterfacesOutput, t.MockDescribeNetworkInterfaces.Err
+}
+
+// AttachNetworkInterface sets the expected input and output for AttachNetworkInterface() on AWSEC2Client
+type AttachNetworkInterface struct {
+	ExpectedInput                *ec2.AttachNetworkInterfaceInput
+	AttachNetworkInterfaceOutput *ec2.AttachNetworkInterfaceOutput
+	Err                          error
+}
+
+// AttachNetworkInterface mocks the aws ec2 client
+func (t AWSEC2Client) AttachNetworkInterface(e *ec2.AttachNetworkInterfaceInput) (*ec2.AttachNetworkInterfaceOutput, error) {
+	gomega.Expect(e).To(gomega.Equal(t.MockAttachNetworkInterface.ExpectedInput))
+	return t.MockAttachNetworkInterface.AttachNetworkInterfaceOutput, t.MockAttachNetworkInterface.Err
+}
+
+// CreateTags sets the expected input and output for CreateTags() on AWSEC2Client
+type CreateTags struct {
+	ExpectedInput    *ec2.CreateTagsInput
+	CreateTagsOutput *ec2.CreateTagsOutput
+	Err              error
+}
+
+// CreateTags mocks the aws ec2 client
+func (t AWSEC2Client) CreateTags(e *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	gomega.Expect(e).To(gomega.Equal(t.MockCreateTags.ExpectedInput))
+	return t.MockCreateTags.CreateTagsOutput, t.MockCreateTags.Err
+}
+
+// DescribeVolumes sets the expected input and output for DescribeVolumes() on AWSEC2Client
+type DescribeVolumes struct {
+	ExpectedInput         *ec2.DescribeVolumesInput
+	DescribeVolumesOutput *ec2.DescribeVolumesOutput
+	Err                   error
+}
+
+// DescribeVolumes mocks the aws ec2 client
+func (t AWSEC2Client) DescribeVolumes(e *ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error) {
+	gomega.Expect(e).To(gomega.Equal(t.MockDescribeVolumes.ExpectedInput))
+	return t.MockDescribeVolumes.DescribeVolumesOutput, t.MockDescribeVolumes.Err
+}
+
+// AttachVolume sets the expected input and output for AttachVolume() on AWSEC2Client
+type AttachVolume struct {
+	ExpectedInput      *ec2.AttachVolumeInput
+	AttachVolumeOutput *ec2.VolumeAttachment
+	Err                error
+}
+
+// AttachVolume mocks the aws ec2 client
+func (t AWSEC2Client) AttachVolume(e *ec2.AttachVolumeInput) (*ec2.VolumeAttachment, error) {
+	gomega.Expect(e).To(gomega.Equal(t.MockAttachVolume.ExpectedInput))
+	return t.MockAttachVolume.AttachVolumeOutput, t.MockAttachVolume.Err
+}
+
 // AWSELBClient for mocking calls to the aws elb client
 type AWSELBClient struct {
 	MockDescribeTargetGroups DescribeTargetGroups
 	MockRegisterTargets      RegisterTargets
+	MockDeregisterTargets    DeregisterTargets
+	MockDescribeTargetHealth DescribeTargetHealth
 }
 
 // DescribeTargetGroups sets the expected input and output for DescribeTargetGroups() on AWSELBClient
@@ -91,10 +177,39 @@ func (t AWSELBClient) RegisterTargets(e *elbv2.RegisterTargetsInput) (*elbv2.Reg
 	return t.MockRegisterTargets.RegisterTargetsOutput, t.MockRegisterTargets.Err
 }
 
+// DeregisterTargets sets the expected input and output for DeregisterTargets() on AWSELBClient
+type DeregisterTargets struct {
+	ExpectedInput           *elbv2.DeregisterTargetsInput
+	DeregisterTargetsOutput *elbv2.DeregisterTargetsOutput
+	Err                     error
+}
+
+// DeregisterTargets mocks the aws elb client
+func (t AWSELBClient) DeregisterTargets(e *elbv2.DeregisterTargetsInput) (*elbv2.DeregisterTargetsOutput, error) {
+	gomega.Expect(e).To(gomega.Equal(t.MockDeregisterTargets.ExpectedInput))
+	return t.MockDeregisterTargets.DeregisterTargetsOutput, t.MockDeregisterTargets.Err
+}
+
+// DescribeTargetHealth sets the expected input and output for DescribeTargetHealth() on AWSELBClient
+type DescribeTargetHealth struct {
+	ExpectedInput              *elbv2.DescribeTargetHealthInput
+	DescribeTargetHealthOutput *elbv2.DescribeTargetHealthOutput
+	Err                        error
+}
+
+// DescribeTargetHealth mocks the aws elb client
+func (t AWSELBClient) DescribeTargetHealth(e *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+	gomega.Expect(e).To(gomega.Equal(t.MockDescribeTargetHealth.ExpectedInput))
+	return t.MockDescribeTargetHealth.DescribeTargetHealthOutput, t.MockDescribeTargetHealth.Err
+}
+
 // AWSR53Client for mocking calls to the aws route53 client
 type AWSR53Client struct {
 	MockGetHostedZone            GetHostedZone
 	MockChangeResourceRecordSets ChangeResourceRecordSets
+	MockListResourceRecordSets   ListResourceRecordSets
+	MockGetChange                GetChange
+	MockListHostedZonesByName    ListHostedZonesByName
 }
 
 // GetHostedZone sets the expected input and output for GetHostedZone() on AWSR53Client
@@ -122,3 +237,42 @@ func (t AWSR53Client) ChangeResourceRecordSets(r *route53.ChangeResourceRecordSe
 	gomega.Expect(r).To(gomega.Equal(t.MockChangeResourceRecordSets.ExpectedInput))
 	return t.MockChangeResourceRecordSets.ChangeResourceRecordSetsOutput, t.MockChangeResourceRecordSets.Err
 }
+
+// ListResourceRecordSets sets the expected input and output for ListResourceRecordSets() on AWSR53Client
+type ListResourceRecordSets struct {
+	ExpectedInput                *route53.ListResourceRecordSetsInput
+	ListResourceRecordSetsOutput *route53.ListResourceRecordSetsOutput
+	Err                          error
+}
+
+// ListResourceRecordSets mocks the aws route53 client
+func (t AWSR53Client) ListResourceRecordSets(r *route53.ListResourceRecordSetsInput) (*route53.ListResourceRecordSetsOutput, error) {
+	gomega.Expect(r).To(gomega.Equal(t.MockListResourceRecordSets.ExpectedInput))
+	return t.MockListResourceRecordSets.ListResourceRecordSetsOutput, t.MockListResourceRecordSets.Err
+}
+
+// GetChange sets the expected input and output for GetChange() on AWSR53Client
+type GetChange struct {
+	ExpectedInput   *route53.GetChangeInput
+	GetChangeOutput *route53.GetChangeOutput
+	Err             error
+}
+
+// GetChange mocks the aws route53 client
+func (t AWSR53Client) GetChange(r *route53.GetChangeInput) (*route53.GetChangeOutput, error) {
+	gomega.Expect(r).To(gomega.Equal(t.MockGetChange.ExpectedInput))
+	return t.MockGetChange.GetChangeOutput, t.MockGetChange.Err
+}
+
+// ListHostedZonesByName sets the expected input and output for ListHostedZonesByName() on AWSR53Client
+type ListHostedZonesByName struct {
+	ExpectedInput               *route53.ListHostedZonesByNameInput
+	ListHostedZonesByNameOutput *route53.ListHostedZonesByNameOutput
+	Err                         error
+}
+
+// ListHostedZonesByName mocks the aws route53 client
+func (t AWSR53Client) ListHostedZonesByName(r *route53.ListHostedZonesByNameInput) (*route53.ListHostedZonesByNameOutput, error) {
+	gomega.Expect(r).To(gomega.Equal(t.MockListHostedZonesByName.ExpectedInput))
+	return t.MockListHostedZonesByName.ListHostedZonesByNameOutput, t.MockListHostedZonesByName.Err
+}
@@ -0,0 +1,172 @@
+// Package dnsrecords is the layout of the DNS records published for the etcd instances, shared by the DNS registration
+// providers so they publish the same records.
+package dnsrecords
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+)
+
+const (
+	// TTL of the records. Completely arbitrary amount that is not too long or too short.
+	TTL = 300
+	// DefaultSRVPort is the port published in SRV records, which is the default etcd client port.
+	DefaultSRVPort = 2379
+	// TXTNamePrefix is the RFC1464 attribute holding the member name, as used by the SRV lookup method.
+	TXTNamePrefix = "name="
+)
+
+// Record types of the layout.
+const (
+	TypeA    = "A"
+	TypeAAAA = "AAAA"
+	TypeTXT  = "TXT"
+	TypeSRV  = "SRV"
+)
+
+// RecordSet is the values of the records with the same name and type.
+type RecordSet struct {
+	Name   string
+	Type   string
+	Values []string
+}
+
+// Key identifies the record set by its name and type.
+func (r RecordSet) Key() string {
+	return r.Name + "/" + r.Type
+}
+
+// Layout is the records published under a hostname. The hostname has round robin A and AAAA records of the instances.
+// With node records, each node has its own A, AAAA and TXT records under the hostname, and an SRV record lists them.
+// This is the layout expected by the SRV instance lookup method.
+type Layout struct {
+	// NodeRecords publishes the per node and SRV records.
+	NodeRecords bool
+	// SRVService is the service of the SRV record.
+	SRVService string
+	// SRVPort is the port of the SRV record targets, which should be the etcd client port. Defaults to 2379.
+	SRVPort int
+}
+
+// RecordSets returns the record sets of the instances under fqdn, with the round robin A record first. An address
+// record without addresses isn't returned, unless there are no addresses at all, in which case an empty round robin A
+// record is. It fails if an address isn't an IP address, such as a hostname.
+func (l Layout) RecordSets(fqdn string, instances []cloud.Instance) ([]RecordSet, error) {
+	var addresses []string
+	for _, instance := range instances {
+		addresses = append(addresses, instance.ClientAddresses()...)
+	}
+	recordSets, err := addressRecordSets(fqdn, addresses)
+	if err != nil {
+		return nil, err
+	}
+	if len(recordSets) == 0 {
+		recordSets = []RecordSet{{Name: fqdn, Type: TypeA}}
+	}
+	if !l.NodeRecords {
+		return recordSets, nil
+	}
+
+	srvPort := l.SRVPort
+	if srvPort == 0 {
+		srvPort = DefaultSRVPort
+	}
+	srv := RecordSet{Name: fmt.Sprintf("_%s._tcp.%s", l.SRVService, fqdn), Type: TypeSRV}
+	for _, instance := range instances {
+		nodeName := instance.Name + "." + fqdn
+		nodeRecordSets, err := addressRecordSets(nodeName, instance.ClientAddresses())
+		if err != nil {
+			return nil, err
+		}
+		recordSets = append(recordSets, nodeRecordSets...)
+		recordSets = append(recordSets, RecordSet{
+			Name:   nodeName,
+			Type:   TypeTXT,
+			Values: []string{fmt.Sprintf("%q", TXTNamePrefix+instance.Name)},
+		})
+		srv.Values = append(srv.Values, fmt.Sprintf("0 0 %d %s", srvPort, nodeName))
+	}
+	return append(recordSets, srv), nil
+}
+
+// addressRecordSets returns an A record of the IPv4 addresses and an AAAA record of the IPv6 addresses, if there are
+// any of each.
+func addressRecordSets(name string, addresses []string) ([]RecordSet, error) {
+	a := RecordSet{Name: name, Type: TypeA}
+	aaaa := RecordSet{Name: name, Type: TypeAAAA}
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("unable to publish %q in the address records of %q as it isn't an IP address",
+				address, name)
+		}
+		if ip.To4() == nil {
+			aaaa.Values = append(aaaa.Values, address)
+		} else {
+			a.Values = append(a.Values, address)
+		}
+	}
+	var recordSets []RecordSet
+	for _, recordSet := range []RecordSet{a, aaaa} {
+		if len(recordSet.Values) > 0 {
+			recordSets = append(recordSets, recordSet)
+		}
+	}
+	return recordSets, nil
+}
+
+// Stale returns the indexes of the existing record sets which belong to the layout under fqdn, but aren't desired.
+// These are the round robin record of an address family without addresses, and with node records, the records of
+// removed nodes and of an address family a node no longer has an address of. Only names with a TXT record holding a
+// member name are considered nodes, so other records under fqdn are left alone.
+func (l Layout) Stale(fqdn string, existing, desired []RecordSet) []int {
+	desiredKeys := make(map[string]bool)
+	for _, recordSet := range desired {
+		desiredKeys[recordSet.Key()] = true
+	}
+	nodeNames := make(map[string]bool)
+	if l.NodeRecords {
+		for _, recordSet := range existing {
+			if recordSet.Type == TypeTXT && isNodeName(fqdn, recordSet.Name) && hasMemberName(recordSet.Values) {
+				nodeNames[recordSet.Name] = true
+			}
+		}
+	}
+
+	var stale []int
+	for i, recordSet := range existing {
+		if !desiredKeys[recordSet.Key()] && isManaged(fqdn, recordSet, nodeNames) {
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
+
+// isManaged returns true if the record set is a round robin address record, or a record of one of the nodes.
+func isManaged(fqdn string, recordSet RecordSet, nodeNames map[string]bool) bool {
+	switch recordSet.Type {
+	case TypeA, TypeAAAA:
+		return recordSet.Name == fqdn || nodeNames[recordSet.Name]
+	case TypeTXT:
+		return nodeNames[recordSet.Name]
+	default:
+		return false
+	}
+}
+
+// isNodeName returns true if name is directly under fqdn.
+func isNodeName(fqdn, name string) bool {
+	return strings.HasSuffix(name, "."+fqdn) && !strings.Contains(strings.TrimSuffix(name, "."+fqdn), ".")
+}
+
+func hasMemberName(values []string) bool {
+	for _, value := range values {
+		if strings.HasPrefix(strings.Trim(value, `"`), TXTNamePrefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package dnsrecords
+
+import (
+	"testing"
+
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// TestDNSRecords to register the test suite
+func TestDNSRecords(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "DNS Records")
+}
+
+const fqdn = "etcd.example.com."
+
+var _ = Describe("DNS record layout", func() {
+	var instances []cloud.Instance
+
+	BeforeEach(func() {
+		instances = []cloud.Instance{
+			{Name: "etcd-1", Endpoint: "192.168.0.1"},
+			{Name: "etcd-2", Endpoint: "192.168.0.2", AdditionalEndpoints: []string{"fd00::2"}},
+		}
+	})
+
+	It("publishes the round robin A and AAAA records", func() {
+		Expect(Layout{}.RecordSets(fqdn, instances)).To(Equal([]RecordSet{
+			{Name: fqdn, Type: TypeA, Values: []string{"192.168.0.1", "192.168.0.2"}},
+			{Name: fqdn, Type: TypeAAAA, Values: []string{"fd00::2"}},
+		}))
+	})
+
+	It("publishes an empty A record without any addresses", func() {
+		Expect(Layout{}.RecordSets(fqdn, nil)).To(Equal([]RecordSet{{Name: fqdn, Type: TypeA}}))
+	})
+
+	It("publishes the node and SRV records", func() {
+		layout := Layout{NodeRecords: true, SRVService: "etcd-bootstrap"}
+		Expect(layout.RecordSets(fqdn, instances)).To(Equal([]RecordSet{
+			{Name: fqdn, Type: TypeA, Values: []string{"192.168.0.1", "192.168.0.2"}},
+			{Name: fqdn, Type: TypeAAAA, Values: []string{"fd00::2"}},
+			{Name: "etcd-1." + fqdn, Type: TypeA, Values: []string{"192.168.0.1"}},
+			{Name: "etcd-1." + fqdn, Type: TypeTXT, Values: []string{`"name=etcd-1"`}},
+			{Name: "etcd-2." + fqdn, Type: TypeA, Values: []string{"192.168.0.2"}},
+			{Name: "etcd-2." + fqdn, Type: TypeAAAA, Values: []string{"fd00::2"}},
+			{Name: "etcd-2." + fqdn, Type: TypeTXT, Values: []string{`"name=etcd-2"`}},
+			{Name: "_etcd-bootstrap._tcp." + fqdn, Type: TypeSRV,
+				Values: []string{"0 0 2379 etcd-1." + fqdn, "0 0 2379 etcd-2." + fqdn}},
+		}))
+
+		layout.SRVPort = 4001
+		recordSets, err := layout.RecordSets(fqdn, instances)
+		Expect(err).To(BeNil())
+		Expect(recordSets[len(recordSets)-1].Values).To(Equal(
+			[]string{"0 0 4001 etcd-1." + fqdn, "0 0 4001 etcd-2." + fqdn}))
+	})
+
+	It("fails when an address isn't an IP address", func() {
+		instances[1].Endpoint = "etcd-2.example.com"
+		_, err := Layout{}.RecordSets(fqdn, instances)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("finds the stale round robin records", func() {
+		existing := []RecordSet{
+			{Name: fqdn, Type: TypeA, Values: []string{"192.168.0.1"}},
+			{Name: fqdn, Type: TypeAAAA, Values: []string{"fd00::1"}},
+			{Name: fqdn, Type: TypeTXT, Values: []string{`"hello"`}},
+			{Name: "etcd-1." + fqdn, Type: TypeA, Values: []string{"192.168.0.1"}},
+			{Name: "etcd-1." + fqdn, Type: TypeTXT, Values: []string{`"name=etcd-1"`}},
+		}
+		desired := []RecordSet{{Name: fqdn, Type: TypeA, Values: []string{"192.168.0.1"}}}
+		Expect(Layout{}.Stale(fqdn, existing, desired)).To(Equal([]int{1}))
+	})
+
+	It("finds the stale records of nodes with a member name", func() {
+		existing := []RecordSet{
+			{Name: fqdn, Type: TypeA, Values: []string{"192.168.0.1"}},
+			{Name: "etcd-1." + fqdn, Type: TypeA, Values: []string{"192.168.0.1"}},
+			{Name: "etcd-1." + fqdn, Type: TypeTXT, Values: []string{`"name=etcd-1"`}},
+			{Name: "removed." + fqdn, Type: TypeA, Values: []string{"192.168.0.9"}},
+			{Name: "removed." + fqdn, Type: TypeAAAA, Values: []string{"fd00::9"}},
+			{Name: "removed." + fqdn, Type: TypeTXT, Values: []string{`"name=removed"`}},
+			{Name: "unrelated." + fqdn, Type: TypeA, Values: []string{"192.168.1.1"}},
+			{Name: "unrelated." + fqdn, Type: TypeTXT, Values: []string{`"hello"`}},
+			{Name: "nested.removed." + fqdn, Type: TypeTXT, Values: []string{`"name=nested"`}},
+		}
+		desired := []RecordSet{
+			{Name: fqdn, Type: TypeAAAA, Values: []string{"fd00::1"}},
+			{Name: "etcd-1." + fqdn, Type: TypeAAAA, Values: []string{"fd00::1"}},
+			{Name: "etcd-1." + fqdn, Type: TypeTXT, Values: []string{`"name=etcd-1"`}},
+		}
+		Expect(Layout{NodeRecords: true}.Stale(fqdn, existing, desired)).To(Equal([]int{0, 1, 3, 4, 5}))
+		Expect(Layout{}.Stale(fqdn, existing, desired)).To(Equal([]int{0}))
+	})
+})
@@ -0,0 +1,190 @@
+package registration
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+)
+
+// Provider registers the etcd cluster instances with a cloud service, such as DNS or a load balancer.
+type Provider interface {
+	// Update sets the instances registered with the cloud service.
+	Update(instances []cloud.Instance) error
+}
+
+// HealthChecker checks the health of the etcd cluster instances.
+type HealthChecker interface {
+	// HealthyInstances returns the instances which are healthy members of the etcd cluster.
+	HealthyInstances(instances []cloud.Instance) ([]cloud.Instance, error)
+}
+
+// HealthFilter is a Provider which only registers the healthy instances with another Provider.
+type HealthFilter struct {
+	provider Provider
+	checker  HealthChecker
+}
+
+// NewHealthFilter returns a HealthFilter which registers the instances found healthy by the checker with the provider.
+func NewHealthFilter(provider Provider, checker HealthChecker) *HealthFilter {
+	return &HealthFilter{
+		provider: provider,
+		checker:  checker,
+	}
+}
+
+// Update registers the healthy instances. If none of the instances are healthy, or their health can't be checked,
+// nothing is registered so the previously registered instances are kept. Failing to check their health is returned as
+// an error.
+func (h *HealthFilter) Update(instances []cloud.Instance) error {
+	healthy, err := h.checker.HealthyInstances(instances)
+	if err != nil {
+		return fmt.Errorf("unable to check the health of the etcd instances, keeping the previously registered "+
+			"instances: %w", err)
+	}
+	if len(healthy) == 0 {
+		log.Warnf("None of the etcd instances are healthy, keeping the previously registered instances")
+		return nil
+	}
+	log.Infof("Registering the %d of %d etcd instances which are healthy", len(healthy), len(instances))
+	return h.provider.Update(healthy)
+}
+
+// InServiceFilter is a Provider which doesn't register out of service instances, such as ASG instances in Standby or
+// stopped instances, with another Provider.
+type InServiceFilter struct {
+	provider Provider
+}
+
+// NewInServiceFilter returns an InServiceFilter which registers the instances in service with the provider.
+func NewInServiceFilter(provider Provider) *InServiceFilter {
+	return &InServiceFilter{provider: provider}
+}
+
+// Update registers the instances which aren't out of service. If all of the instances are out of service, nothing is
+// registered so the previously registered instances are kept.
+func (f *InServiceFilter) Update(instances []cloud.Instance) error {
+	var inService []cloud.Instance
+	for _, instance := range instances {
+		if instance.OutOfService() {
+			log.Infof("Not registering %s, it's %s", instance.Name, instance.State)
+			continue
+		}
+		inService = append(inService, instance)
+	}
+	if len(instances) > 0 && len(inService) == 0 {
+		log.Warnf("All of the etcd instances are out of service, keeping the previously registered instances")
+		return nil
+	}
+	return f.provider.Update(inService)
+}
+
+// TemplatedHealthChecker checks the health of instances by the members they're bootstrapped as, after the member name
+// and endpoint templates are applied, while the instances themselves are registered with their provider's identity.
+type TemplatedHealthChecker struct {
+	checker   HealthChecker
+	templates cloud.InstanceTemplates
+}
+
+// NewTemplatedHealthChecker returns a TemplatedHealthChecker which applies templates to the instances before checking
+// them with checker.
+func NewTemplatedHealthChecker(checker HealthChecker, templates cloud.InstanceTemplates) *TemplatedHealthChecker {
+	return &TemplatedHealthChecker{
+		checker:   checker,
+		templates: templates,
+	}
+}
+
+// HealthyInstances returns the untemplated instances whose templated members are healthy.
+func (t *TemplatedHealthChecker) HealthyInstances(instances []cloud.Instance) ([]cloud.Instance, error) {
+	var templated []cloud.Instance
+	for _, instance := range instances {
+		member, err := t.templates.Apply(instance)
+		if err != nil {
+			return nil, err
+		}
+		templated = append(templated, member)
+	}
+	healthyMembers, err := t.checker.HealthyInstances(templated)
+	if err != nil {
+		return nil, err
+	}
+	healthyNames := make(map[string]bool)
+	for _, member := range healthyMembers {
+		healthyNames[member.Name] = true
+	}
+	var healthy []cloud.Instance
+	for i, instance := range instances {
+		if healthyNames[templated[i].Name] {
+			healthy = append(healthy, instance)
+		}
+	}
+	return healthy, nil
+}
+
+// MemberNames is a Provider which registers instances with another Provider by the member names they're bootstrapped
+// as, after the member name template is applied. Their addresses are left alone, so DNS providers publish the member
+// names used by etcd and the advertise domain, along with the instances' IPs.
+type MemberNames struct {
+	provider  Provider
+	templates cloud.InstanceTemplates
+}
+
+// NewMemberNames returns a MemberNames which applies the member name template of templates to the instances before
+// registering them with provider.
+func NewMemberNames(provider Provider, templates cloud.InstanceTemplates) *MemberNames {
+	return &MemberNames{
+		provider:  provider,
+		templates: cloud.InstanceTemplates{Name: templates.Name},
+	}
+}
+
+// Update registers the instances by their member names.
+func (m *MemberNames) Update(instances []cloud.Instance) error {
+	var named []cloud.Instance
+	for _, instance := range instances {
+		member, err := m.templates.Apply(instance)
+		if err != nil {
+			return err
+		}
+		named = append(named, member)
+	}
+	return m.provider.Update(named)
+}
+
+// Multi is a Provider which updates each of its providers independently, so a failure of one provider doesn't
+// prevent the others from being updated.
+type Multi struct {
+	names     []string
+	providers []Provider
+}
+
+// NewMulti returns an empty Multi.
+func NewMulti() *Multi {
+	return &Multi{}
+}
+
+// Add adds a provider, identified by name in the logs and errors.
+func (m *Multi) Add(name string, provider Provider) {
+	m.names = append(m.names, name)
+	m.providers = append(m.providers, provider)
+}
+
+// Update updates every provider. If any fail, it returns an error describing each of the failures.
+func (m *Multi) Update(instances []cloud.Instance) error {
+	var failures []string
+	for i, provider := range m.providers {
+		if err := provider.Update(instances); err != nil {
+			log.Errorf("Failed to update %s registration provider: %v", m.names[i], err)
+			failures = append(failures, fmt.Sprintf("%s: %v", m.names[i], err))
+			continue
+		}
+		log.Infof("Updated %s registration provider", m.names[i])
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d registration providers failed: %s", len(failures), len(m.providers),
+			strings.Join(failures, "; "))
+	}
+	return nil
+}
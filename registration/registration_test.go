@@ -0,0 +1,236 @@
+package registration
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sky-uk/etcd-bootstrap/cloud"
+	"github.com/sky-uk/etcd-bootstrap/registration/dnsrecords"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// TestRegistration to register the test suite
+func TestRegistration(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Registration")
+}
+
+var _ = Describe("Health filter", func() {
+	var (
+		provider  *mockProvider
+		checker   *mockHealthChecker
+		instances []cloud.Instance
+	)
+
+	BeforeEach(func() {
+		instances = []cloud.Instance{
+			{Name: "etcd-1", Endpoint: "192.168.0.1"},
+			{Name: "etcd-2", Endpoint: "192.168.0.2"},
+		}
+		provider = &mockProvider{}
+		checker = &mockHealthChecker{healthy: instances[:1]}
+	})
+
+	It("registers only the healthy instances", func() {
+		Expect(NewHealthFilter(provider, checker).Update(instances)).To(Succeed())
+		Expect(checker.checked).To(Equal(instances))
+		Expect(provider.updates).To(Equal([][]cloud.Instance{instances[:1]}))
+	})
+
+	It("keeps the previous instances when none are healthy", func() {
+		checker.healthy = nil
+		Expect(NewHealthFilter(provider, checker).Update(instances)).To(Succeed())
+		Expect(provider.updates).To(BeEmpty())
+	})
+
+	It("keeps the previous instances when health can't be checked", func() {
+		checker.err = fmt.Errorf("failed to list members")
+		Expect(NewHealthFilter(provider, checker).Update(instances)).ToNot(Succeed())
+		Expect(provider.updates).To(BeEmpty())
+	})
+
+	It("fails when the provider fails", func() {
+		provider.err = fmt.Errorf("failed to update")
+		Expect(NewHealthFilter(provider, checker).Update(instances)).ToNot(Succeed())
+	})
+})
+
+var _ = Describe("In service filter", func() {
+	var (
+		provider  *mockProvider
+		instances []cloud.Instance
+	)
+
+	BeforeEach(func() {
+		instances = []cloud.Instance{
+			{Name: "etcd-1", Endpoint: "192.168.0.1", State: cloud.StateRunning},
+			{Name: "etcd-2", Endpoint: "192.168.0.2", State: cloud.StateStandby},
+			{Name: "etcd-3", Endpoint: "192.168.0.3", State: cloud.StateStopped},
+			{Name: "etcd-4", Endpoint: "192.168.0.4"},
+		}
+		provider = &mockProvider{}
+	})
+
+	It("registers only the instances in service", func() {
+		Expect(NewInServiceFilter(provider).Update(instances)).To(Succeed())
+		Expect(provider.updates).To(Equal([][]cloud.Instance{{instances[0], instances[3]}}))
+	})
+
+	It("keeps the previous instances when all are out of service", func() {
+		Expect(NewInServiceFilter(provider).Update(instances[1:3])).To(Succeed())
+		Expect(provider.updates).To(BeEmpty())
+	})
+
+	It("fails when the provider fails", func() {
+		provider.err = fmt.Errorf("failed to update")
+		Expect(NewInServiceFilter(provider).Update(instances)).ToNot(Succeed())
+	})
+})
+
+var _ = Describe("Templated health checker", func() {
+	It("checks the templated members and returns the untemplated instances", func() {
+		instances := []cloud.Instance{
+			{Name: "i-1", Endpoint: "192.168.0.1", Tags: map[string]string{"Name": "etcd-1"}},
+			{Name: "i-2", Endpoint: "192.168.0.2", Tags: map[string]string{"Name": "etcd-2"}},
+		}
+		templates, err := cloud.ParseInstanceTemplates("{{.Tags.Name}}", "")
+		Expect(err).To(BeNil())
+		checker := &mockHealthChecker{healthy: []cloud.Instance{{Name: "etcd-2", Endpoint: "192.168.0.2"}}}
+
+		healthy, err := NewTemplatedHealthChecker(checker, templates).HealthyInstances(instances)
+		Expect(err).To(BeNil())
+		Expect(healthy).To(Equal(instances[1:]))
+		Expect(checker.checked[0].Name).To(Equal("etcd-1"))
+		Expect(checker.checked[1].Name).To(Equal("etcd-2"))
+	})
+
+	It("fails when the templates can't be applied", func() {
+		templates, err := cloud.ParseInstanceTemplates("{{.Tags.Name}}", "")
+		Expect(err).To(BeNil())
+		_, err = NewTemplatedHealthChecker(&mockHealthChecker{}, templates).HealthyInstances([]cloud.Instance{{Name: "i-1"}})
+		Expect(err).ToNot(BeNil())
+	})
+})
+
+var _ = Describe("Member names", func() {
+	var (
+		instances []cloud.Instance
+		templates cloud.InstanceTemplates
+		provider  *mockProvider
+	)
+
+	BeforeEach(func() {
+		instances = []cloud.Instance{
+			{
+				Name:                "i-1",
+				Endpoint:            "192.168.0.1",
+				AdditionalEndpoints: []string{"fd00::1"},
+				PrivateDNSName:      "ip-192-168-0-1.internal",
+				Tags:                map[string]string{"Name": "etcd-1"},
+			},
+			{
+				Name:           "i-2",
+				Endpoint:       "192.168.0.2",
+				PrivateDNSName: "ip-192-168-0-2.internal",
+				Tags:           map[string]string{"Name": "etcd-2"},
+			},
+		}
+		var err error
+		templates, err = cloud.ParseInstanceTemplates("{{.Tags.Name}}", "{{.PrivateDNSName}}")
+		Expect(err).To(BeNil())
+		provider = &mockProvider{}
+	})
+
+	It("registers the instances by their member names and addresses", func() {
+		Expect(NewMemberNames(provider, templates).Update(instances)).To(Succeed())
+		Expect(provider.updates).To(HaveLen(1))
+		Expect(provider.updates[0][0].Name).To(Equal("etcd-1"))
+		Expect(provider.updates[0][0].ClientAddresses()).To(Equal([]string{"192.168.0.1", "fd00::1"}))
+		Expect(provider.updates[0][1].Name).To(Equal("etcd-2"))
+		Expect(provider.updates[0][1].ClientAddresses()).To(Equal([]string{"192.168.0.2"}))
+	})
+
+	It("publishes the SRV layout of the member names etcd is bootstrapped with", func() {
+		const fqdn = "etcd.example.com."
+		Expect(NewMemberNames(provider, templates).Update(instances)).To(Succeed())
+		layout := dnsrecords.Layout{NodeRecords: true, SRVService: "etcd-bootstrap"}
+		recordSets, err := layout.RecordSets(fqdn, provider.updates[0])
+		Expect(err).To(BeNil())
+
+		srv := recordSets[len(recordSets)-1]
+		for i, instance := range instances {
+			member, err := templates.Apply(instance)
+			Expect(err).To(BeNil())
+			Expect(srv.Values[i]).To(Equal("0 0 2379 " + member.Name + "." + fqdn))
+			Expect(recordSets).To(ContainElement(dnsrecords.RecordSet{
+				Name:   member.Name + "." + fqdn,
+				Type:   dnsrecords.TypeTXT,
+				Values: []string{`"name=` + member.Name + `"`},
+			}))
+		}
+		Expect(recordSets).To(ContainElement(dnsrecords.RecordSet{
+			Name:   "etcd-1." + fqdn,
+			Type:   dnsrecords.TypeAAAA,
+			Values: []string{"fd00::1"},
+		}))
+	})
+
+	It("fails when the member name template can't be applied", func() {
+		instances[1].Tags = nil
+		Expect(NewMemberNames(provider, templates).Update(instances)).ToNot(Succeed())
+		Expect(provider.updates).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Multi", func() {
+	var instances []cloud.Instance
+
+	BeforeEach(func() {
+		instances = []cloud.Instance{{Name: "etcd-1", Endpoint: "192.168.0.1"}}
+	})
+
+	It("updates every provider", func() {
+		first, second := &mockProvider{}, &mockProvider{}
+		multi := NewMulti()
+		multi.Add("first", first)
+		multi.Add("second", second)
+		Expect(multi.Update(instances)).To(Succeed())
+		Expect(first.updates).To(Equal([][]cloud.Instance{instances}))
+		Expect(second.updates).To(Equal([][]cloud.Instance{instances}))
+	})
+
+	It("updates the remaining providers when one fails, and reports the failure", func() {
+		failing, working := &mockProvider{err: fmt.Errorf("failed to update")}, &mockProvider{}
+		multi := NewMulti()
+		multi.Add("failing", failing)
+		multi.Add("working", working)
+		err := multi.Update(instances)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("failing: failed to update"))
+		Expect(err.Error()).ToNot(ContainSubstring("working"))
+		Expect(working.updates).To(Equal([][]cloud.Instance{instances}))
+	})
+})
+
+type mockProvider struct {
+	updates [][]cloud.Instance
+	err     error
+}
+
+func (m *mockProvider) Update(instances []cloud.Instance) error {
+	m.updates = append(m.updates, instances)
+	return m.err
+}
+
+type mockHealthChecker struct {
+	checked []cloud.Instance
+	healthy []cloud.Instance
+	err     error
+}
+
+func (m *mockHealthChecker) HealthyInstances(instances []cloud.Instance) ([]cloud.Instance, error) {
+	m.checked = instances
+	return m.healthy, m.err
+}